@@ -0,0 +1,356 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package activator implements the proxy that Routers send the requests of
+// sleeping DeploymentVersions to, and the requests of versions pinned on the
+// same host and path of an nginx Ingress. It wakes the version, waits for it
+// to become ready and forwards the request.
+package activator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// activityResolution is how often the activity of an awake version is
+// recorded.
+const activityResolution = time.Minute
+
+// Activator wakes sleeping DeploymentVersions on request.
+type Activator struct {
+	Client client.Client
+
+	// Namespace is where the DeploymentVersions are looked up.
+	Namespace string
+	// Header and Cookie carry the pin value of Header mode routes, as set in
+	// the pinning of the Router.
+	Header string
+	Cookie string
+	// Domain is the Router domain. The first label of a host under it names
+	// the version in Host mode routes.
+	Domain string
+
+	// Timeout bounds how long a request waits for the version to be ready.
+	Timeout time.Duration
+	// PollInterval is how often the readiness of the version is checked.
+	PollInterval time.Duration
+
+	// BackendURL returns the address requests to a version Service are
+	// forwarded to. It defaults to the cluster DNS name of the Service.
+	BackendURL func(service *corev1.Service) *url.URL
+}
+
+// ServeHTTP resolves the version a request is for, wakes it and forwards the
+// request to its Service.
+func (a *Activator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	log := log.FromContext(ctx)
+
+	version, prefix, err := a.resolveVersion(ctx, req)
+	if err != nil {
+		log.Error(err, "Unable to resolve DeploymentVersion")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if version == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if err := a.wake(ctx, version); err != nil {
+		log.Error(err, "Unable to wake DeploymentVersion", "version", version.Name)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, a.timeout())
+	defer cancel()
+	if err := a.waitReady(waitCtx, version); err != nil {
+		log.Error(err, "DeploymentVersion did not become ready", "version", version.Name)
+		http.Error(w, fmt.Sprintf("version %s is not ready", version.Name), http.StatusGatewayTimeout)
+		return
+	}
+
+	var service corev1.Service
+	serviceName := types.NamespacedName{Namespace: version.Namespace, Name: version.Status.ServiceName}
+	if err := a.Client.Get(ctx, serviceName, &service); err != nil {
+		log.Error(err, "Unable to fetch version Service", "version", version.Name)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	port, err := a.servicePort(ctx, version, &service, req.Host)
+	if err != nil {
+		log.Error(err, "Unable to find the port of the version Service", "version", version.Name)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(a.backendURL(&service, port))
+	if prefix != "" {
+		req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		req.URL.RawPath = ""
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// resolveVersion finds the version pinned by the header or cookie of the
+// request, as rendered by the Router in Header mode, or else the version named
+// by the host or the first path segment of the request. For a path segment it
+// also returns the prefix to strip before forwarding.
+func (a *Activator) resolveVersion(ctx context.Context, req *http.Request) (*kyaninusv1.DeploymentVersion, string, error) {
+	if value := a.pinValue(req); value != "" {
+		version, err := a.pinnedVersion(ctx, value)
+		if err != nil || version != nil {
+			return version, "", err
+		}
+	}
+
+	type candidate struct{ name, prefix string }
+	var candidates []candidate
+
+	if a.Domain != "" {
+		host := strings.Split(req.Host, ":")[0]
+		if strings.HasSuffix(host, "."+a.Domain) {
+			candidates = append(candidates, candidate{name: strings.TrimSuffix(host, "."+a.Domain)})
+		}
+	}
+	if segment := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]; segment != "" {
+		candidates = append(candidates, candidate{name: segment, prefix: "/" + segment})
+	}
+
+	for _, c := range candidates {
+		if strings.Contains(c.name, ".") {
+			continue
+		}
+		var version kyaninusv1.DeploymentVersion
+		err := a.Client.Get(ctx, types.NamespacedName{Namespace: a.Namespace, Name: c.name}, &version)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return &version, c.prefix, nil
+	}
+	return nil, "", nil
+}
+
+// pinValue returns the value pinning the request to a version: the value of
+// the pinning header, or of the cookie as Traefik matches it (<cookie>=<value>),
+// or the name of the cookie as nginx matches it (<cookie>-<value>=always).
+func (a *Activator) pinValue(req *http.Request) string {
+	if a.Header != "" {
+		if value := req.Header.Get(a.Header); value != "" {
+			return value
+		}
+	}
+	if a.Cookie == "" {
+		return ""
+	}
+	for _, cookie := range req.Cookies() {
+		switch {
+		case cookie.Name == a.Cookie:
+			return cookie.Value
+		case strings.HasPrefix(cookie.Name, a.Cookie+"-") && cookie.Value == "always":
+			return strings.TrimPrefix(cookie.Name, a.Cookie+"-")
+		}
+	}
+	return ""
+}
+
+// pinnedVersion finds the version whose pin value is value, as the Router
+// pins them.
+func (a *Activator) pinnedVersion(ctx context.Context, value string) (*kyaninusv1.DeploymentVersion, error) {
+	var versions kyaninusv1.DeploymentVersionList
+	if err := a.Client.List(ctx, &versions, client.InNamespace(a.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range versions.Items {
+		if versions.Items[i].PinValue() == value {
+			return &versions.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// wake records the version as awake in its status and scales its workload
+// back up to the replicas it had before sleeping.
+func (a *Activator) wake(ctx context.Context, version *kyaninusv1.DeploymentVersion) error {
+	replicas := int32(1)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := a.Client.Get(ctx, client.ObjectKeyFromObject(version), version); err != nil {
+			return err
+		}
+		now := metav1.Now()
+		sleep := version.Status.Sleep
+		awake := sleep == nil || !sleep.Asleep
+		if last := version.Status.LastActivityTime; awake && last != nil && now.Sub(last.Time) < activityResolution {
+			// Pinned requests may all pass through the activator.
+			return nil
+		}
+		version.Status.LastActivityTime = &now
+
+		if awake {
+			return a.Client.Status().Update(ctx, version)
+		}
+		if sleep.Replicas > 0 {
+			replicas = sleep.Replicas
+		}
+		sleep.Asleep = false
+		sleep.Since = &now
+		return a.Client.Status().Update(ctx, version)
+	})
+	if err != nil {
+		return err
+	}
+
+	workload := workloadOf(version)
+	if err := a.Client.Get(ctx, client.ObjectKeyFromObject(workload), workload); err != nil {
+		return err
+	}
+	if current, found, _ := unstructured.NestedInt64(workload.Object, "spec", "replicas"); found && current > 0 {
+		return nil
+	}
+
+	patch := client.MergeFrom(workload.DeepCopy())
+	if err := unstructured.SetNestedField(workload.Object, int64(replicas), "spec", "replicas"); err != nil {
+		return err
+	}
+	return a.Client.Patch(ctx, workload, patch)
+}
+
+// waitReady polls the workload of the version until a replica is available.
+func (a *Activator) waitReady(ctx context.Context, version *kyaninusv1.DeploymentVersion) error {
+	interval := a.PollInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		workload := workloadOf(version)
+		if err := a.Client.Get(ctx, client.ObjectKeyFromObject(workload), workload); err != nil {
+			return err
+		}
+		// Not every StatefulSet reports available replicas, ready ones serve too.
+		available, _, _ := unstructured.NestedInt64(workload.Object, "status", "availableReplicas")
+		ready, _, _ := unstructured.NestedInt64(workload.Object, "status", "readyReplicas")
+		if available > 0 || ready > 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// workloadOf returns the workload generated for a version, to be fetched.
+func workloadOf(version *kyaninusv1.DeploymentVersion) *unstructured.Unstructured {
+	workload := &unstructured.Unstructured{}
+	workload.SetGroupVersionKind(version.WorkloadGroupVersionKind())
+	workload.SetNamespace(version.Namespace)
+	workload.SetName(version.Status.DeploymentName)
+	return workload
+}
+
+func (a *Activator) timeout() time.Duration {
+	if a.Timeout == 0 {
+		return 2 * time.Minute
+	}
+	return a.Timeout
+}
+
+func (a *Activator) backendURL(service *corev1.Service, port int32) *url.URL {
+	if a.BackendURL != nil {
+		return a.BackendURL(service)
+	}
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("%s.%s.svc:%d", service.Name, service.Namespace, port)}
+}
+
+// servicePort returns the port of the version Service matching the port the
+// base Ingress sends to the base Service, preferring the rules for the host of
+// the request. The version Service is a clone of the base Service, so ports
+// keep their names and numbers. Without such a backend it is the first port.
+func (a *Activator) servicePort(ctx context.Context, version *kyaninusv1.DeploymentVersion, service *corev1.Service, host string) (int32, error) {
+	var backend *networkingv1.ServiceBackendPort
+	if version.Spec.ServiceRef != nil {
+		var ingresses networkingv1.IngressList
+		if err := a.Client.List(ctx, &ingresses, client.InNamespace(version.Namespace)); err != nil {
+			return 0, err
+		}
+		host = strings.Split(host, ":")[0]
+		hostMatched := false
+		for _, ingress := range ingresses.Items {
+			rules := ingress.Spec.Rules
+			if defaultBackend := ingress.Spec.DefaultBackend; defaultBackend != nil {
+				rules = append(rules, networkingv1.IngressRule{IngressRuleValue: networkingv1.IngressRuleValue{
+					HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{{Backend: *defaultBackend}}},
+				}})
+			}
+			for _, rule := range rules {
+				if rule.HTTP == nil || hostMatched {
+					continue
+				}
+				for _, path := range rule.HTTP.Paths {
+					if path.Backend.Service == nil || path.Backend.Service.Name != version.Spec.ServiceRef.Name {
+						continue
+					}
+					if backend == nil || rule.Host == host {
+						port := path.Backend.Service.Port
+						backend = &port
+						hostMatched = rule.Host == host
+						break
+					}
+				}
+			}
+		}
+	}
+
+	for _, port := range service.Spec.Ports {
+		if backend == nil ||
+			(backend.Name != "" && port.Name == backend.Name) ||
+			(backend.Name == "" && port.Port == backend.Number) {
+			return port.Port, nil
+		}
+	}
+	if len(service.Spec.Ports) > 0 {
+		return service.Spec.Ports[0].Port, nil
+	}
+	return 80, nil
+}
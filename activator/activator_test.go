@@ -0,0 +1,272 @@
+package activator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := kyaninusv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func sleepingVersion() (*kyaninusv1.DeploymentVersion, *appsv1.Deployment, *corev1.Service) {
+	since := metav1.NewTime(time.Now().Add(-time.Hour))
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "v2", Namespace: "default"},
+		Status: kyaninusv1.DeploymentVersionStatus{
+			DeploymentName: "v2",
+			ServiceName:    "v2",
+			Sleep:          &kyaninusv1.SleepStatus{Asleep: true, Since: &since, Replicas: 2},
+		},
+	}
+	zero := int32(0)
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "v2", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &zero},
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "v2", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+	}
+	return version, deploy, service
+}
+
+// markAvailable plays the part of the Deployment controller, reporting the
+// Deployment available once it has been scaled up.
+func markAvailable(t *testing.T, c client.Client, done <-chan struct{}) {
+	t.Helper()
+	ctx := context.Background()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+		var deploy appsv1.Deployment
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "v2"}, &deploy); err != nil {
+			continue
+		}
+		if deploy.Spec.Replicas != nil && *deploy.Spec.Replicas > 0 && deploy.Status.AvailableReplicas == 0 {
+			deploy.Status.AvailableReplicas = *deploy.Spec.Replicas
+			_ = c.Status().Update(ctx, &deploy)
+		}
+	}
+}
+
+func TestActivatorWakesAndForwards(t *testing.T) {
+	var forwardedPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwardedPath = req.URL.Path
+		io.WriteString(w, "hello from v2")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	version, deploy, service := sleepingVersion()
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(version, deploy, service).Build()
+	a := &Activator{
+		Client:       c,
+		Namespace:    "default",
+		Header:       kyaninusv1.DefaultPinningHeader,
+		Timeout:      time.Second,
+		PollInterval: 5 * time.Millisecond,
+		BackendURL:   func(*corev1.Service) *url.URL { return backendURL },
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go markAvailable(t, c, done)
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/orders", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello from v2" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if forwardedPath != "/orders" {
+		t.Errorf("forwarded path %q, want the version prefix stripped", forwardedPath)
+	}
+
+	ctx := context.Background()
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deploy), deploy); err != nil {
+		t.Fatal(err)
+	}
+	if *deploy.Spec.Replicas != 2 {
+		t.Errorf("replicas = %d, want the 2 recorded before sleeping", *deploy.Spec.Replicas)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(version), version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Status.Sleep.Asleep || version.Status.LastActivityTime == nil {
+		t.Errorf("expected the version to be recorded awake and active, status %+v", version.Status)
+	}
+}
+
+func TestActivatorResolvesHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.Path)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	version, deploy, service := sleepingVersion()
+	deploy.Status.AvailableReplicas = 1
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(version, deploy, service).Build()
+	a := &Activator{
+		Client:     c,
+		Namespace:  "default",
+		Header:     kyaninusv1.DefaultPinningHeader,
+		BackendURL: func(*corev1.Service) *url.URL { return backendURL },
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set(kyaninusv1.DefaultPinningHeader, "v2")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "/orders" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestActivatorUnknownVersion(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build()
+	a := &Activator{Client: c, Namespace: "default"}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404", rec.Code)
+	}
+}
+
+func TestActivatorTimesOut(t *testing.T) {
+	version, deploy, service := sleepingVersion()
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(version, deploy, service).Build()
+	a := &Activator{
+		Client:       c,
+		Namespace:    "default",
+		Timeout:      20 * time.Millisecond,
+		PollInterval: 5 * time.Millisecond,
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want 504", rec.Code)
+	}
+}
+
+func TestActivatorResolvesPinValue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello from v2")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	version, deploy, service := sleepingVersion()
+	version.Spec.Routing = &kyaninusv1.VersionRouting{PinValue: "feature-123"}
+	deploy.Status.AvailableReplicas = 1
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(version, deploy, service).Build()
+	a := &Activator{
+		Client:     c,
+		Namespace:  "default",
+		Header:     kyaninusv1.DefaultPinningHeader,
+		Cookie:     "version",
+		BackendURL: func(*corev1.Service) *url.URL { return backendURL },
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie *http.Cookie
+	}{
+		{name: "header", header: "feature-123"},
+		{name: "traefik cookie", cookie: &http.Cookie{Name: "version", Value: "feature-123"}},
+		{name: "nginx cookie", cookie: &http.Cookie{Name: "version-feature-123", Value: "always"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			if tt.header != "" {
+				req.Header.Set(kyaninusv1.DefaultPinningHeader, tt.header)
+			}
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			a.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK || rec.Body.String() != "hello from v2" {
+				t.Errorf("got %d %q, want the request pinned to v2", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestActivatorServicePort(t *testing.T) {
+	version, _, service := sleepingVersion()
+	version.Spec.ServiceRef = &corev1.LocalObjectReference{Name: "myapp"}
+	service.Spec.Ports = []corev1.ServicePort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}}
+
+	pathType := networkingv1.PathTypePrefix
+	ingress := func(name, host string, port networkingv1.ServiceBackendPort) *networkingv1.Ingress {
+		return &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{
+				Host: host,
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path: "/", PathType: &pathType,
+						Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "myapp", Port: port}},
+					}},
+				}},
+			}}},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+		ingress("myapp", "myapp.example.com", networkingv1.ServiceBackendPort{Name: "http"}),
+		ingress("myapp-grpc", "grpc.example.com", networkingv1.ServiceBackendPort{Number: 9000}),
+	).Build()
+	a := &Activator{Client: c, Namespace: "default"}
+	ctx := context.Background()
+
+	for host, want := range map[string]int32{"myapp.example.com": 8080, "grpc.example.com:443": 9000} {
+		port, err := a.servicePort(ctx, version, service, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != want {
+			t.Errorf("port for %s = %d, want %d", host, port, want)
+		}
+	}
+
+	version.Spec.ServiceRef = &corev1.LocalObjectReference{Name: "unrouted"}
+	if port, _ := a.servicePort(ctx, version, service, "myapp.example.com"); port != 9090 {
+		t.Errorf("port = %d, want the first port without an Ingress backend", port)
+	}
+}
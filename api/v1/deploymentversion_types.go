@@ -17,8 +17,14 @@ limitations under the License.
 package v1
 
 import (
+	"encoding/json"
+
 	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -35,18 +41,483 @@ type DeploymentVersionSpec struct {
 	Namespace string `json:"namespace,omitempty"`
 	// +optional
 	TestProp string `json:"testProp,omitempty"`
+	// DeploymentSpec holds overrides for the spec of the base Deployment. Only
+	// the fields that are set take effect. Unlike in a Deployment, the
+	// selector, the template and its containers are optional.
 	// +optional
 	DeploymentSpec apps.DeploymentSpec `json:"deploymentSpec,omitempty"`
+	// RawDeploymentSpec is DeploymentSpec as it was decoded, keeping the
+	// fields explicitly set to a zero value, such as paused: false, which
+	// DeploymentSpec cannot tell from unset ones. It is not serialized.
+	RawDeploymentSpec json.RawMessage `json:"-"`
+
+	// WorkloadRef selects the kind of the base workload named by Name and
+	// Namespace. It defaults to an apps/v1 Deployment. For other workloads
+	// DeploymentSpec overrides the replicas, selector, template,
+	// minReadySeconds and revisionHistoryLimit they share with Deployments,
+	// while JSONPatch applies to their whole spec.
+	// +optional
+	WorkloadRef *WorkloadReference `json:"workloadRef,omitempty"`
+
+	// MergeStrategy selects how DeploymentSpec, or JSONPatch, is applied to
+	// the spec of the base Deployment.
+	// +kubebuilder:default=merge
+	// +optional
+	MergeStrategy MergeStrategy `json:"mergeStrategy,omitempty"`
+	// JSONPatch lists the RFC 6902 operations applied to the base spec when
+	// MergeStrategy is jsonpatch. Paths are relative to the DeploymentSpec,
+	// e.g. /replicas or /template/spec/containers/0/image.
+	// +optional
+	JSONPatch []JSONPatchOperation `json:"jsonPatch,omitempty"`
+
+	// Images sets the image of containers of the base pod template, keyed by
+	// container name. Like Env and Replicas it is applied after the merge, on
+	// top of DeploymentSpec or JSONPatch.
+	// +optional
+	Images map[string]string `json:"images,omitempty"`
+	// Env sets environment variables on every container of the pod template,
+	// replacing variables of the same name.
+	// +optional
+	Env map[string]string `json:"env,omitempty"`
+	// Replicas sets the replicas of the generated workload.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// ImagePolicy pins the image of a container to the digest of the newest
+	// matching tag in a registry, polled periodically. It is applied after
+	// Images.
+	// +optional
+	ImagePolicy *ImagePolicy `json:"imagePolicy,omitempty"`
+
+	// ServiceRef names the base Service to clone for this version. It is
+	// looked up in Spec.Namespace, next to the base Deployment.
+	// +optional
+	ServiceRef *core.LocalObjectReference `json:"serviceRef,omitempty"`
+	// ServiceOverrides are merged onto the spec of the cloned Service.
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	ServiceOverrides *core.ServiceSpec `json:"serviceOverrides,omitempty"`
+
+	// Resources lists other objects of the base Deployment, such as its
+	// ConfigMaps, Secrets, HorizontalPodAutoscalers and PodDisruptionBudgets,
+	// that are cloned for this version. References to cloned ConfigMaps and
+	// Secrets in the pod template are rewritten to the clones.
+	// +optional
+	Resources []VersionResource `json:"resources,omitempty"`
+
+	// Routing configures how Routers send traffic to this version.
+	// +optional
+	Routing *VersionRouting `json:"routing,omitempty"`
+
+	// Analysis progressively shifts traffic to this version while Prometheus
+	// metrics stay within their thresholds, and rolls it back otherwise. While
+	// set it replaces Routing.TrafficWeight.
+	// +optional
+	Analysis *CanaryAnalysis `json:"analysis,omitempty"`
+
+	// Promote writes the merged DeploymentSpec of this version onto the base
+	// Deployment, keeping the base selector and pod labels. It is applied once
+	// per generation of the DeploymentVersion.
+	// +optional
+	Promote bool `json:"promote,omitempty"`
+
+	// DeleteOthersOnPromote deletes the other DeploymentVersions of the same
+	// base Deployment after this version is promoted.
+	// +optional
+	DeleteOthersOnPromote bool `json:"deleteOthersOnPromote,omitempty"`
+
+	// Sleep scales the generated Deployment to zero once the version has
+	// served no requests for a while. Routers with an activator send the
+	// requests of a sleeping version to it, which wakes the version up.
+	// +optional
+	Sleep *SleepPolicy `json:"sleep,omitempty"`
+
+	// TTL deletes the version once it is this old.
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// ExpireAfterIdle deletes the version once it has served no requests for
+	// this long. Requests are counted from ingress metrics in Prometheus;
+	// without them the version is idle from its last spec update.
+	// +optional
+	ExpireAfterIdle *metav1.Duration `json:"expireAfterIdle,omitempty"`
+}
+
+// WorkloadReference names the kind of workload a version clones.
+type WorkloadReference struct {
+	// APIVersion of the workload, e.g. apps/v1 or argoproj.io/v1alpha1.
+	APIVersion string `json:"apiVersion"`
+	// Kind of the workload.
+	// +kubebuilder:validation:Enum=Deployment;StatefulSet;Rollout
+	Kind string `json:"kind"`
+}
+
+// WorkloadGroups maps the workload kinds a version may clone to their API
+// groups.
+var WorkloadGroups = map[string]string{
+	"Deployment":  "apps",
+	"StatefulSet": "apps",
+	"Rollout":     "argoproj.io",
+}
+
+// WorkloadGroupVersionKind is the kind of the base workload of the version.
+func (r *DeploymentVersion) WorkloadGroupVersionKind() schema.GroupVersionKind {
+	if r.Spec.WorkloadRef == nil {
+		return apps.SchemeGroupVersion.WithKind("Deployment")
+	}
+	return schema.FromAPIVersionAndKind(r.Spec.WorkloadRef.APIVersion, r.Spec.WorkloadRef.Kind)
+}
+
+// PinValue is the header or cookie value pinning requests to the version in
+// a Router's Header mode: its routing.pinValue, or else its name.
+func (r *DeploymentVersion) PinValue() string {
+	if r.Spec.Routing != nil && r.Spec.Routing.PinValue != "" {
+		return r.Spec.Routing.PinValue
+	}
+	return r.Name
+}
+
+// UnmarshalJSON decodes the spec, keeping the raw deploymentSpec in
+// RawDeploymentSpec.
+func (s *DeploymentVersionSpec) UnmarshalJSON(data []byte) error {
+	type spec DeploymentVersionSpec
+	var decoded struct {
+		spec
+		RawDeploymentSpec json.RawMessage `json:"deploymentSpec,omitempty"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if len(decoded.RawDeploymentSpec) > 0 {
+		if err := json.Unmarshal(decoded.RawDeploymentSpec, &decoded.spec.DeploymentSpec); err != nil {
+			return err
+		}
+	}
+	*s = DeploymentVersionSpec(decoded.spec)
+	s.RawDeploymentSpec = decoded.RawDeploymentSpec
+	return nil
+}
+
+// MergeStrategy describes how the overrides of a version are applied to its
+// base Deployment.
+// +kubebuilder:validation:Enum=merge;strategic;jsonpatch
+type MergeStrategy string
+
+const (
+	// MergeStrategyMerge overlays the non-empty fields of DeploymentSpec on the
+	// base. Lists are replaced and zero values never override the base.
+	MergeStrategyMerge MergeStrategy = "merge"
+	// MergeStrategyStrategic applies DeploymentSpec as a strategic merge patch,
+	// so containers, env and volumes are merged by name.
+	MergeStrategyStrategic MergeStrategy = "strategic"
+	// MergeStrategyJSONPatch applies the operations in JSONPatch to the base.
+	MergeStrategyJSONPatch MergeStrategy = "jsonpatch"
+)
+
+// JSONPatchOperation is a single RFC 6902 operation.
+type JSONPatchOperation struct {
+	// +kubebuilder:validation:Enum=add;remove;replace;move;copy;test
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// From is the source path of move and copy operations.
+	// +optional
+	From string `json:"from,omitempty"`
+	// Value is the value of add, replace and test operations.
+	// +optional
+	Value *apiextensionsv1.JSON `json:"value,omitempty"`
+}
+
+// VersionResource names a base object cloned for a version, and the
+// overrides applied to the clone.
+type VersionResource struct {
+	// APIVersion of the object, e.g. v1 or autoscaling/v2beta2.
+	APIVersion string `json:"apiVersion"`
+	// Kind of the object, e.g. ConfigMap.
+	Kind string `json:"kind"`
+	// Name of the base object. It is looked up in Spec.Namespace, next to
+	// the base Deployment, and cloned as <name>-<version>.
+	Name string `json:"name"`
+	// Patch is an RFC 7386 merge patch applied to the clone.
+	// +optional
+	Patch *apiextensionsv1.JSON `json:"patch,omitempty"`
+	// JSONPatch lists the RFC 6902 operations applied to the clone after Patch.
+	// +optional
+	JSONPatch []JSONPatchOperation `json:"jsonPatch,omitempty"`
+}
+
+// ImagePolicy selects the image of a container among the tags of a registry
+// repository.
+type ImagePolicy struct {
+	// Container is the name of the container whose image is pinned.
+	Container string `json:"container"`
+	// Repository is the image repository polled, e.g.
+	// registry.example.com/myapp. It defaults to the repository of the
+	// container image.
+	// +optional
+	Repository string `json:"repository,omitempty"`
+	// TagPattern is a regular expression the tags must match, e.g. ^main-.
+	// Every tag matches when it is empty.
+	// +optional
+	TagPattern string `json:"tagPattern,omitempty"`
+	// Select picks one of the matching tags.
+	// +kubebuilder:default=Latest
+	// +optional
+	Select ImageSelect `json:"select,omitempty"`
+	// Interval is how often the registry is polled. It defaults to 5m.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// PullSecretRef names a kubernetes.io/dockerconfigjson Secret, in the
+	// namespace of the version, holding the registry credentials.
+	// +optional
+	PullSecretRef *core.LocalObjectReference `json:"pullSecretRef,omitempty"`
+}
+
+// ImageSelect is the rule choosing among the tags matched by an ImagePolicy.
+// +kubebuilder:validation:Enum=Latest;Semver
+type ImageSelect string
+
+const (
+	// ImageSelectLatest picks the tag of the most recently created image.
+	ImageSelectLatest ImageSelect = "Latest"
+	// ImageSelectSemver picks the highest semantic version, ignoring tags
+	// that are not one. A leading v is allowed.
+	ImageSelectSemver ImageSelect = "Semver"
+)
+
+// ImageStatus records the image resolved by an ImagePolicy.
+type ImageStatus struct {
+	// Container is the name of the pinned container.
+	Container string `json:"container"`
+	// Tag is the selected tag.
+	Tag string `json:"tag"`
+	// Digest is the manifest digest the tag resolved to.
+	Digest string `json:"digest"`
+	// Image is the pinned image reference, repository@digest.
+	Image string `json:"image"`
+	// LastPollTime is when the registry was last polled.
+	// +optional
+	LastPollTime *metav1.Time `json:"lastPollTime,omitempty"`
+}
+
+// SleepPolicy configures when an idle version is scaled to zero.
+type SleepPolicy struct {
+	// AfterIdle is how long the version may serve no requests before it is
+	// scaled to zero.
+	AfterIdle metav1.Duration `json:"afterIdle"`
+}
+
+// SleepStatus records whether a version is scaled to zero.
+type SleepStatus struct {
+	// Asleep is true while the generated Deployment is scaled to zero.
+	Asleep bool `json:"asleep"`
+	// Since is when the version last fell asleep or woke up.
+	// +optional
+	Since *metav1.Time `json:"since,omitempty"`
+	// Replicas is the replica count restored when the version wakes up.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+}
+
+// CanaryAnalysis walks a version through increasing traffic weights, checking
+// Prometheus metrics before each step.
+type CanaryAnalysis struct {
+	// StepWeights are the traffic weights the version moves through, e.g. [5, 25, 100].
+	// +kubebuilder:validation:MinItems=1
+	StepWeights []int32 `json:"stepWeights"`
+
+	// Interval is how long each step runs before its metrics are checked.
+	Interval metav1.Duration `json:"interval"`
+
+	// SuccessRate must stay at or above its threshold, e.g. 0.99.
+	// +optional
+	SuccessRate *MetricCheck `json:"successRate,omitempty"`
+
+	// Latency must stay at or below its threshold, e.g. 0.5 seconds.
+	// +optional
+	Latency *MetricCheck `json:"latency,omitempty"`
+}
+
+// MetricCheck is a PromQL query compared against a threshold. The query is a
+// Go template given the version's .Name, .Namespace and .ServiceName, and must
+// return a single sample.
+type MetricCheck struct {
+	Query string `json:"query"`
+	// +kubebuilder:validation:Pattern=`^-?[0-9]+(\.[0-9]+)?$`
+	Threshold string `json:"threshold"`
 }
 
+// AnalysisPhase is the state of a canary analysis.
+type AnalysisPhase string
+
+const (
+	// AnalysisProgressing means the version is being moved through its steps.
+	AnalysisProgressing AnalysisPhase = "Progressing"
+	// AnalysisSucceeded means every step passed.
+	AnalysisSucceeded AnalysisPhase = "Succeeded"
+	// AnalysisRolledBack means a metric check failed and traffic was withdrawn.
+	AnalysisRolledBack AnalysisPhase = "RolledBack"
+)
+
+// AnalysisStatus records the progress of a canary analysis.
+type AnalysisStatus struct {
+	Phase AnalysisPhase `json:"phase"`
+	// Step is the index of the current step weight.
+	Step int32 `json:"step"`
+	// Weight is the traffic weight currently applied to the version.
+	Weight int32 `json:"weight"`
+	// StepStartTime is when the current step started.
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+	// Message describes the last metric checks.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// PodTemplateHash is the hash of the pod template of the generated
+	// workload being analysed. The analysis starts over when it changes.
+	// +optional
+	PodTemplateHash string `json:"podTemplateHash,omitempty"`
+}
+
+// VersionRouting configures how Routers send traffic to a DeploymentVersion.
+type VersionRouting struct {
+	// PinValue is the header or cookie value that pins a request to this
+	// version in a Router's Header mode. Defaults to the version name.
+	// +optional
+	PinValue string `json:"pinValue,omitempty"`
+
+	// TrafficWeight is the percentage of unpinned requests sent to this
+	// version, instead of the base Deployment, by a Router in Header mode.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	TrafficWeight *int32 `json:"trafficWeight,omitempty"`
+}
+
+// Condition types reported on a DeploymentVersion.
+const (
+	// ConditionReady is True once the generated Deployment has all of its
+	// desired replicas available.
+	ConditionReady = "Ready"
+	// ConditionBaseFound reports whether the base Deployment referenced by
+	// Spec.Name and Spec.Namespace could be fetched.
+	ConditionBaseFound = "BaseFound"
+	// ConditionMerged reports whether the version overrides could be merged
+	// onto the base Deployment.
+	ConditionMerged = "Merged"
+	// ConditionProgressing is True while the generated Deployment is rolling out.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the last reconcile failed or the generated
+	// Deployment reports a failure.
+	ConditionDegraded = "Degraded"
+	// ConditionPromoted is True once the version has been written onto the
+	// base Deployment.
+	ConditionPromoted = "Promoted"
+	// ConditionIsolated is True when the pods of the generated Deployment are
+	// not selected by the Services of the base Deployment.
+	ConditionIsolated = "Isolated"
+	// ConditionImageResolved reports whether the registry of Spec.ImagePolicy
+	// could be polled. The last resolved image stays pinned while it cannot.
+	ConditionImageResolved = "ImageResolved"
+)
+
+// Labels understood and set on DeploymentVersions and their pods.
+const (
+	// BaseLabel names the base Deployment of a DeploymentVersion when
+	// Spec.Name is left empty.
+	BaseLabel = "kyaninus.codepraxis.com/base"
+	// VersionLabel is set to the DeploymentVersion name on the selector and
+	// pod template of the generated Deployment, so its pods are never shared
+	// with the base Deployment.
+	VersionLabel = "kyaninus.codepraxis.com/version"
+)
+
 // DeploymentVersionStatus defines the observed state of DeploymentVersion
 type DeploymentVersionStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ObservedGeneration is the most recent generation reconciled by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// DeploymentName is the name of the workload generated for this version.
+	// +optional
+	DeploymentName string `json:"deploymentName,omitempty"`
+	// DeploymentUID is the UID of the workload generated for this version.
+	// +optional
+	DeploymentUID types.UID `json:"deploymentUID,omitempty"`
+	// ServiceName is the name of the Service cloned for this version.
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// Resources are the objects cloned for the Resources of this version.
+	// +optional
+	Resources []ClonedResource `json:"resources,omitempty"`
+
+	// Replicas is the number of pods targeted by the generated Deployment.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+	// ReadyReplicas is the number of ready pods of the generated Deployment.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+	// AvailableReplicas is the number of available pods of the generated Deployment.
+	// +optional
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+
+	// Analysis is the progress of the canary analysis, when one is configured.
+	// +optional
+	Analysis *AnalysisStatus `json:"analysis,omitempty"`
+
+	// PromotedGeneration is the generation of this version last written onto
+	// the base Deployment.
+	// +optional
+	PromotedGeneration int64 `json:"promotedGeneration,omitempty"`
+	// PromotedAt is when the version was last promoted.
+	// +optional
+	PromotedAt *metav1.Time `json:"promotedAt,omitempty"`
+
+	// Image is the image resolved by Spec.ImagePolicy.
+	// +optional
+	Image *ImageStatus `json:"image,omitempty"`
+
+	// Sleep is the sleep state of the version, when Spec.Sleep is set.
+	// +optional
+	Sleep *SleepStatus `json:"sleep,omitempty"`
+
+	// LastActivityTime is when the version last served a request, or had its
+	// spec updated.
+	// +optional
+	LastActivityTime *metav1.Time `json:"lastActivityTime,omitempty"`
+	// ExpiresAt is when the version will be deleted by its TTL or
+	// ExpireAfterIdle.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Conditions represent the latest available observations of the version's state.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// ClonedResource identifies an object cloned for a version.
+type ClonedResource struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Base",type=string,JSONPath=`.spec.name`
+//+kubebuilder:printcolumn:name="Workload",type=string,JSONPath=`.spec.workloadRef.kind`,priority=1
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Available",type=integer,JSONPath=`.status.availableReplicas`
+//+kubebuilder:printcolumn:name="Weight",type=integer,JSONPath=`.spec.routing.trafficWeight`
+//+kubebuilder:printcolumn:name="Asleep",type=boolean,JSONPath=`.status.sleep.asleep`,priority=1
+//+kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.status.expiresAt`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DeploymentVersion is the Schema for the deploymentversions API
 type DeploymentVersion struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
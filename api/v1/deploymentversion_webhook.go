@@ -0,0 +1,392 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+var (
+	// log is for logging in this package.
+	deploymentversionlog = logf.Log.WithName("deploymentversion-resource")
+
+	// webhookClient looks up the base Deployment of a version during
+	// validation. Checks that need it are skipped while it is unset.
+	webhookClient client.Reader
+
+	// allowCrossNamespaceBase permits versions of a Deployment in another
+	// namespace.
+	allowCrossNamespaceBase = true
+)
+
+// SetupWebhookWithManager registers the DeploymentVersion webhooks with the
+// manager. allowCrossNamespace controls whether a version may clone a base
+// Deployment from another namespace.
+func (r *DeploymentVersion) SetupWebhookWithManager(mgr ctrl.Manager, allowCrossNamespace bool) error {
+	webhookClient = mgr.GetClient()
+	allowCrossNamespaceBase = allowCrossNamespace
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-kyaninus-codepraxis-com-v1-deploymentversion,mutating=true,failurePolicy=fail,sideEffects=None,groups=kyaninus.codepraxis.com,resources=deploymentversions,verbs=create;update,versions=v1,name=mdeploymentversion.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &DeploymentVersion{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *DeploymentVersion) Default() {
+	deploymentversionlog.Info("default", "name", r.Name)
+
+	if r.Spec.Namespace == "" {
+		r.Spec.Namespace = r.Namespace
+	}
+	if r.Spec.Name == "" {
+		r.Spec.Name = r.Labels[BaseLabel]
+	}
+
+	// JSON patches are applied as written, the reconciler labels their pods.
+	if r.Spec.MergeStrategy == MergeStrategyJSONPatch {
+		return
+	}
+
+	template := &r.Spec.DeploymentSpec.Template
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	template.Labels[VersionLabel] = r.Name
+
+	// The selector of a Deployment is immutable, so it is only extended for
+	// versions that are being created.
+	if !r.CreationTimestamp.IsZero() {
+		return
+	}
+	if r.Spec.DeploymentSpec.Selector == nil {
+		r.Spec.DeploymentSpec.Selector = &metav1.LabelSelector{}
+	}
+	selector := r.Spec.DeploymentSpec.Selector
+	if selector.MatchLabels == nil {
+		selector.MatchLabels = map[string]string{}
+	}
+	selector.MatchLabels[VersionLabel] = r.Name
+}
+
+//+kubebuilder:webhook:path=/validate-kyaninus-codepraxis-com-v1-deploymentversion,mutating=false,failurePolicy=fail,sideEffects=None,groups=kyaninus.codepraxis.com,resources=deploymentversions,verbs=create;update,versions=v1,name=vdeploymentversion.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &DeploymentVersion{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *DeploymentVersion) ValidateCreate() error {
+	deploymentversionlog.Info("validate create", "name", r.Name)
+
+	return r.validateDeploymentVersion(nil)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *DeploymentVersion) ValidateUpdate(old runtime.Object) error {
+	deploymentversionlog.Info("validate update", "name", r.Name)
+
+	oldVersion, ok := old.(*DeploymentVersion)
+	if !ok {
+		return fmt.Errorf("expected a DeploymentVersion but got a %T", old)
+	}
+	// A version being deleted is only updated to remove its finalizer, which
+	// must not depend on the state of its base.
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.validateDeploymentVersion(oldVersion)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *DeploymentVersion) ValidateDelete() error {
+	deploymentversionlog.Info("validate delete", "name", r.Name)
+
+	// Deleting a version only removes what it generated.
+	return nil
+}
+
+func (r *DeploymentVersion) validateDeploymentVersion(old *DeploymentVersion) error {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if r.Spec.Name == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("name"), "the base Deployment must be named"))
+		return apierrors.NewInvalid(GroupVersion.WithKind("DeploymentVersion").GroupKind(), r.Name, allErrs)
+	}
+
+	baseNamespace := r.Spec.Namespace
+	if baseNamespace == "" {
+		baseNamespace = r.Namespace
+	}
+
+	if baseNamespace != r.Namespace && !allowCrossNamespaceBase {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("namespace"),
+			"versions of a Deployment in another namespace are not allowed"))
+	}
+	if baseNamespace == r.Namespace && r.Spec.Name == r.Name {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("name"), r.Spec.Name,
+			"the DeploymentVersion must not have the same name as its base Deployment"))
+	}
+
+	if ref := r.Spec.WorkloadRef; ref != nil {
+		refPath := specPath.Child("workloadRef")
+		group, supported := WorkloadGroups[ref.Kind]
+		if !supported {
+			allErrs = append(allErrs, field.NotSupported(refPath.Child("kind"), ref.Kind, []string{"Deployment", "StatefulSet", "Rollout"}))
+		} else if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || gv.Group != group {
+			allErrs = append(allErrs, field.Invalid(refPath.Child("apiVersion"), ref.APIVersion,
+				fmt.Sprintf("%s is served by the %s API group", ref.Kind, group)))
+		}
+	}
+	if old != nil && old.WorkloadGroupVersionKind() != r.WorkloadGroupVersionKind() {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("workloadRef"),
+			"the kind of the base workload is immutable"))
+	}
+
+	for i, resource := range r.Spec.Resources {
+		resourcePath := specPath.Child("resources").Index(i)
+		if resource.APIVersion == "" {
+			allErrs = append(allErrs, field.Required(resourcePath.Child("apiVersion"), ""))
+		}
+		if resource.Kind == "" {
+			allErrs = append(allErrs, field.Required(resourcePath.Child("kind"), ""))
+		}
+		if resource.Name == "" {
+			allErrs = append(allErrs, field.Required(resourcePath.Child("name"), ""))
+		}
+		if resource.APIVersion == "v1" && resource.Kind == "Secret" && baseNamespace != r.Namespace {
+			allErrs = append(allErrs, field.Forbidden(resourcePath,
+				"Secrets are only cloned within the namespace of the DeploymentVersion"))
+		}
+		if resource.Kind == r.WorkloadGroupVersionKind().Kind && resource.Name == r.Spec.Name {
+			allErrs = append(allErrs, field.Invalid(resourcePath.Child("name"), resource.Name,
+				"the base workload is cloned by the DeploymentVersion itself"))
+		}
+	}
+
+	// The base is only looked up when the fields checked against it change, so
+	// that status and metadata updates do not depend on its current state.
+	if old == nil || r.baseFieldsChanged(old) {
+		base, err := r.lookupBase(types.NamespacedName{Namespace: baseNamespace, Name: r.Spec.Name})
+		if err != nil {
+			allErrs = append(allErrs, err)
+		}
+
+		if err := r.validateSelector(base); err != nil {
+			allErrs = append(allErrs, err)
+		}
+		allErrs = append(allErrs, r.validateImages(base)...)
+		allErrs = append(allErrs, r.validateImagePolicy(base)...)
+	}
+	if old != nil && !apiequality.Semantic.DeepEqual(old.Spec.DeploymentSpec.Selector, r.Spec.DeploymentSpec.Selector) {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("deploymentSpec", "selector"),
+			"the selector of the generated Deployment is immutable"))
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("DeploymentVersion").GroupKind(), r.Name, allErrs)
+}
+
+// baseFieldsChanged reports whether the update changes any of the spec fields
+// that are validated against the base workload.
+func (r *DeploymentVersion) baseFieldsChanged(old *DeploymentVersion) bool {
+	return r.Spec.Name != old.Spec.Name ||
+		r.Spec.Namespace != old.Spec.Namespace ||
+		r.Spec.MergeStrategy != old.Spec.MergeStrategy ||
+		!apiequality.Semantic.DeepEqual(r.Spec.WorkloadRef, old.Spec.WorkloadRef) ||
+		!apiequality.Semantic.DeepEqual(r.Spec.DeploymentSpec, old.Spec.DeploymentSpec) ||
+		!apiequality.Semantic.DeepEqual(r.Spec.Images, old.Spec.Images) ||
+		!apiequality.Semantic.DeepEqual(r.Spec.ImagePolicy, old.Spec.ImagePolicy)
+}
+
+// lookupBase fetches the base workload, and rejects it if it was generated
+// for another DeploymentVersion. Other workloads than Deployments are returned
+// with the selector and template labels they share with Deployments. It
+// returns a nil Deployment when the base cannot be looked up.
+func (r *DeploymentVersion) lookupBase(name types.NamespacedName) (*apps.Deployment, *field.Error) {
+	if webhookClient == nil {
+		return nil, nil
+	}
+	ctx := context.Background()
+	namePath := field.NewPath("spec", "name")
+
+	var version DeploymentVersion
+	if err := webhookClient.Get(ctx, name, &version); err == nil {
+		return nil, field.Invalid(namePath, name.Name,
+			fmt.Sprintf("%s is the Deployment generated for DeploymentVersion %s, not a base Deployment", name.Name, version.Name))
+	}
+
+	gvk := r.WorkloadGroupVersionKind()
+	workload := &unstructured.Unstructured{}
+	workload.SetGroupVersionKind(gvk)
+	if err := webhookClient.Get(ctx, name, workload); err != nil {
+		return nil, nil
+	}
+	if owner := metav1.GetControllerOf(workload); owner != nil && owner.Kind == "DeploymentVersion" &&
+		strings.HasPrefix(owner.APIVersion, GroupVersion.Group+"/") {
+		return nil, field.Invalid(namePath, name.Name,
+			fmt.Sprintf("%s is the %s generated for DeploymentVersion %s, not a base %s", name.Name, gvk.Kind, owner.Name, gvk.Kind))
+	}
+
+	base := &apps.Deployment{ObjectMeta: metav1.ObjectMeta{Name: workload.GetName(), Namespace: workload.GetNamespace()}}
+	if matchLabels, found, _ := unstructured.NestedStringMap(workload.Object, "spec", "selector", "matchLabels"); found {
+		base.Spec.Selector = &metav1.LabelSelector{MatchLabels: matchLabels}
+	}
+	base.Spec.Template.Labels, _, _ = unstructured.NestedStringMap(workload.Object, "spec", "template", "metadata", "labels")
+	base.Spec.Template.Spec.InitContainers = namedContainers(workload, "initContainers")
+	base.Spec.Template.Spec.Containers = namedContainers(workload, "containers")
+	return base, nil
+}
+
+// namedContainers returns the containers of the pod template of a workload,
+// with only their names set.
+func namedContainers(workload *unstructured.Unstructured, key string) []core.Container {
+	items, _, _ := unstructured.NestedSlice(workload.Object, "spec", "template", "spec", key)
+	var containers []core.Container
+	for _, item := range items {
+		if container, ok := item.(map[string]interface{}); ok {
+			name, _, _ := unstructured.NestedString(container, "name")
+			containers = append(containers, core.Container{Name: name})
+		}
+	}
+	return containers
+}
+
+// validateImages checks that the containers named by Images exist in the pod
+// template of the base, or in the containers the overrides add to it. JSON
+// patches may add containers of their own, so they are not checked.
+func (r *DeploymentVersion) validateImages(base *apps.Deployment) field.ErrorList {
+	var allErrs field.ErrorList
+	imagesPath := field.NewPath("spec", "images")
+	names := r.containerNames(base)
+
+	// Keys are sorted so the errors are reported in a stable order.
+	keys := make([]string, 0, len(r.Spec.Images))
+	for name := range r.Spec.Images {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		if r.Spec.Images[name] == "" {
+			allErrs = append(allErrs, field.Required(imagesPath.Key(name), "the image must not be empty"))
+			continue
+		}
+		if base == nil || r.Spec.MergeStrategy == MergeStrategyJSONPatch || names[name] {
+			continue
+		}
+		allErrs = append(allErrs, field.NotFound(imagesPath.Key(name), name))
+	}
+	return allErrs
+}
+
+// validateImagePolicy checks the tag pattern of the ImagePolicy, and that its
+// container exists like the containers named by Images.
+func (r *DeploymentVersion) validateImagePolicy(base *apps.Deployment) field.ErrorList {
+	var allErrs field.ErrorList
+	policy := r.Spec.ImagePolicy
+	if policy == nil {
+		return nil
+	}
+	policyPath := field.NewPath("spec", "imagePolicy")
+
+	if policy.Container == "" {
+		allErrs = append(allErrs, field.Required(policyPath.Child("container"), ""))
+	} else if base != nil && r.Spec.MergeStrategy != MergeStrategyJSONPatch && !r.containerNames(base)[policy.Container] {
+		allErrs = append(allErrs, field.NotFound(policyPath.Child("container"), policy.Container))
+	}
+	if _, err := regexp.Compile(policy.TagPattern); err != nil {
+		allErrs = append(allErrs, field.Invalid(policyPath.Child("tagPattern"), policy.TagPattern, err.Error()))
+	}
+	if policy.Interval != nil && policy.Interval.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(policyPath.Child("interval"), policy.Interval.Duration.String(),
+			"the interval must not be negative"))
+	}
+	return allErrs
+}
+
+// containerNames returns the names of the containers of the pod template of
+// the base, and of the containers the overrides add to it.
+func (r *DeploymentVersion) containerNames(base *apps.Deployment) map[string]bool {
+	names := map[string]bool{}
+	podSpec := r.Spec.DeploymentSpec.Template.Spec
+	containers := append(append([]core.Container{}, podSpec.InitContainers...), podSpec.Containers...)
+	if base != nil {
+		containers = append(containers, base.Spec.Template.Spec.InitContainers...)
+		containers = append(containers, base.Spec.Template.Spec.Containers...)
+	}
+	for _, container := range containers {
+		names[container.Name] = true
+	}
+	return names
+}
+
+// validateSelector checks that the selector of the generated Deployment still
+// selects its own pods once the overrides are merged onto the base.
+func (r *DeploymentVersion) validateSelector(base *apps.Deployment) *field.Error {
+	override := r.Spec.DeploymentSpec
+	if override.Selector == nil || r.Spec.MergeStrategy == MergeStrategyJSONPatch {
+		return nil
+	}
+	selectorPath := field.NewPath("spec", "deploymentSpec", "selector")
+
+	selector := override.Selector.DeepCopy()
+	podLabels := labels.Set{}
+	if base != nil {
+		if base.Spec.Selector != nil {
+			selector.MatchLabels = labels.Merge(base.Spec.Selector.MatchLabels, selector.MatchLabels)
+		}
+		podLabels = labels.Merge(podLabels, base.Spec.Template.Labels)
+	}
+	podLabels = labels.Merge(podLabels, override.Template.Labels)
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return field.Invalid(selectorPath, override.Selector, err.Error())
+	}
+	if s.Empty() {
+		return field.Invalid(selectorPath, override.Selector, "the selector must not be empty")
+	}
+	if !s.Matches(podLabels) {
+		return field.Invalid(selectorPath, override.Selector,
+			fmt.Sprintf("the selector does not match the pod template labels %v", podLabels))
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func webhookTestClient(t *testing.T, objs ...client.Object) client.Reader {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func labelledDeployment(name string, labels map[string]string) *apps.Deployment {
+	return &apps.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: apps.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: core.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}},
+		},
+	}
+}
+
+func validVersion() *DeploymentVersion {
+	labels := map[string]string{"app": "myapp-v1"}
+	return &DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v1", Namespace: "default"},
+		Spec: DeploymentVersionSpec{
+			Name:      "myapp",
+			Namespace: "default",
+			DeploymentSpec: apps.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: core.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}},
+			},
+		},
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	isController := true
+	clone := labelledDeployment("myapp-v0", map[string]string{"app": "myapp-v0"})
+	clone.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: GroupVersion.String(), Kind: "DeploymentVersion", Name: "renamed", UID: "v0", Controller: &isController,
+	}}
+	existingVersion := &DeploymentVersion{ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default"}}
+
+	base := labelledDeployment("myapp", map[string]string{"app": "myapp"})
+	base.Spec.Template.Spec.Containers = []core.Container{{Name: "app", Image: "myapp:1"}}
+
+	webhookClient = webhookTestClient(t, base, clone, existingVersion)
+	defer func() { webhookClient = nil }()
+
+	tests := []struct {
+		name         string
+		mutate       func(v *DeploymentVersion)
+		crossNsAllow bool
+		wantErr      bool
+	}{
+		{name: "valid", mutate: func(v *DeploymentVersion) {}, crossNsAllow: true},
+		{name: "empty base", mutate: func(v *DeploymentVersion) { v.Spec.Name = "" }, crossNsAllow: true, wantErr: true},
+		{name: "base is a clone by owner", mutate: func(v *DeploymentVersion) { v.Spec.Name = "myapp-v0" }, crossNsAllow: true, wantErr: true},
+		{name: "base is another version", mutate: func(v *DeploymentVersion) { v.Spec.Name = "myapp-v2" }, crossNsAllow: true, wantErr: true},
+		{name: "name collides with base", mutate: func(v *DeploymentVersion) { v.Name = "myapp" }, crossNsAllow: true, wantErr: true},
+		{
+			name:         "name matches a base in another namespace",
+			mutate:       func(v *DeploymentVersion) { v.Name = "myapp"; v.Spec.Namespace = "other" },
+			crossNsAllow: true,
+		},
+		{
+			name:    "cross namespace disallowed",
+			mutate:  func(v *DeploymentVersion) { v.Spec.Namespace = "other" },
+			wantErr: true,
+		},
+		{
+			name:   "same namespace when cross namespace is disallowed",
+			mutate: func(v *DeploymentVersion) { v.Spec.Namespace = "" },
+		},
+		{
+			name: "secret cloned across namespaces",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Namespace = "other"
+				v.Spec.Resources = []VersionResource{{APIVersion: "v1", Kind: "Secret", Name: "myapp-secret"}}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "configmap cloned across namespaces",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Namespace = "other"
+				v.Spec.Resources = []VersionResource{{APIVersion: "v1", Kind: "ConfigMap", Name: "myapp-config"}}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "selector does not match pod labels",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.DeploymentSpec.Template.Labels = map[string]string{"app": "other"}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "selector merged with the base no longer matches",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.DeploymentSpec.Selector.MatchLabels = map[string]string{"track": "canary"}
+				v.Spec.DeploymentSpec.Template.Labels = map[string]string{"track": "canary", "app": "myapp-v1"}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "selector merged with the base pod labels",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.DeploymentSpec.Selector.MatchLabels = map[string]string{"track": "canary"}
+				v.Spec.DeploymentSpec.Template.Labels = map[string]string{"track": "canary"}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "statefulset workload",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.WorkloadRef = &WorkloadReference{APIVersion: "apps/v1", Kind: "StatefulSet"}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "rollout workload in the wrong group",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.WorkloadRef = &WorkloadReference{APIVersion: "apps/v1", Kind: "Rollout"}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "unsupported workload",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.WorkloadRef = &WorkloadReference{APIVersion: "apps/v1", Kind: "DaemonSet"}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "resource",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Resources = []VersionResource{{APIVersion: "v1", Kind: "ConfigMap", Name: "myapp-config"}}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "resource without a kind",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Resources = []VersionResource{{APIVersion: "v1", Name: "myapp-config"}}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "resource is the base Deployment",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Resources = []VersionResource{{APIVersion: "apps/v1", Kind: "Deployment", Name: "myapp"}}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "image of a base container",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.Images = map[string]string{"app": "myapp:2"}
+				v.Spec.Env = map[string]string{"FEATURE": "on"}
+				replicas := int32(2)
+				v.Spec.Replicas = &replicas
+			},
+			crossNsAllow: true,
+		},
+		{
+			name:         "image of an unknown container",
+			mutate:       func(v *DeploymentVersion) { v.Spec.Images = map[string]string{"sidecar": "proxy:2"} },
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "image of a container added by the overrides",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.DeploymentSpec.Template.Spec.Containers = []core.Container{{Name: "sidecar", Image: "proxy:1"}}
+				v.Spec.Images = map[string]string{"sidecar": "proxy:2"}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "image of an unknown container with a JSON patch",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.MergeStrategy = MergeStrategyJSONPatch
+				v.Spec.Images = map[string]string{"sidecar": "proxy:2"}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name:         "empty image",
+			mutate:       func(v *DeploymentVersion) { v.Spec.Images = map[string]string{"app": ""} },
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "image policy",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.ImagePolicy = &ImagePolicy{Container: "app", TagPattern: `^v1\.`, Select: ImageSelectSemver}
+			},
+			crossNsAllow: true,
+		},
+		{
+			name: "image policy of an unknown container",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.ImagePolicy = &ImagePolicy{Container: "sidecar"}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+		{
+			name: "image policy with an invalid tag pattern",
+			mutate: func(v *DeploymentVersion) {
+				v.Spec.ImagePolicy = &ImagePolicy{Container: "app", TagPattern: "main-("}
+			},
+			crossNsAllow: true,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowCrossNamespaceBase = tt.crossNsAllow
+			defer func() { allowCrossNamespaceBase = true }()
+
+			version := validVersion()
+			tt.mutate(version)
+			err := version.ValidateCreate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCreate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateSelectorImmutable(t *testing.T) {
+	old := validVersion()
+
+	updated := validVersion()
+	updated.Spec.DeploymentSpec.Template.Spec.Containers = []core.Container{{Name: "app", Image: "myapp:2"}}
+	if err := updated.ValidateUpdate(old); err != nil {
+		t.Errorf("expected an image change to be allowed, got %v", err)
+	}
+
+	labels := map[string]string{"app": "myapp-v1", "track": "canary"}
+	updated.Spec.DeploymentSpec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	updated.Spec.DeploymentSpec.Template.Labels = labels
+	if err := updated.ValidateUpdate(old); err == nil {
+		t.Errorf("expected a selector change to be rejected")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	version := &DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "myapp-v1",
+			Namespace: "default",
+			Labels:    map[string]string{BaseLabel: "myapp"},
+		},
+	}
+	version.Default()
+
+	if version.Spec.Name != "myapp" || version.Spec.Namespace != "default" {
+		t.Errorf("base reference = %s/%s, want default/myapp", version.Spec.Namespace, version.Spec.Name)
+	}
+	if got := version.Spec.DeploymentSpec.Selector.MatchLabels[VersionLabel]; got != "myapp-v1" {
+		t.Errorf("selector version label = %q, want myapp-v1", got)
+	}
+	if got := version.Spec.DeploymentSpec.Template.Labels[VersionLabel]; got != "myapp-v1" {
+		t.Errorf("pod template version label = %q, want myapp-v1", got)
+	}
+	if err := version.ValidateCreate(); err != nil {
+		t.Errorf("a defaulted version must be valid, got %v", err)
+	}
+}
+
+func TestDefaultKeepsExplicitFields(t *testing.T) {
+	version := validVersion()
+	version.Spec.Namespace = "other"
+	version.Labels = map[string]string{BaseLabel: "ignored"}
+	version.Default()
+
+	if version.Spec.Name != "myapp" || version.Spec.Namespace != "other" {
+		t.Errorf("base reference = %s/%s, want other/myapp", version.Spec.Namespace, version.Spec.Name)
+	}
+	selector := version.Spec.DeploymentSpec.Selector.MatchLabels
+	if selector["app"] != "myapp-v1" || selector[VersionLabel] != "myapp-v1" {
+		t.Errorf("selector = %v, want the explicit labels and the version label", selector)
+	}
+}
+
+func TestDefaultLeavesSelectorOfExistingVersion(t *testing.T) {
+	old := validVersion()
+	old.CreationTimestamp = metav1.Now()
+
+	updated := old.DeepCopy()
+	updated.Default()
+
+	if _, ok := updated.Spec.DeploymentSpec.Selector.MatchLabels[VersionLabel]; ok {
+		t.Errorf("the selector of an existing version must not change")
+	}
+	if updated.Spec.DeploymentSpec.Template.Labels[VersionLabel] != "myapp-v1" {
+		t.Errorf("expected the pod template to be labelled")
+	}
+	if err := updated.ValidateUpdate(old); err != nil {
+		t.Errorf("a defaulted update must be valid, got %v", err)
+	}
+}
+
+func TestValidateUpdateWorkloadImmutable(t *testing.T) {
+	old := validVersion()
+
+	updated := validVersion()
+	updated.Spec.WorkloadRef = &WorkloadReference{APIVersion: "apps/v1", Kind: "Deployment"}
+	if err := updated.ValidateUpdate(old); err != nil {
+		t.Errorf("expected the default workload to be made explicit, got %v", err)
+	}
+
+	updated.Spec.WorkloadRef = &WorkloadReference{APIVersion: "apps/v1", Kind: "StatefulSet"}
+	if err := updated.ValidateUpdate(old); err == nil {
+		t.Errorf("expected a workload kind change to be rejected")
+	}
+}
+
+func TestValidateUpdateSkipsUnchangedBase(t *testing.T) {
+	// The base lost the container the version sets an image for.
+	base := labelledDeployment("myapp", map[string]string{"app": "myapp"})
+	webhookClient = webhookTestClient(t, base)
+	defer func() { webhookClient = nil }()
+
+	old := validVersion()
+	old.Spec.Images = map[string]string{"app": "myapp:2"}
+
+	updated := old.DeepCopy()
+	updated.Labels = map[string]string{"team": "shop"}
+	if err := updated.ValidateUpdate(old); err != nil {
+		t.Errorf("expected a metadata update to be allowed, got %v", err)
+	}
+
+	deleted := old.DeepCopy()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	if err := deleted.ValidateUpdate(old); err != nil {
+		t.Errorf("expected the finalizer of a deleted version to be removable, got %v", err)
+	}
+
+	updated.Spec.Images = map[string]string{"app": "myapp:3"}
+	if err := updated.ValidateUpdate(old); err == nil {
+		t.Errorf("expected a changed image to be checked against the base")
+	}
+}
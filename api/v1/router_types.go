@@ -0,0 +1,178 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RoutingMode selects how a Router exposes each DeploymentVersion.
+// +kubebuilder:validation:Enum=Host;Path;Header
+type RoutingMode string
+
+const (
+	// RoutingModeHost routes version-1.mydomain.com to version-1.
+	RoutingModeHost RoutingMode = "Host"
+	// RoutingModePath routes mydomain.com/version-1 to version-1.
+	RoutingModePath RoutingMode = "Path"
+	// RoutingModeHeader keeps the hosts and paths of the base Ingress and
+	// routes requests pinned to a version by header or cookie, falling back
+	// to the base Deployment. Versions with a traffic weight also receive that
+	// share of the unpinned requests.
+	RoutingModeHeader RoutingMode = "Header"
+)
+
+// DefaultPinningHeader is the request header used by the Header routing mode
+// when a Router does not configure one.
+const DefaultPinningHeader = "X-Version"
+
+// VersionPinning names the request header and cookie that pin a request to a
+// DeploymentVersion in the Header routing mode.
+type VersionPinning struct {
+	// Header is the request header whose value names the version, e.g. X-Version.
+	// +optional
+	Header string `json:"header,omitempty"`
+	// Cookie is the name of a cookie whose value names the version. With the
+	// nginx Ingress provider the cookie is named <cookie>-<value> and must be
+	// set to "always", as nginx canaries cannot match cookie values.
+	// +optional
+	Cookie string `json:"cookie,omitempty"`
+}
+
+// RouterProvider selects the reverse proxy a Router writes routes for.
+// +kubebuilder:validation:Enum=Ingress;Traefik
+type RouterProvider string
+
+const (
+	// RouterProviderIngress writes a networking.k8s.io Ingress.
+	RouterProviderIngress RouterProvider = "Ingress"
+	// RouterProviderTraefik writes Traefik IngressRoute and Middleware objects.
+	RouterProviderTraefik RouterProvider = "Traefik"
+)
+
+// RouterSpec defines the desired state of Router
+type RouterSpec struct {
+	// VersionSelector selects the DeploymentVersions in the Router's namespace
+	// that are routed. An empty selector matches every DeploymentVersion.
+	// +optional
+	VersionSelector *metav1.LabelSelector `json:"versionSelector,omitempty"`
+
+	// IngressRef names the base Ingress, in the Router's namespace, whose rules
+	// are rewritten for each version.
+	IngressRef core.LocalObjectReference `json:"ingressRef"`
+
+	// Mode selects host-based or path-based routes.
+	// +optional
+	// +kubebuilder:default=Host
+	Mode RoutingMode `json:"mode,omitempty"`
+
+	// Domain overrides the hosts of the base Ingress rules when generating
+	// version routes.
+	// +optional
+	Domain string `json:"domain,omitempty"`
+
+	// Pinning configures the header and cookie used by the Header mode. The
+	// X-Version header is used when unset.
+	// +optional
+	Pinning *VersionPinning `json:"pinning,omitempty"`
+
+	// Provider selects the reverse proxy the routes are written for.
+	// +optional
+	// +kubebuilder:default=Ingress
+	Provider RouterProvider `json:"provider,omitempty"`
+
+	// Activator is the Service, in the Router's namespace, of the activator
+	// proxy. Routes of sleeping versions are sent to it so that a request
+	// wakes the version up. With the Ingress provider in Header mode it also
+	// forwards the requests of versions pinned on the same host and path.
+	// +optional
+	Activator *networking.IngressServiceBackend `json:"activator,omitempty"`
+}
+
+// RouteStatus describes a route generated for a single DeploymentVersion.
+type RouteStatus struct {
+	// Version is the name of the routed DeploymentVersion.
+	Version string `json:"version"`
+	// Host is the host the version is reachable on.
+	// +optional
+	Host string `json:"host,omitempty"`
+	// Path is the path the version is reachable on.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Header is the header match, as name=value, pinning requests to the version.
+	// +optional
+	Header string `json:"header,omitempty"`
+	// Weight is the percentage of unpinned requests applied to the version.
+	// +optional
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// RouterStatus defines the observed state of Router
+type RouterStatus struct {
+	// ObservedGeneration is the most recent generation reconciled by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// IngressName is the name of the Ingress or IngressRoute generated for the
+	// routed versions.
+	// +optional
+	IngressName string `json:"ingressName,omitempty"`
+
+	// Routes lists the routes currently generated, one per ready version.
+	// +optional
+	Routes []RouteStatus `json:"routes,omitempty"`
+
+	// Conditions represent the latest available observations of the router's state.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ingress",type=string,JSONPath=`.spec.ingressRef.name`
+//+kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.spec.mode`
+//+kubebuilder:printcolumn:name="Provider",type=string,JSONPath=`.spec.provider`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Router is the Schema for the routers API
+type Router struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RouterSpec   `json:"spec,omitempty"`
+	Status RouterStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RouterList contains a list of Router
+type RouterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Router `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Router{}, &RouterList{})
+}
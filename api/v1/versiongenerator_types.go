@@ -0,0 +1,185 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GitProviderType selects the API a VersionGenerator polls.
+// +kubebuilder:validation:Enum=GitHub;Gitea
+type GitProviderType string
+
+const (
+	// GitProviderGitHub polls the GitHub REST API.
+	GitProviderGitHub GitProviderType = "GitHub"
+	// GitProviderGitea polls the Gitea API.
+	GitProviderGitea GitProviderType = "Gitea"
+)
+
+// GitSource selects what a VersionGenerator creates versions for.
+// +kubebuilder:validation:Enum=PullRequests;Branches
+type GitSource string
+
+const (
+	// GitSourcePullRequests creates a version per open pull request, matched
+	// on the name of its head branch.
+	GitSourcePullRequests GitSource = "PullRequests"
+	// GitSourceBranches creates a version per branch.
+	GitSourceBranches GitSource = "Branches"
+)
+
+// GitProvider locates a repository on a Git hosting service.
+type GitProvider struct {
+	// Type is the hosting service.
+	// +kubebuilder:default=GitHub
+	// +optional
+	Type GitProviderType `json:"type,omitempty"`
+	// URL is the API endpoint of GitHub, https://api.github.com by default,
+	// or the root URL of the Gitea server.
+	// +optional
+	URL string `json:"url,omitempty"`
+	// Owner is the user or organization owning the repository.
+	Owner string `json:"owner"`
+	// Repository is the name of the repository.
+	Repository string `json:"repository"`
+	// TokenSecretRef selects the key of a Secret, in the namespace of the
+	// VersionGenerator, holding an API token. Public repositories need none.
+	// +optional
+	TokenSecretRef *core.SecretKeySelector `json:"tokenSecretRef,omitempty"`
+}
+
+// VersionTemplate describes the DeploymentVersions created by a
+// VersionGenerator.
+type VersionTemplate struct {
+	// Labels are set on every generated DeploymentVersion.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are set on every generated DeploymentVersion.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Spec is the spec of the generated DeploymentVersions, before the image
+	// of the branch is set.
+	Spec DeploymentVersionSpec `json:"spec"`
+}
+
+// VersionGeneratorSpec defines the desired state of VersionGenerator
+type VersionGeneratorSpec struct {
+	// Provider is the Git hosting service and repository polled.
+	Provider GitProvider `json:"provider"`
+
+	// Source selects whether versions are created for open pull requests or
+	// for branches.
+	// +kubebuilder:default=PullRequests
+	// +optional
+	Source GitSource `json:"source,omitempty"`
+
+	// Pattern is a regular expression matched against branch names, the head
+	// branch of pull requests. Every branch matches when it is empty.
+	// +optional
+	Pattern string `json:"pattern,omitempty"`
+
+	// Interval is how often the provider is polled.
+	// +kubebuilder:default="1m"
+	// +optional
+	Interval metav1.Duration `json:"interval,omitempty"`
+
+	// Container names the container of the base pod template whose image is
+	// set for each branch.
+	Container string `json:"container"`
+	// Image is a Go template of the image of each version, e.g.
+	// myapp:{{.Branch}}-{{.ShortSHA}}. It is given the Branch, with the
+	// characters not allowed in image tags replaced by dashes, the RawBranch,
+	// the commit SHA and ShortSHA, and the Number of the pull request.
+	Image string `json:"image"`
+
+	// Template describes the generated DeploymentVersions.
+	Template VersionTemplate `json:"template"`
+}
+
+// GeneratedVersion describes a DeploymentVersion created for a branch.
+type GeneratedVersion struct {
+	// Name is the name of the DeploymentVersion.
+	Name string `json:"name"`
+	// Branch is the branch the version was created for.
+	Branch string `json:"branch"`
+	// SHA is the commit the image of the version was built from.
+	SHA string `json:"sha"`
+	// Number is the number of the pull request, if any.
+	// +optional
+	Number int `json:"number,omitempty"`
+	// Image is the image set on the version.
+	Image string `json:"image"`
+}
+
+// VersionGeneratorStatus defines the observed state of VersionGenerator
+type VersionGeneratorStatus struct {
+	// ObservedGeneration is the most recent generation reconciled by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// LastPollTime is when the provider was last polled successfully.
+	// +optional
+	LastPollTime *metav1.Time `json:"lastPollTime,omitempty"`
+
+	// Versions lists the DeploymentVersions currently generated.
+	// +optional
+	Versions []GeneratedVersion `json:"versions,omitempty"`
+
+	// Conditions represent the latest available observations of the generator's state.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// GeneratorLabel is set to the name of the VersionGenerator on the
+// DeploymentVersions it creates.
+const GeneratorLabel = "kyaninus.codepraxis.com/generator"
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Repository",type=string,JSONPath=`.spec.provider.repository`
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.spec.source`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Last Poll",type=date,JSONPath=`.status.lastPollTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VersionGenerator is the Schema for the versiongenerators API
+type VersionGenerator struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VersionGeneratorSpec   `json:"spec,omitempty"`
+	Status VersionGeneratorStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VersionGeneratorList contains a list of VersionGenerator
+type VersionGeneratorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VersionGenerator `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VersionGenerator{}, &VersionGeneratorList{})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	// to ensure that exec-entrypoint and run can make use of them.
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"codepraxis.com/kyaninus/activator"
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+var (
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+
+	utilruntime.Must(kyaninusv1.AddToScheme(scheme))
+}
+
+func main() {
+	var listenAddr string
+	var namespace string
+	var domain string
+	var header string
+	var cookie string
+	var timeout time.Duration
+	flag.StringVar(&listenAddr, "listen-address", ":8080", "The address the activator proxy binds to.")
+	flag.StringVar(&namespace, "namespace", os.Getenv("POD_NAMESPACE"), "The namespace of the DeploymentVersions to wake.")
+	flag.StringVar(&domain, "domain", "", "The Router domain under which Host mode routes name their version.")
+	flag.StringVar(&header, "header", kyaninusv1.DefaultPinningHeader, "The request header that pins a version in Header mode, as set in the Router pinning.")
+	flag.StringVar(&cookie, "cookie", "", "The cookie that pins a version in Header mode, as set in the Router pinning.")
+	flag.DurationVar(&timeout, "timeout", 2*time.Minute, "How long a request waits for a sleeping version to become ready.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	// Requests are resolved from a cache of the versions, their Services and
+	// workloads and the Ingresses of the namespace, so that requests to awake
+	// versions do not each query the API server.
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:             scheme,
+		Namespace:          namespace,
+		MetricsBindAddress: "0",
+		NewClient:          newCachingClient,
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to create manager")
+		os.Exit(1)
+	}
+	for _, obj := range []client.Object{&kyaninusv1.DeploymentVersion{}, &corev1.Service{}, &networkingv1.Ingress{}} {
+		if _, err := mgr.GetCache().GetInformer(context.Background(), obj); err != nil {
+			setupLog.Error(err, "unable to create informer")
+			os.Exit(1)
+		}
+	}
+
+	handler := &activator.Activator{
+		Client:    mgr.GetClient(),
+		Namespace: namespace,
+		Domain:    domain,
+		Header:    header,
+		Cookie:    cookie,
+		Timeout:   timeout,
+	}
+	server := &http.Server{Addr: listenAddr, Handler: handler}
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if !mgr.GetCache().WaitForCacheSync(ctx) {
+			return ctx.Err()
+		}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		setupLog.Info("starting activator", "address", listenAddr, "namespace", namespace)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to add activator server")
+		os.Exit(1)
+	}
+
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running activator")
+		os.Exit(1)
+	}
+}
+
+// newCachingClient is the default client of the manager, except that it also
+// reads the workloads of versions, which are unstructured, from the cache.
+func newCachingClient(cache cache.Cache, config *rest.Config, options client.Options, uncachedObjects ...client.Object) (client.Client, error) {
+	c, err := client.New(config, options)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewDelegatingClient(client.NewDelegatingClientInput{
+		CacheReader:       cache,
+		Client:            c,
+		UncachedObjects:   uncachedObjects,
+		CacheUnstructured: true,
+	})
+}
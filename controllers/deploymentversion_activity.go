@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// DefaultActivityQuery counts the requests the NGINX ingress controller sent to
+// the Service of a version over the last activity interval.
+const DefaultActivityQuery = `sum(increase(nginx_ingress_controller_requests{exported_namespace="{{ .Namespace }}",exported_service="{{ .ServiceName }}"}[5m]))`
+
+// activityInterval is how often the activity of an idle version is
+// checked. It matches the range of DefaultActivityQuery.
+const activityInterval = 5 * time.Minute
+
+// recordActivity updates the last activity of the version. A spec update
+// counts as activity, as do requests seen by the activity query for versions
+// that expire or sleep when idle. It returns the error of the activity query,
+// in which case whether the version is idle is unknown.
+func (r *DeploymentVersionReconciler) recordActivity(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, now time.Time) error {
+	log := log.FromContext(ctx)
+	status := &deploymentVersion.Status
+
+	if status.LastActivityTime == nil || status.ObservedGeneration != deploymentVersion.Generation {
+		status.LastActivityTime = &metav1.Time{Time: now}
+	}
+
+	if deploymentVersion.Spec.ExpireAfterIdle == nil && deploymentVersion.Spec.Sleep == nil {
+		return nil
+	}
+	active, err := r.servedRequests(ctx, deploymentVersion)
+	if err != nil {
+		log.Error(err, "Unable to query version activity")
+		return err
+	}
+	if active {
+		status.LastActivityTime = &metav1.Time{Time: now}
+	}
+	return nil
+}
+
+// servedRequests reports whether the ingress sent requests to the version
+// over the last activity interval. Versions without a Service, or managers
+// without Prometheus, are never seen as active.
+func (r *DeploymentVersionReconciler) servedRequests(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) (bool, error) {
+	if r.PrometheusURL == "" || deploymentVersion.Status.ServiceName == "" {
+		return false, nil
+	}
+
+	activityQuery := r.ActivityQuery
+	if activityQuery == "" {
+		activityQuery = DefaultActivityQuery
+	}
+	query, err := renderQuery(activityQuery, deploymentVersion)
+	if err != nil {
+		return false, err
+	}
+
+	prometheus := &prometheusClient{url: r.PrometheusURL}
+	requests, err := prometheus.query(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	return requests > 0, nil
+}
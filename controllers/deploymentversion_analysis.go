@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// reconcileAnalysis moves a version through the step weights of its canary
+// analysis. Each step runs for the analysis interval, after which the metric
+// checks either promote the version to the next step or roll it back to no
+// traffic. Prometheus errors, and checks without data to compare, such as a
+// success rate over no requests, are retried at the next interval. A new pod
+// template, e.g. a new image, starts the analysis over from its first step.
+func (r *DeploymentVersionReconciler) reconcileAnalysis(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, now time.Time) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	analysis := deploymentVersion.Spec.Analysis
+	interval := analysis.Interval.Duration
+
+	templateHash, err := r.podTemplateHash(ctx, deploymentVersion)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := deploymentVersion.Status.Analysis
+	if status != nil && status.PodTemplateHash != "" && templateHash != "" && status.PodTemplateHash != templateHash {
+		log.Info(fmt.Sprintf("%s %s", "Restarting canary analysis for the new pod template of version", deploymentVersion.Name))
+		status = nil
+	}
+	if status == nil {
+		deploymentVersion.Status.Analysis = &kyaninusv1.AnalysisStatus{
+			Phase:           kyaninusv1.AnalysisProgressing,
+			Weight:          analysis.StepWeights[0],
+			StepStartTime:   &metav1.Time{Time: now},
+			PodTemplateHash: templateHash,
+		}
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+	if status.PodTemplateHash == "" {
+		status.PodTemplateHash = templateHash
+	}
+	if status.Phase != kyaninusv1.AnalysisProgressing {
+		return ctrl.Result{}, nil
+	}
+
+	summarizeReady(deploymentVersion)
+	if !meta.IsStatusConditionTrue(deploymentVersion.Status.Conditions, kyaninusv1.ConditionReady) {
+		status.Message = "Waiting for the version to become ready"
+		status.StepStartTime = &metav1.Time{Time: now}
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+
+	if status.StepStartTime != nil {
+		if elapsed := now.Sub(status.StepStartTime.Time); elapsed < interval {
+			return ctrl.Result{RequeueAfter: interval - elapsed}, nil
+		}
+	}
+
+	passed, message, err := r.checkMetrics(ctx, deploymentVersion)
+	if err != nil {
+		log.Error(err, "Error running canary analysis")
+		status.Message = err.Error()
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+	status.Message = message
+
+	if !passed {
+		log.Info(fmt.Sprintf("%s %s: %s", "Rolling back version", deploymentVersion.Name, message))
+		status.Phase = kyaninusv1.AnalysisRolledBack
+		status.Weight = 0
+		return ctrl.Result{}, nil
+	}
+
+	if int(status.Step)+1 >= len(analysis.StepWeights) {
+		status.Phase = kyaninusv1.AnalysisSucceeded
+		return ctrl.Result{}, nil
+	}
+
+	status.Step++
+	status.Weight = analysis.StepWeights[status.Step]
+	status.StepStartTime = &metav1.Time{Time: now}
+	log.Info(fmt.Sprintf("%s %s to %d%%", "Promoting version", deploymentVersion.Name, status.Weight))
+
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// podTemplateHash hashes the pod template of the workload generated for the
+// version. It is empty until the workload exists.
+func (r *DeploymentVersionReconciler) podTemplateHash(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) (string, error) {
+	if deploymentVersion.Status.DeploymentName == "" {
+		return "", nil
+	}
+	workload := newWorkload(deploymentVersion.WorkloadGroupVersionKind())
+	name := types.NamespacedName{Namespace: deploymentVersion.Namespace, Name: deploymentVersion.Status.DeploymentName}
+	if err := r.Get(ctx, name, workload); err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+
+	template, _, _ := unstructured.NestedFieldNoCopy(workload.Object, "spec", "template")
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return strconv.FormatUint(hash.Sum64(), 16), nil
+}
+
+// checkMetrics runs the metric checks of the analysis. It reports whether all
+// of them are within their thresholds, with a message describing the values.
+func (r *DeploymentVersionReconciler) checkMetrics(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) (bool, string, error) {
+	if r.PrometheusURL == "" {
+		return false, "", fmt.Errorf("no Prometheus URL configured for canary analysis")
+	}
+	prometheus := &prometheusClient{url: r.PrometheusURL}
+
+	analysis := deploymentVersion.Spec.Analysis
+	checks := []struct {
+		name    string
+		check   *kyaninusv1.MetricCheck
+		atLeast bool
+	}{
+		{"success rate", analysis.SuccessRate, true},
+		{"latency", analysis.Latency, false},
+	}
+
+	var messages []string
+	for _, c := range checks {
+		if c.check == nil {
+			continue
+		}
+
+		threshold, err := strconv.ParseFloat(c.check.Threshold, 64)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid %s threshold: %w", c.name, err)
+		}
+		query, err := renderQuery(c.check.Query, deploymentVersion)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid %s query: %w", c.name, err)
+		}
+		value, err := prometheus.query(ctx, query)
+		if err != nil {
+			return false, "", err
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			// A ratio over no requests is NaN, which no threshold rejects.
+			return false, "", fmt.Errorf("%s query returned %g, not enough data to compare with the threshold", c.name, value)
+		}
+
+		message := fmt.Sprintf("%s %g (threshold %s)", c.name, value, c.check.Threshold)
+		if (c.atLeast && value < threshold) || (!c.atLeast && value > threshold) {
+			return false, message, nil
+		}
+		messages = append(messages, message)
+	}
+
+	return true, strings.Join(messages, ", "), nil
+}
+
+// renderQuery expands the version's .Name, .Namespace and .ServiceName in a
+// PromQL query template.
+func renderQuery(query string, deploymentVersion *kyaninusv1.DeploymentVersion) (string, error) {
+	tmpl, err := template.New("query").Parse(query)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, map[string]string{
+		"Name":        deploymentVersion.Name,
+		"Namespace":   deploymentVersion.Namespace,
+		"ServiceName": deploymentVersion.Status.ServiceName,
+	})
+	return out.String(), err
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// fakePrometheus answers instant queries with the value registered for the
+// query, as a single sample vector.
+func fakePrometheus(t *testing.T, values map[string]string) *httptest.Server {
+	t.Helper()
+	return fakePrometheusFunc(t, func(query string) (string, bool) {
+		value, ok := values[query]
+		return value, ok
+	})
+}
+
+// fakePrometheusFunc answers instant queries with the value returned by
+// lookup, as a single sample vector.
+func fakePrometheusFunc(t *testing.T, lookup func(query string) (string, bool)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/query" {
+			http.NotFound(w, req)
+			return
+		}
+		value, ok := lookup(req.URL.Query().Get("query"))
+		if !ok {
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unknown query"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1630000000,"%s"]}]}}`, value)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func analysedVersion() *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "version-1", Namespace: "default"},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Analysis: &kyaninusv1.CanaryAnalysis{
+				StepWeights: []int32{5, 25, 100},
+				Interval:    metav1.Duration{Duration: time.Minute},
+				SuccessRate: &kyaninusv1.MetricCheck{Query: `success{version="{{ .Name }}"}`, Threshold: "0.99"},
+				Latency:     &kyaninusv1.MetricCheck{Query: `latency{version="{{ .Name }}"}`, Threshold: "0.5"},
+			},
+		},
+		Status: kyaninusv1.DeploymentVersionStatus{
+			Conditions: []metav1.Condition{
+				{Type: kyaninusv1.ConditionBaseFound, Status: metav1.ConditionTrue, Reason: "BaseFound"},
+				{Type: kyaninusv1.ConditionMerged, Status: metav1.ConditionTrue, Reason: "Merged"},
+				{Type: kyaninusv1.ConditionProgressing, Status: metav1.ConditionFalse, Reason: "RolloutComplete"},
+				{Type: kyaninusv1.ConditionDegraded, Status: metav1.ConditionFalse, Reason: "Reconciled"},
+			},
+		},
+	}
+}
+
+func TestAnalysisPromotesThroughSteps(t *testing.T) {
+	prometheus := fakePrometheus(t, map[string]string{
+		`success{version="version-1"}`: "0.999",
+		`latency{version="version-1"}`: "0.2",
+	})
+	r := &DeploymentVersionReconciler{PrometheusURL: prometheus.URL}
+	ctx := context.Background()
+	version := analysedVersion()
+	now := time.Now()
+
+	result, err := r.reconcileAnalysis(ctx, version, now)
+	if err != nil || result.RequeueAfter != time.Minute {
+		t.Fatalf("start: result %+v, err %v", result, err)
+	}
+	if version.Status.Analysis.Weight != 5 {
+		t.Fatalf("expected the first step weight, got %d", version.Status.Analysis.Weight)
+	}
+
+	result, _ = r.reconcileAnalysis(ctx, version, now.Add(20*time.Second))
+	if version.Status.Analysis.Weight != 5 || result.RequeueAfter != 40*time.Second {
+		t.Fatalf("expected to wait out the interval, got weight %d requeue %v", version.Status.Analysis.Weight, result.RequeueAfter)
+	}
+
+	for i, want := range []int32{25, 100} {
+		now = now.Add(time.Minute)
+		if _, err := r.reconcileAnalysis(ctx, version, now); err != nil {
+			t.Fatal(err)
+		}
+		if version.Status.Analysis.Weight != want {
+			t.Fatalf("step %d: weight %d, want %d (%s)", i+1, version.Status.Analysis.Weight, want, version.Status.Analysis.Message)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	result, _ = r.reconcileAnalysis(ctx, version, now)
+	if version.Status.Analysis.Phase != kyaninusv1.AnalysisSucceeded || result.RequeueAfter != 0 {
+		t.Fatalf("expected the analysis to succeed, got %+v", version.Status.Analysis)
+	}
+}
+
+func TestAnalysisRollsBack(t *testing.T) {
+	prometheus := fakePrometheus(t, map[string]string{
+		`success{version="version-1"}`: "0.999",
+		`latency{version="version-1"}`: "1.5",
+	})
+	r := &DeploymentVersionReconciler{PrometheusURL: prometheus.URL}
+	ctx := context.Background()
+	version := analysedVersion()
+	now := time.Now()
+
+	r.reconcileAnalysis(ctx, version, now)
+	r.reconcileAnalysis(ctx, version, now.Add(time.Minute))
+
+	if version.Status.Analysis.Phase != kyaninusv1.AnalysisRolledBack || version.Status.Analysis.Weight != 0 {
+		t.Fatalf("expected a rollback to no traffic, got %+v", version.Status.Analysis)
+	}
+	if weight := trafficWeight(version); weight == nil || *weight != 0 {
+		t.Fatalf("expected routers to apply no weight, got %v", weight)
+	}
+}
+
+func TestAnalysisRetriesQueryErrors(t *testing.T) {
+	prometheus := fakePrometheus(t, map[string]string{})
+	r := &DeploymentVersionReconciler{PrometheusURL: prometheus.URL}
+	ctx := context.Background()
+	version := analysedVersion()
+	now := time.Now()
+
+	r.reconcileAnalysis(ctx, version, now)
+	result, err := r.reconcileAnalysis(ctx, version, now.Add(time.Minute))
+
+	if err != nil || result.RequeueAfter != time.Minute {
+		t.Fatalf("expected a retry at the next interval, got result %+v err %v", result, err)
+	}
+	if version.Status.Analysis.Phase != kyaninusv1.AnalysisProgressing || version.Status.Analysis.Weight != 5 {
+		t.Fatalf("expected the step to be kept, got %+v", version.Status.Analysis)
+	}
+}
+
+func TestAnalysisRetriesWithoutData(t *testing.T) {
+	for _, value := range []string{"NaN", "+Inf", "-Inf"} {
+		t.Run(value, func(t *testing.T) {
+			prometheus := fakePrometheus(t, map[string]string{
+				`success{version="version-1"}`: value,
+				`latency{version="version-1"}`: "0.1",
+			})
+			r := &DeploymentVersionReconciler{PrometheusURL: prometheus.URL}
+			ctx := context.Background()
+			version := analysedVersion()
+			now := time.Now()
+
+			r.reconcileAnalysis(ctx, version, now)
+			result, err := r.reconcileAnalysis(ctx, version, now.Add(time.Minute))
+
+			if err != nil || result.RequeueAfter != time.Minute {
+				t.Fatalf("expected a retry at the next interval, got result %+v err %v", result, err)
+			}
+			if version.Status.Analysis.Phase != kyaninusv1.AnalysisProgressing || version.Status.Analysis.Weight != 5 {
+				t.Fatalf("expected no promotion without data, got %+v", version.Status.Analysis)
+			}
+		})
+	}
+}
+
+func TestAnalysisRestartsForNewPodTemplate(t *testing.T) {
+	prometheus := fakePrometheus(t, map[string]string{
+		`success{version="version-1"}`: "0.999",
+		`latency{version="version-1"}`: "0.2",
+	})
+	generated := testDeployment("version-1", map[string]string{"app": "myapp"}, "myapp:2")
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(generated).Build(),
+		Scheme:        scheme,
+		PrometheusURL: prometheus.URL,
+	}
+	ctx := context.Background()
+	version := analysedVersion()
+	version.Status.DeploymentName = "version-1"
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		if _, err := r.reconcileAnalysis(ctx, version, now); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+	if version.Status.Analysis.Phase != kyaninusv1.AnalysisSucceeded || version.Status.Analysis.Weight != 100 {
+		t.Fatalf("expected the analysis to succeed, got %+v", version.Status.Analysis)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(generated), generated); err != nil {
+		t.Fatal(err)
+	}
+	replicas := int32(3)
+	generated.Spec.Replicas = &replicas
+	if err := r.Update(ctx, generated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.reconcileAnalysis(ctx, version, now); err != nil {
+		t.Fatal(err)
+	}
+	if version.Status.Analysis.Phase != kyaninusv1.AnalysisSucceeded {
+		t.Fatalf("scaling must not restart the analysis, got %+v", version.Status.Analysis)
+	}
+
+	generated.Spec.Template.Spec.Containers[0].Image = "myapp:3"
+	if err := r.Update(ctx, generated); err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.reconcileAnalysis(ctx, version, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analysis := version.Status.Analysis
+	if analysis.Phase != kyaninusv1.AnalysisProgressing || analysis.Step != 0 || analysis.Weight != 5 || result.RequeueAfter != time.Minute {
+		t.Errorf("expected a new image to restart the analysis at its first step, got %+v", analysis)
+	}
+}
+
+func TestPrometheusQueryTimesOut(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	defer func(timeout time.Duration) { prometheusTimeout = timeout }(prometheusTimeout)
+	prometheusTimeout = 50 * time.Millisecond
+
+	prometheus := &prometheusClient{url: server.URL}
+	if _, err := prometheus.query(context.Background(), "up"); err == nil {
+		t.Fatal("expected a hung Prometheus to time out")
+	}
+}
@@ -3,16 +3,29 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"time"
 
-	"github.com/imdario/mergo"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
 )
@@ -21,27 +34,48 @@ import (
 type DeploymentVersionReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// PrometheusURL is the Prometheus server queried by canary analyses and
+	// for the activity of expiring versions.
+	PrometheusURL string
+	// ActivityQuery is a PromQL template counting the recent requests to a
+	// version. It defaults to DefaultActivityQuery.
+	ActivityQuery string
+	// WatchRollouts watches Argo Rollouts, whose CRD must then be installed.
+	WatchRollouts bool
+	// HTTPClient is used to poll the registries of image policies. It
+	// defaults to a client timing out after registryTimeout.
+	HTTPClient *http.Client
+	// Recorder records events on DeploymentVersions explaining each
+	// reconcile decision. No events are recorded when it is nil.
+	Recorder record.EventRecorder
 }
 
+// missingBaseRequeue is how long a version whose base workload does not exist
+// waits before looking for it again.
+const missingBaseRequeue = time.Minute
+
 var (
-	jobOwnerKey = ".metadata.controller"
+	// baseDeploymentKey indexes DeploymentVersions by the kind and
+	// namespace/name of their base workload.
+	baseDeploymentKey = ".spec.base"
 	//apiGVStr    = kyaninusv1.GroupVersion.String()
 )
 
 //+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=deploymentversions,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=deploymentversions/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=deploymentversions/finalizers,verbs=update
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create
-
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the DeploymentVersion object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile clones the base workload of a DeploymentVersion, merges the
+// version's overrides onto it and keeps the generated workload, Service and
+// cloned resources up to date. It then runs the canary analysis and expiry of
+// the version, and writes its status. A finalizer removes what was generated
+// for the version before it is deleted.
 //
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+// The result requeues the version at the earliest time one of its steps must
+// run again, such as the next image poll, sleep or analysis interval.
 func (r *DeploymentVersionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
@@ -49,9 +83,12 @@ func (r *DeploymentVersionReconciler) Reconcile(ctx context.Context, req ctrl.Re
 	deployVersionRef := &deploymentVersion
 
 	if err := r.Get(ctx, req.NamespacedName, deployVersionRef); err != nil {
+		if apierrors.IsNotFound(err) {
+			// The version was deleted after the request was queued.
+			return ctrl.Result{}, nil
+		}
 		log.Error(err, "Unable to fetch DeploymentVersion")
-
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, err
 	}
 
 	log.Info("Have DeploymentVersion")
@@ -65,7 +102,7 @@ func (r *DeploymentVersionReconciler) Reconcile(ctx context.Context, req ctrl.Re
 		if !controllerutil.ContainsFinalizer(deployVersionRef, myFinalizerName) {
 			controllerutil.AddFinalizer(deployVersionRef, myFinalizerName)
 			if err := r.Update(ctx, deployVersionRef); err != nil {
-				return ctrl.Result{}, err
+				return requeueOnConflict(err)
 			}
 		}
 	} else {
@@ -81,84 +118,380 @@ func (r *DeploymentVersionReconciler) Reconcile(ctx context.Context, req ctrl.Re
 			// remove our finalizer from the list and update it.
 			controllerutil.RemoveFinalizer(deployVersionRef, myFinalizerName)
 			if err := r.Update(ctx, deployVersionRef); err != nil {
-				return ctrl.Result{}, err
+				return requeueOnConflict(err)
 			}
 		}
 		// Stop reconciliation as the item is being deleted
 		return ctrl.Result{}, nil
 	}
 
-	var existingDeploy appsv1.Deployment
-	err := r.Get(ctx, req.NamespacedName, &existingDeploy)
+	now := time.Now()
+	// Without the activity of the version, it is neither put to sleep nor
+	// expired for being idle.
+	idleKnown := r.recordActivity(ctx, deployVersionRef, now) == nil
 
-	haveDeploy := true
+	result, reconcileErr := r.reconcileDeployment(ctx, deployVersionRef, idleKnown)
+	if reconcileErr == nil && deploymentVersion.Spec.Analysis != nil {
+		var analysisResult ctrl.Result
+		analysisResult, reconcileErr = r.reconcileAnalysis(ctx, deployVersionRef, now)
+		result = earliestRequeue(result, analysisResult)
+	}
+
+	expired, expiryResult, err := r.reconcileExpiry(ctx, deployVersionRef, now, idleKnown)
 	if err != nil {
-		log.Info("Error getting existing Deploy")
+		log.Error(err, "Unable to delete expired DeploymentVersion")
+		if reconcileErr == nil {
+			reconcileErr = err
+		}
+	}
+	if expired {
+		reconcileOutcomes.WithLabelValues("success", "Expired").Inc()
+		return ctrl.Result{}, nil
+	}
+	result = earliestRequeue(result, expiryResult)
+
+	if err := r.updateStatus(ctx, deployVersionRef); apierrors.IsConflict(err) {
+		log.Info("DeploymentVersion status changed meanwhile, reconciling again")
+		result = earliestRequeue(result, ctrl.Result{Requeue: true})
+	} else if err != nil {
+		log.Error(err, "Unable to update DeploymentVersion status")
+		if reconcileErr == nil {
+			reconcileErr = err
+		}
+	}
+	recordReconcile(deployVersionRef, reconcileErr)
+
+	return result, reconcileErr
+}
+
+// reconcileDeployment clones the base workload, merges the version overrides
+// onto it and creates or updates the generated workload. Conditions describing
+// each step are recorded on the DeploymentVersion status. Workloads are read and
+// written as unstructured objects, and merged through their Deployment view.
+//
+// Errors are returned so the request is retried with backoff, after they are
+// recorded in a condition. A missing base is not an error: the version is
+// checked again after missingBaseRequeue, or as soon as the base is created.
+// idleKnown reports whether the activity of the version could be queried, and
+// so whether it may be put to sleep.
+func (r *DeploymentVersionReconciler) reconcileDeployment(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, idleKnown bool) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	deployVersionRef := deploymentVersion
+	gvk := deploymentVersion.WorkloadGroupVersionKind()
+
+	existingDeploy := newWorkload(gvk)
+	haveDeploy := true
+	if err := r.Get(ctx, types.NamespacedName{Namespace: deploymentVersion.Namespace, Name: deploymentVersion.Name}, existingDeploy); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, fmt.Sprintf("%s %s", "Unable to fetch generated", gvk.Kind))
+			setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "GetFailed", err.Error())
+			return ctrl.Result{}, err
+		}
 		haveDeploy = false
 	}
 
-	baseDeploy := &appsv1.Deployment{}
+	baseWorkload := newWorkload(gvk)
 	baseDeployName := types.NamespacedName{Namespace: deploymentVersion.Spec.Namespace, Name: deploymentVersion.Spec.Name}
 
-	if err := r.Client.Get(ctx, baseDeployName, baseDeploy); err != nil {
-		log.Error(err, "Unable to fetch base Deployment")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+	if err := r.Client.Get(ctx, baseDeployName, baseWorkload); err != nil {
+		log.Error(err, fmt.Sprintf("%s %s", "Unable to fetch base", gvk.Kind))
+		if !apierrors.IsNotFound(err) {
+			setCondition(deploymentVersion, kyaninusv1.ConditionBaseFound, metav1.ConditionUnknown, "BaseFetchFailed", err.Error())
+			return ctrl.Result{}, err
+		}
+		setCondition(deploymentVersion, kyaninusv1.ConditionBaseFound, metav1.ConditionFalse, "BaseNotFound", err.Error())
+		r.event(deploymentVersion, corev1.EventTypeWarning, "BaseNotFound", "Unable to fetch base %s %s: %v", gvk.Kind, baseDeployName, err)
+		return ctrl.Result{RequeueAfter: missingBaseRequeue}, nil
 	}
+	setCondition(deploymentVersion, kyaninusv1.ConditionBaseFound, metav1.ConditionTrue, "BaseFound",
+		fmt.Sprintf("Found base %s %s", gvk.Kind, baseDeployName))
 
-	newDeploy := baseDeploy.DeepCopy()
+	// The generated workload must never be the base itself, nor any other
+	// workload the version does not own.
+	if baseDeployName.Namespace == deploymentVersion.Namespace && baseDeployName.Name == deploymentVersion.Name {
+		err := fmt.Errorf("DeploymentVersion %s has the same name as its base %s", deploymentVersion.Name, gvk.Kind)
+		setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "NameCollision", err.Error())
+		return ctrl.Result{}, nil
+	}
+	if haveDeploy && !metav1.IsControlledBy(existingDeploy, deploymentVersion) {
+		err := fmt.Errorf("%s %s already exists and is not owned by DeploymentVersion %s", gvk.Kind, existingDeploy.GetName(), deploymentVersion.Name)
+		setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "NotOwned", err.Error())
+		return ctrl.Result{}, nil
+	}
 
-	if err := mergo.Merge(&newDeploy.Spec, deploymentVersion.Spec.DeploymentSpec, mergo.WithOverride); err != nil {
+	baseDeploy, err := workloadView(baseWorkload)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	mergeStart := time.Now()
+	merged, newDeploy, err := mergeWorkload(baseWorkload, deploymentVersion)
+	observeMerge(deploymentVersion, mergeStart)
+	if err != nil {
 		log.Error(err, "Error merging configuration")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		setCondition(deploymentVersion, kyaninusv1.ConditionMerged, metav1.ConditionFalse, "MergeFailed", err.Error())
+		r.event(deploymentVersion, corev1.EventTypeWarning, "MergeFailed", "Unable to merge the version onto base %s %s: %v", gvk.Kind, baseDeployName, err)
+		return ctrl.Result{}, err
+	}
+	setCondition(deploymentVersion, kyaninusv1.ConditionMerged, metav1.ConditionTrue, "Merged", "")
+
+	newDeploy.ObjectMeta = metav1.ObjectMeta{
+		Name:        deploymentVersion.Name,
+		Namespace:   deploymentVersion.Namespace,
+		Labels:      baseDeploy.Labels,
+		Annotations: cloneAnnotations(baseDeploy.Annotations),
+	}
+	newDeploy.Status = appsv1.DeploymentStatus{}
+
+	if err := r.isolateVersion(ctx, deploymentVersion, baseDeploy, newDeploy); err != nil {
+		log.Error(err, "Error isolating version pods")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileResources(ctx, deploymentVersion, baseDeploy, newDeploy); err != nil {
+		log.Error(err, "Error cloning version resources")
+		setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "ResourcesFailed", err.Error())
+		return ctrl.Result{}, err
 	}
 
-	newDeploy.Name = deploymentVersion.Name
-	newDeploy.Namespace = deploymentVersion.Namespace
-	newDeploy.ResourceVersion = ""
+	imageResult := r.reconcileImagePolicy(ctx, deploymentVersion, newDeploy, time.Now())
+	sleepResult := r.reconcileSleep(ctx, deploymentVersion, newDeploy, time.Now(), idleKnown)
+
+	generated := newWorkload(gvk)
+	generated.Object["spec"] = merged.Object["spec"]
+	if err := setWorkloadSpec(generated, newDeploy.Spec); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := setVersionServiceName(generated, deploymentVersion); err != nil {
+		return ctrl.Result{}, err
+	}
+	generated.SetName(newDeploy.Name)
+	generated.SetNamespace(newDeploy.Namespace)
+	generated.SetLabels(newDeploy.Labels)
+	generated.SetAnnotations(newDeploy.Annotations)
+
+	// Owning the clone lets the garbage collector remove it with the version,
+	// and routes its status changes back to this reconciler.
+	if err := ctrl.SetControllerReference(deployVersionRef, generated, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	if haveDeploy {
-		if err := r.Client.Update(ctx, newDeploy); err != nil {
+		existingView, err := workloadView(existingDeploy)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		existingServiceName, _, _ := unstructured.NestedString(existingDeploy.Object, "spec", "serviceName")
+		serviceName, _, _ := unstructured.NestedString(generated.Object, "spec", "serviceName")
+		if !apiequality.Semantic.DeepEqual(existingView.Spec.Selector, newDeploy.Spec.Selector) || existingServiceName != serviceName {
+			// The selector of a workload, like the serviceName of a StatefulSet,
+			// is immutable, so the clone is replaced.
+			log.Info(fmt.Sprintf("%s %s", "Recreating deployment with a new selector", existingDeploy.GetName()))
+			if err := r.Client.Delete(ctx, existingDeploy); client.IgnoreNotFound(err) != nil {
+				log.Error(err, "Error deleting existing deployment")
+				setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "UpdateFailed", err.Error())
+				r.event(deploymentVersion, corev1.EventTypeWarning, "UpdateFailed", "Unable to replace %s %s: %v", gvk.Kind, existingDeploy.GetName(), err)
+				return ctrl.Result{}, err
+			}
+			r.event(deploymentVersion, corev1.EventTypeNormal, "Deleted", "Deleted %s %s to recreate it with a new selector", gvk.Kind, existingDeploy.GetName())
+			haveDeploy = false
+		}
+	}
+
+	if haveDeploy {
+		generated.SetResourceVersion(existingDeploy.GetResourceVersion())
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			err := r.Client.Update(ctx, generated)
+			if apierrors.IsConflict(err) {
+				// Retry on top of the latest version of the workload.
+				latest := newWorkload(gvk)
+				if err := r.Get(ctx, client.ObjectKeyFromObject(generated), latest); err != nil {
+					return err
+				}
+				generated.SetResourceVersion(latest.GetResourceVersion())
+			}
+			return err
+		})
+		if err != nil {
 			log.Error(err, "Error updating existing deployment")
-			return ctrl.Result{}, client.IgnoreNotFound(err)
+			setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "UpdateFailed", err.Error())
+			r.event(deploymentVersion, corev1.EventTypeWarning, "UpdateFailed", "Unable to update %s %s: %v", gvk.Kind, generated.GetName(), err)
+			return ctrl.Result{}, err
+		}
+		// The API server keeps the resource version of an update that
+		// changed nothing.
+		if generated.GetResourceVersion() != existingDeploy.GetResourceVersion() {
+			r.event(deploymentVersion, corev1.EventTypeNormal, "Updated", "Updated %s %s", gvk.Kind, generated.GetName())
 		}
 	} else {
-		if err := r.Client.Create(ctx, newDeploy); err != nil {
+		if err := r.Client.Create(ctx, generated); err != nil {
 			log.Error(err, "Error creating new deployment")
-			return ctrl.Result{}, client.IgnoreNotFound(err)
-		}
-
-		if err := ctrl.SetControllerReference(deployVersionRef, newDeploy, r.Scheme); err != nil {
+			setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "CreateFailed", err.Error())
+			r.event(deploymentVersion, corev1.EventTypeWarning, "CreateFailed", "Unable to create %s %s: %v", gvk.Kind, generated.GetName(), err)
 			return ctrl.Result{}, err
 		}
+		r.event(deploymentVersion, corev1.EventTypeNormal, "Created", "Created %s %s from base %s", gvk.Kind, generated.GetName(), baseDeployName)
+	}
+
+	deployed, err := workloadView(generated)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	mirrorDeploymentStatus(deploymentVersion, deployed)
+
+	if err := r.reconcileService(ctx, deploymentVersion, deployed); err != nil {
+		setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, "ServiceFailed", err.Error())
+		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	if err := r.reconcilePromotion(ctx, deploymentVersion, baseWorkload, generated); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return earliestRequeue(sleepResult, imageResult), nil
+}
+
+// requeueOnConflict requeues the request when an update conflicted with a
+// newer version of the object, which the next reconcile reads from the cache,
+// and returns any other error.
+func requeueOnConflict(err error) (ctrl.Result, error) {
+	if apierrors.IsConflict(err) {
+		return ctrl.Result{Requeue: true}, nil
+	}
+	return ctrl.Result{}, err
+}
+
+// baseWorkloadKey is the baseDeploymentKey index value of a base workload.
+func baseWorkloadKey(kind string, name types.NamespacedName) string {
+	return fmt.Sprintf("%s/%s", kind, name)
+}
+
+// versionsForBase maps a base workload of the given kind to the
+// DeploymentVersions derived from it, so that changes to the base are merged
+// into every clone.
+func (r *DeploymentVersionReconciler) versionsForBase(kind string) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		var versions kyaninusv1.DeploymentVersionList
+		if err := r.List(context.Background(), &versions,
+			client.MatchingFields{baseDeploymentKey: baseWorkloadKey(kind, client.ObjectKeyFromObject(obj))}); err != nil {
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for _, version := range versions.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&version)})
+		}
+		return requests
+	}
 }
 
+// baseWorkloadChanged filters the events of base workloads. Versions only
+// depend on the spec, labels and annotations of their base, so its status
+// updates are not reconciled.
+var baseWorkloadChanged = predicate.Or(
+	predicate.GenerationChangedPredicate{},
+	predicate.LabelChangedPredicate{},
+	predicate.AnnotationChangedPredicate{},
+)
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *DeploymentVersionReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := registerVersionCollector(mgr.GetClient()); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &kyaninusv1.DeploymentVersion{}, baseDeploymentKey, func(rawObj client.Object) []string {
+		version := rawObj.(*kyaninusv1.DeploymentVersion)
+		if version.Spec.Name == "" {
+			return nil
+		}
+		name := types.NamespacedName{Namespace: version.Spec.Namespace, Name: version.Spec.Name}
+		return []string{baseWorkloadKey(version.WorkloadGroupVersionKind().Kind, name)}
+	}); err != nil {
+		return err
+	}
+
+	baseChanged := builder.WithPredicates(baseWorkloadChanged)
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&kyaninusv1.DeploymentVersion{}).
 		Owns(&appsv1.Deployment{}).
-		Complete(r)
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.versionsForBase("Deployment")), baseChanged).
+		Watches(&source.Kind{Type: &appsv1.StatefulSet{}}, handler.EnqueueRequestsFromMapFunc(r.versionsForBase("StatefulSet")), baseChanged)
+
+	if r.WatchRollouts {
+		rollout := newWorkload(rolloutGroupVersionKind)
+		controllerBuilder = controllerBuilder.
+			Owns(rollout).
+			Watches(&source.Kind{Type: newWorkload(rolloutGroupVersionKind)}, handler.EnqueueRequestsFromMapFunc(r.versionsForBase("Rollout")), baseChanged)
+	}
+
+	return controllerBuilder.Complete(r)
 }
 
+// deleteExternalResources deletes the workload, Service and resources
+// generated for the version. Only objects controlled by the version are
+// removed, so the base workload is never touched.
 func (r *DeploymentVersionReconciler) deleteExternalResources(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) error {
-	//
-	// delete any external resources associated with the deploymentVersion
-	//
 	log := log.FromContext(ctx)
 
-	var existingDeploy *appsv1.Deployment
-	existingDeployName := types.NamespacedName{Namespace: deploymentVersion.Spec.Namespace, Name: deploymentVersion.Spec.Name}
+	childName := types.NamespacedName{Namespace: deploymentVersion.Namespace, Name: deploymentVersion.Name}
 
-	err := r.Get(ctx, existingDeployName, existingDeploy)
-	if err != nil {
-		log.Info(fmt.Sprintf("%s %s", "Removing deployment for version", existingDeployName.Name))
-		delErr := r.Client.Delete(ctx, existingDeploy)
-		if delErr != nil {
-			log.Error(delErr, fmt.Sprintf("%s %s", "Error removing deployment: ", delErr))
+	gvk := deploymentVersion.WorkloadGroupVersionKind()
+	children := []struct {
+		kind   string
+		object client.Object
+	}{{gvk.Kind, newWorkload(gvk)}, {"Service", &corev1.Service{}}}
+	for _, child := range children {
+		if err := r.Get(ctx, childName, child.object); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if !metav1.IsControlledBy(child.object, deploymentVersion) {
+			continue
 		}
+
+		log.Info(fmt.Sprintf("%s %s", "Removing generated objects for version", childName.Name))
+		if err := r.Client.Delete(ctx, child.object); client.IgnoreNotFound(err) != nil {
+			log.Error(err, fmt.Sprintf("%s %s", "Error removing generated object: ", err))
+			return err
+		}
+		r.event(deploymentVersion, corev1.EventTypeNormal, "Deleted", "Deleted %s %s", child.kind, childName.Name)
+	}
+
+	for _, resource := range deploymentVersion.Status.Resources {
+		log.Info(fmt.Sprintf("%s %s %s", "Removing cloned resource", resource.Kind, resource.Name))
+		if err := r.deleteClonedResource(ctx, deploymentVersion, resource); err != nil {
+			log.Error(err, fmt.Sprintf("%s %s", "Error removing cloned resource: ", err))
+			return err
+		}
+		r.event(deploymentVersion, corev1.EventTypeNormal, "Deleted", "Deleted cloned %s %s", resource.Kind, resource.Name)
 	}
 	return nil
 }
+
+// event records an event on the DeploymentVersion, when a Recorder is set.
+func (r *DeploymentVersionReconciler) event(deploymentVersion *kyaninusv1.DeploymentVersion, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(deploymentVersion, eventType, reason, messageFmt, args...)
+}
+
+// cloneAnnotations copies the annotations of the base Deployment, leaving out
+// the ones the deployment controller maintains for it.
+func cloneAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	out := map[string]string{}
+	for k, v := range annotations {
+		if k == "deployment.kubernetes.io/revision" {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
@@ -7,6 +7,8 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
@@ -147,6 +149,247 @@ var _ = Describe("DeploymentVersion controller", func() {
 				}
 				return true
 			}, timeout, interval).Should(BeTrue())
+
+			By("Checking the DeploymentVersion status references the generated deployment")
+			Eventually(func() string {
+				err := k8sClient.Get(ctx, deployVersionLookupKey, createdDeployVersion)
+				if err != nil {
+					return ""
+				}
+				return createdDeployVersion.Status.DeploymentName
+			}, timeout, interval).Should(Equal("deployversion1"))
+
+			Expect(meta.IsStatusConditionTrue(createdDeployVersion.Status.Conditions, kyaninusv1.ConditionBaseFound)).Should(BeTrue())
+			Expect(meta.IsStatusConditionTrue(createdDeployVersion.Status.Conditions, kyaninusv1.ConditionMerged)).Should(BeTrue())
+			Expect(createdDeployVersion.Status.ObservedGeneration).Should(Equal(createdDeployVersion.Generation))
+		})
+	})
+
+	Context("When a DeploymentVersion only sets an image", func() {
+		It("The installed schema should accept it without a deploymentSpec", func() {
+			ctx := context.Background()
+
+			baseLabels := map[string]string{"app": "shorthandbase"}
+
+			By("By creating a base Deployment")
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "shorthandbase", Namespace: DeployNamespace},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+					Template: v1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "test-container", Image: "test-image"}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deployment)).Should(Succeed())
+
+			By("By creating a DeploymentVersion without a selector or template")
+			deploymentVersion := &kyaninusv1.DeploymentVersion{
+				ObjectMeta: metav1.ObjectMeta{Name: "shorthandbase-v1", Namespace: DeployNamespace},
+				Spec: kyaninusv1.DeploymentVersionSpec{
+					Name:      "shorthandbase",
+					Namespace: DeployNamespace,
+					Images:    map[string]string{"test-container": "test-image:v1"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deploymentVersion)).Should(Succeed())
+
+			Eventually(func() string {
+				child := &appsv1.Deployment{}
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: "shorthandbase-v1", Namespace: DeployNamespace}, child); err != nil {
+					return ""
+				}
+				return child.Spec.Template.Spec.Containers[0].Image
+			}, timeout, interval).Should(Equal("test-image:v1"))
+		})
+	})
+
+	Context("When a DeploymentVersion references a base Service", func() {
+		It("A version Service selecting the version pods should be created", func() {
+			ctx := context.Background()
+
+			baseLabels := map[string]string{"app": "svcbase"}
+			versionLabels := map[string]string{"app": "svcbase-v1"}
+
+			By("By creating a base Deployment and Service")
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "svcbase", Namespace: DeployNamespace},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+					Template: v1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "test-container", Image: "test-image"}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deployment)).Should(Succeed())
+
+			service := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svcbase", Namespace: DeployNamespace},
+				Spec: v1.ServiceSpec{
+					Selector: baseLabels,
+					Ports:    []v1.ServicePort{{Name: "http", Port: 80}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+
+			By("By creating a DeploymentVersion with a serviceRef")
+			deploymentVersion := &kyaninusv1.DeploymentVersion{
+				ObjectMeta: metav1.ObjectMeta{Name: "svcbase-v1", Namespace: DeployNamespace},
+				Spec: kyaninusv1.DeploymentVersionSpec{
+					Name:       "svcbase",
+					Namespace:  DeployNamespace,
+					ServiceRef: &v1.LocalObjectReference{Name: "svcbase"},
+					DeploymentSpec: appsv1.DeploymentSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: versionLabels},
+						Template: v1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{Labels: versionLabels},
+							Spec: v1.PodSpec{
+								Containers: []v1.Container{{Name: "test-container", Image: "test-image:v1"}},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deploymentVersion)).Should(Succeed())
+
+			By("Waiting for controller created service")
+			createdService := &v1.Service{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, types.NamespacedName{Name: "svcbase-v1", Namespace: DeployNamespace}, createdService)
+			}, timeout, interval).Should(Succeed())
+
+			Expect(createdService.Spec.Selector).Should(Equal(map[string]string{
+				"app":                   "svcbase-v1",
+				kyaninusv1.VersionLabel: "svcbase-v1",
+			}))
+			Expect(createdService.Spec.Ports).Should(HaveLen(1))
+			Expect(metav1.IsControlledBy(createdService, deploymentVersion)).Should(BeTrue())
+		})
+	})
+
+	Context("When the base Deployment changes", func() {
+		It("The change should be merged into the generated deployment", func() {
+			ctx := context.Background()
+
+			baseLabels := map[string]string{"app": "changingbase"}
+
+			By("By creating a base Deployment and a DeploymentVersion")
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "changingbase", Namespace: DeployNamespace},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+					Template: v1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "test-container", Image: "test-image"}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deployment)).Should(Succeed())
+
+			deploymentVersion := &kyaninusv1.DeploymentVersion{
+				ObjectMeta: metav1.ObjectMeta{Name: "changingbase-v1", Namespace: DeployNamespace},
+				Spec: kyaninusv1.DeploymentVersionSpec{
+					Name:      "changingbase",
+					Namespace: DeployNamespace,
+					DeploymentSpec: appsv1.DeploymentSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+						Template: v1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+							Spec: v1.PodSpec{
+								Containers: []v1.Container{{Name: "test-container", Image: "test-image:v1"}},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deploymentVersion)).Should(Succeed())
+
+			childKey := types.NamespacedName{Name: "changingbase-v1", Namespace: DeployNamespace}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, childKey, &appsv1.Deployment{})
+			}, timeout, interval).Should(Succeed())
+
+			By("By updating the base Deployment")
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "changingbase", Namespace: DeployNamespace}, deployment)).Should(Succeed())
+			deployment.Spec.MinReadySeconds = 15
+			Expect(k8sClient.Update(ctx, deployment)).Should(Succeed())
+
+			Eventually(func() int32 {
+				child := &appsv1.Deployment{}
+				if err := k8sClient.Get(ctx, childKey, child); err != nil {
+					return 0
+				}
+				return child.Spec.MinReadySeconds
+			}, timeout, interval).Should(Equal(int32(15)))
+		})
+	})
+
+	Context("When a DeploymentVersion is deleted", func() {
+		It("Only the generated deployment should be removed", func() {
+			ctx := context.Background()
+
+			baseLabels := map[string]string{"app": "ownedbase"}
+
+			By("By creating a base Deployment and a DeploymentVersion")
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "ownedbase", Namespace: DeployNamespace},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+					Template: v1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "test-container", Image: "test-image"}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deployment)).Should(Succeed())
+
+			deploymentVersion := &kyaninusv1.DeploymentVersion{
+				ObjectMeta: metav1.ObjectMeta{Name: "ownedbase-v1", Namespace: DeployNamespace},
+				Spec: kyaninusv1.DeploymentVersionSpec{
+					Name:      "ownedbase",
+					Namespace: DeployNamespace,
+					DeploymentSpec: appsv1.DeploymentSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: baseLabels},
+						Template: v1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{Labels: baseLabels},
+							Spec: v1.PodSpec{
+								Containers: []v1.Container{{Name: "test-container", Image: "test-image:v1"}},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, deploymentVersion)).Should(Succeed())
+
+			By("Waiting for the generated deployment to be owned by the version")
+			childKey := types.NamespacedName{Name: "ownedbase-v1", Namespace: DeployNamespace}
+			child := &appsv1.Deployment{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, childKey, child)
+			}, timeout, interval).Should(Succeed())
+			Expect(metav1.IsControlledBy(child, deploymentVersion)).Should(BeTrue())
+
+			By("By deleting the DeploymentVersion")
+			Expect(k8sClient.Delete(ctx, deploymentVersion)).Should(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, childKey, &appsv1.Deployment{})
+				return apierrors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+
+			Consistently(func() error {
+				return k8sClient.Get(ctx, types.NamespacedName{Name: "ownedbase", Namespace: DeployNamespace}, &appsv1.Deployment{})
+			}, time.Second, interval).Should(Succeed())
 		})
 	})
 
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func TestDeleteExternalResourcesKeepsBase(t *testing.T) {
+	scheme := newTestScheme(t)
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp", Namespace: "default"},
+	}
+
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp"}, "myapp:2")
+	if err := controllerutil.SetControllerReference(version, clone, scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, clone, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if err := r.deleteExternalResources(ctx, version); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(clone), &appsv1.Deployment{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the generated deployment to be deleted, got %v", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &appsv1.Deployment{}); err != nil {
+		t.Errorf("expected the base deployment to be kept, got %v", err)
+	}
+}
+
+func TestDeleteExternalResourcesSkipsUnownedDeployment(t *testing.T) {
+	scheme := newTestScheme(t)
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default", UID: "v1"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp", Namespace: "default"},
+	}
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if err := r.deleteExternalResources(ctx, version); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &appsv1.Deployment{}); err != nil {
+		t.Errorf("a deployment not owned by the version must not be deleted, got %v", err)
+	}
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+	var kept appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &kept); err != nil {
+		t.Fatal(err)
+	}
+	if len(kept.OwnerReferences) != 0 {
+		t.Errorf("the base deployment must not be adopted, got owners %v", kept.OwnerReferences)
+	}
+}
@@ -0,0 +1,325 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// faultyClient fails the calls its hooks return an error for, and passes
+// every other call to the wrapped client.
+type faultyClient struct {
+	client.Client
+	get          func(key client.ObjectKey, obj client.Object) error
+	create       func(obj client.Object) error
+	update       func(obj client.Object) error
+	statusUpdate func(obj client.Object) error
+}
+
+func (c *faultyClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if c.get != nil {
+		if err := c.get(key, obj); err != nil {
+			return err
+		}
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *faultyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if c.create != nil {
+		if err := c.create(obj); err != nil {
+			return err
+		}
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if c.update != nil {
+		if err := c.update(obj); err != nil {
+			return err
+		}
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Status() client.StatusWriter {
+	return &faultyStatusWriter{StatusWriter: c.Client.Status(), update: c.statusUpdate}
+}
+
+type faultyStatusWriter struct {
+	client.StatusWriter
+	update func(obj client.Object) error
+}
+
+func (w *faultyStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if w.update != nil {
+		if err := w.update(obj); err != nil {
+			return err
+		}
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+// conflictOnce returns a hook failing the first call for a workload with a
+// conflict, and counting the calls.
+func conflictOnce(calls *int) func(obj client.Object) error {
+	return func(obj client.Object) error {
+		if _, workload := obj.(*unstructured.Unstructured); !workload {
+			return nil
+		}
+		*calls++
+		if *calls == 1 {
+			return apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, obj.GetName(), errors.New("the object has been modified"))
+		}
+		return nil
+	}
+}
+
+func newFaultyReconciler(t *testing.T, objs ...client.Object) (*DeploymentVersionReconciler, *faultyClient) {
+	scheme := newTestScheme(t)
+	faulty := &faultyClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+	return &DeploymentVersionReconciler{Client: faulty, Scheme: scheme}, faulty
+}
+
+// storedCondition reads a condition of the version as written to the API.
+func storedCondition(t *testing.T, r *DeploymentVersionReconciler, version *kyaninusv1.DeploymentVersion, conditionType string) *metav1.Condition {
+	t.Helper()
+	var stored kyaninusv1.DeploymentVersion
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(version), &stored); err != nil {
+		t.Fatal(err)
+	}
+	return meta.FindStatusCondition(stored.Status.Conditions, conditionType)
+}
+
+func reconcileRequest(version *kyaninusv1.DeploymentVersion) ctrl.Request {
+	return ctrl.Request{NamespacedName: client.ObjectKeyFromObject(version)}
+}
+
+func TestReconcileMissingBaseRequeues(t *testing.T) {
+	version := eventVersion()
+	r, _ := newFaultyReconciler(t, version)
+
+	result, err := r.Reconcile(context.Background(), reconcileRequest(version))
+	if err != nil {
+		t.Fatalf("a missing base is not an error, got %v", err)
+	}
+	if result.RequeueAfter != missingBaseRequeue {
+		t.Errorf("requeue after %v, want %v", result.RequeueAfter, missingBaseRequeue)
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionBaseFound); cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "BaseNotFound" {
+		t.Errorf("expected BaseFound to be False, got %+v", cond)
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionReady); cond == nil || cond.Reason != "BaseNotFound" {
+		t.Errorf("expected Ready to report the missing base, got %+v", cond)
+	}
+}
+
+func TestReconcileBaseFetchErrorRetries(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, faulty := newFaultyReconciler(t, base, version)
+	faulty.get = func(key client.ObjectKey, obj client.Object) error {
+		if key.Name == "myapp" {
+			return apierrors.NewServiceUnavailable("etcd is unavailable")
+		}
+		return nil
+	}
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest(version)); !apierrors.IsServiceUnavailable(err) {
+		t.Fatalf("expected the error to be returned for a retry, got %v", err)
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionBaseFound); cond == nil || cond.Status != metav1.ConditionUnknown || cond.Reason != "BaseFetchFailed" {
+		t.Errorf("expected BaseFound to be Unknown, got %+v", cond)
+	}
+}
+
+func TestReconcileCloneFetchErrorRetries(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, faulty := newFaultyReconciler(t, base, version)
+	faulty.get = func(key client.ObjectKey, obj client.Object) error {
+		if _, workload := obj.(*unstructured.Unstructured); workload && key.Name == version.Name {
+			return apierrors.NewTimeoutError("request timed out", 1)
+		}
+		return nil
+	}
+	created := false
+	faulty.create = func(obj client.Object) error {
+		created = true
+		return nil
+	}
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest(version)); !apierrors.IsTimeout(err) {
+		t.Fatalf("expected the error to be returned for a retry, got %v", err)
+	}
+	if created {
+		t.Error("a clone that could not be fetched must not be created again")
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionDegraded); cond == nil || cond.Reason != "GetFailed" {
+		t.Errorf("expected Degraded to report the failed fetch, got %+v", cond)
+	}
+}
+
+func TestReconcileMergeFailureRetries(t *testing.T) {
+	version := eventVersion()
+	version.Spec.Images = map[string]string{"sidecar": "proxy:2"}
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, _ := newFaultyReconciler(t, base, version)
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest(version)); err == nil {
+		t.Fatal("expected the merge error to be returned")
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionMerged); cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "MergeFailed" {
+		t.Errorf("expected Merged to be False, got %+v", cond)
+	}
+}
+
+func TestReconcileCreateFailureRetries(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, faulty := newFaultyReconciler(t, base, version)
+	faulty.create = func(obj client.Object) error {
+		if _, workload := obj.(*unstructured.Unstructured); workload {
+			return apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, obj.GetName(), errors.New("exceeded quota"))
+		}
+		return nil
+	}
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest(version)); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected the create error to be returned, got %v", err)
+	}
+	if cond := storedCondition(t, r, version, kyaninusv1.ConditionDegraded); cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != "CreateFailed" {
+		t.Errorf("expected Degraded to report the failed create, got %+v", cond)
+	}
+}
+
+func TestReconcileUpdateConflictRetried(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, faulty := newFaultyReconciler(t, base, version)
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	faulty.update = conflictOnce(&calls)
+	version.Spec.Images["app"] = "myapp:3"
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatalf("expected the conflict to be retried, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("updated the clone %d times, want a retry after the conflict", calls)
+	}
+	var clone appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(version), &clone); err != nil {
+		t.Fatal(err)
+	}
+	if image := clone.Spec.Template.Spec.Containers[0].Image; image != "myapp:3" {
+		t.Errorf("clone image = %s, want the update to be applied", image)
+	}
+}
+
+func TestPromotionConflictRetried(t *testing.T) {
+	version := eventVersion()
+	version.Spec.Promote = true
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp-v2"}, "myapp:2")
+	r, faulty := newFaultyReconciler(t, base, version)
+	ctx := context.Background()
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), base); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	faulty.update = conflictOnce(&calls)
+	if err := r.reconcilePromotion(ctx, version, toWorkload(t, base), toWorkload(t, clone)); err != nil {
+		t.Fatalf("expected the conflict to be retried, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("updated the base %d times, want a retry after the conflict", calls)
+	}
+	var promoted appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &promoted); err != nil {
+		t.Fatal(err)
+	}
+	if image := promoted.Spec.Template.Spec.Containers[0].Image; image != "myapp:2" {
+		t.Errorf("base image = %s, want the promoted myapp:2", image)
+	}
+}
+
+func TestReconcileStatusConflictKeepsConcurrentWrite(t *testing.T) {
+	version := eventVersion()
+	version.Spec.Sleep = &kyaninusv1.SleepPolicy{AfterIdle: metav1.Duration{Duration: time.Hour}}
+	asleepSince := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	version.Status.LastActivityTime = &asleepSince
+	version.Status.Sleep = &kyaninusv1.SleepStatus{Asleep: true, Since: &asleepSince, Replicas: 2}
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, faulty := newFaultyReconciler(t, base, version)
+	ctx := context.Background()
+
+	// The activator wakes the version while it is being reconciled.
+	woken := false
+	faulty.statusUpdate = func(obj client.Object) error {
+		if woken {
+			return nil
+		}
+		woken = true
+		var latest kyaninusv1.DeploymentVersion
+		if err := faulty.Client.Get(ctx, client.ObjectKeyFromObject(obj), &latest); err != nil {
+			return err
+		}
+		now := metav1.Now()
+		latest.Status.LastActivityTime = &now
+		latest.Status.Sleep.Asleep = false
+		latest.Status.Sleep.Since = &now
+		return faulty.Client.Status().Update(ctx, &latest)
+	}
+
+	result, err := r.Reconcile(ctx, reconcileRequest(version))
+	if err != nil || !result.Requeue {
+		t.Fatalf("expected a conflicting status update to requeue, got %+v, %v", result, err)
+	}
+	if _, err := r.Reconcile(ctx, reconcileRequest(version)); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored kyaninusv1.DeploymentVersion
+	if err := r.Get(ctx, client.ObjectKeyFromObject(version), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status.Sleep == nil || stored.Status.Sleep.Asleep {
+		t.Errorf("the version woken by the activator was put back to sleep: %+v", stored.Status.Sleep)
+	}
+	if !meta.IsStatusConditionTrue(stored.Status.Conditions, kyaninusv1.ConditionBaseFound) {
+		t.Errorf("expected the status to be written once reconciled again, got %+v", stored.Status.Conditions)
+	}
+}
+
+func TestReconcileFinalizerConflictRequeues(t *testing.T) {
+	version := eventVersion()
+	r, faulty := newFaultyReconciler(t, version)
+	faulty.update = func(obj client.Object) error {
+		return apierrors.NewConflict(schema.GroupResource{Group: kyaninusv1.GroupVersion.Group, Resource: "deploymentversions"}, obj.GetName(), errors.New("the object has been modified"))
+	}
+
+	result, err := r.Reconcile(context.Background(), reconcileRequest(version))
+	if err != nil || !result.Requeue {
+		t.Errorf("expected a conflict adding the finalizer to requeue, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func eventVersion() *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2", Generation: 1},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:      "myapp",
+			Namespace: "default",
+			Images:    map[string]string{"app": "myapp:2"},
+		},
+	}
+}
+
+func newEventReconciler(t *testing.T, objs ...client.Object) (*DeploymentVersionReconciler, *record.FakeRecorder) {
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(20)
+	return &DeploymentVersionReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme:   scheme,
+		Recorder: recorder,
+	}, recorder
+}
+
+// recordedEvents drains the events recorded so far, formatted as
+// "<type> <reason> <message>".
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// expectEvent fails the test unless an event of the type and reason was
+// recorded.
+func expectEvent(t *testing.T, events []string, eventType, reason string) {
+	t.Helper()
+	for _, event := range events {
+		if strings.HasPrefix(event, eventType+" "+reason+" ") {
+			return
+		}
+	}
+	t.Errorf("expected a %s %s event, got %q", eventType, reason, events)
+}
+
+func TestEventsBaseNotFound(t *testing.T) {
+	version := eventVersion()
+	r, recorder := newEventReconciler(t, version)
+
+	r.reconcileDeployment(context.Background(), version, true)
+	expectEvent(t, recordedEvents(recorder), corev1.EventTypeWarning, "BaseNotFound")
+}
+
+func TestEventsMergeFailed(t *testing.T) {
+	version := eventVersion()
+	version.Spec.Images = map[string]string{"sidecar": "proxy:2"}
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, recorder := newEventReconciler(t, base, version)
+
+	r.reconcileDeployment(context.Background(), version, true)
+	events := recordedEvents(recorder)
+	expectEvent(t, events, corev1.EventTypeWarning, "MergeFailed")
+	if !strings.Contains(strings.Join(events, "\n"), `"sidecar"`) {
+		t.Errorf("expected the event to name the missing container, got %q", events)
+	}
+}
+
+func TestEventsCreatedUpdatedPromoted(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, recorder := newEventReconciler(t, base, version)
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+	events := recordedEvents(recorder)
+	expectEvent(t, events, corev1.EventTypeNormal, "Created")
+	if len(events) != 1 {
+		t.Errorf("expected only the Created event, got %q", events)
+	}
+
+	version.Spec.Images["app"] = "myapp:3"
+	version.Spec.Promote = true
+	version.Generation = 2
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+	events = recordedEvents(recorder)
+	expectEvent(t, events, corev1.EventTypeNormal, "Updated")
+	expectEvent(t, events, corev1.EventTypeNormal, "Promoted")
+}
+
+func TestEventsDeleted(t *testing.T) {
+	version := eventVersion()
+	scheme := newTestScheme(t)
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp"}, "myapp:2")
+	if err := controllerutil.SetControllerReference(version, clone, scheme); err != nil {
+		t.Fatal(err)
+	}
+	r, recorder := newEventReconciler(t, clone, version)
+
+	if err := r.deleteExternalResources(context.Background(), version); err != nil {
+		t.Fatal(err)
+	}
+	events := recordedEvents(recorder)
+	expectEvent(t, events, corev1.EventTypeNormal, "Deleted")
+	if len(events) != 1 || !strings.Contains(events[0], "Deployment myapp-v2") {
+		t.Errorf("expected one event for the generated Deployment, got %q", events)
+	}
+}
+
+func TestEventsWithoutRecorder(t *testing.T) {
+	version := eventVersion()
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	r, _ := newEventReconciler(t, base, version)
+	r.Recorder = nil
+
+	if _, err := r.reconcileDeployment(context.Background(), version, true); err != nil {
+		t.Fatal(err)
+	}
+	var clone appsv1.Deployment
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(version), &clone); err != nil {
+		t.Errorf("expected the version to reconcile without a recorder, got %v", err)
+	}
+}
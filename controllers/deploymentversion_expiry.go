@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// reconcileExpiry deletes the version once its TTL or idle period has
+// passed. It reports whether the version was deleted, and otherwise requeues
+// for the next check. Unless idleKnown, the activity of the version could not
+// be queried and only its TTL may expire it.
+func (r *DeploymentVersionReconciler) reconcileExpiry(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, now time.Time, idleKnown bool) (bool, ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	status := &deploymentVersion.Status
+
+	if deploymentVersion.Spec.TTL == nil && deploymentVersion.Spec.ExpireAfterIdle == nil {
+		status.ExpiresAt = nil
+		return false, ctrl.Result{}, nil
+	}
+
+	var expiresAt, ttlAt time.Time
+	if ttl := deploymentVersion.Spec.TTL; ttl != nil {
+		ttlAt = deploymentVersion.CreationTimestamp.Add(ttl.Duration)
+		expiresAt = ttlAt
+	}
+	if idle := deploymentVersion.Spec.ExpireAfterIdle; idle != nil {
+		lastActivity := deploymentVersion.CreationTimestamp
+		if status.LastActivityTime != nil {
+			lastActivity = *status.LastActivityTime
+		}
+		idleAt := lastActivity.Add(idle.Duration)
+		if expiresAt.IsZero() || idleAt.Before(expiresAt) {
+			expiresAt = idleAt
+		}
+	}
+	status.ExpiresAt = &metav1.Time{Time: expiresAt}
+
+	if !idleKnown && !now.Before(expiresAt) && (ttlAt.IsZero() || now.Before(ttlAt)) {
+		log.Info(fmt.Sprintf("%s %s", "Activity unknown, not expiring idle version", deploymentVersion.Name))
+		return false, ctrl.Result{RequeueAfter: activityInterval}, nil
+	}
+	if !now.Before(expiresAt) {
+		log.Info(fmt.Sprintf("%s %s", "Deleting expired version", deploymentVersion.Name))
+		if err := r.Delete(ctx, deploymentVersion); client.IgnoreNotFound(err) != nil {
+			return false, ctrl.Result{}, err
+		}
+		r.event(deploymentVersion, corev1.EventTypeNormal, "Deleted", "Deleted the version, expired at %s", expiresAt.Format(time.RFC3339))
+		return true, ctrl.Result{}, nil
+	}
+
+	requeueAfter := expiresAt.Sub(now)
+	if deploymentVersion.Spec.ExpireAfterIdle != nil && r.PrometheusURL != "" && requeueAfter > activityInterval {
+		requeueAfter = activityInterval
+	}
+	return false, ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// earliestRequeue combines two results, requeueing at the earlier of them.
+func earliestRequeue(a, b ctrl.Result) ctrl.Result {
+	result := ctrl.Result{Requeue: a.Requeue || b.Requeue, RequeueAfter: a.RequeueAfter}
+	if b.RequeueAfter > 0 && (result.RequeueAfter == 0 || b.RequeueAfter < result.RequeueAfter) {
+		result.RequeueAfter = b.RequeueAfter
+	}
+	return result
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func expiringVersion(created time.Time) *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "version-1", Namespace: "default", Generation: 1,
+			CreationTimestamp: metav1.Time{Time: created},
+		},
+		Status: kyaninusv1.DeploymentVersionStatus{ServiceName: "version-1"},
+	}
+}
+
+func TestExpiryTTL(t *testing.T) {
+	created := time.Now().Truncate(time.Second)
+	version := expiringVersion(created)
+	version.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	expired, result, err := r.reconcileExpiry(ctx, version, created.Add(20*time.Minute), true)
+	if err != nil || expired {
+		t.Fatalf("expected the version to live, expired %t err %v", expired, err)
+	}
+	if result.RequeueAfter != 40*time.Minute {
+		t.Errorf("requeue after %v, want 40m", result.RequeueAfter)
+	}
+	if version.Status.ExpiresAt == nil || !version.Status.ExpiresAt.Time.Equal(created.Add(time.Hour)) {
+		t.Errorf("expiresAt = %v, want %v", version.Status.ExpiresAt, created.Add(time.Hour))
+	}
+
+	expired, _, err = r.reconcileExpiry(ctx, version, created.Add(time.Hour), true)
+	if err != nil || !expired {
+		t.Fatalf("expected the version to expire, expired %t err %v", expired, err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(version), version); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the expired version to be deleted, got %v", err)
+	}
+}
+
+func TestExpiryIdleFromSpecUpdate(t *testing.T) {
+	created := time.Now().Truncate(time.Second)
+	version := expiringVersion(created)
+	version.Spec.ExpireAfterIdle = &metav1.Duration{Duration: time.Hour}
+	r := &DeploymentVersionReconciler{}
+	ctx := context.Background()
+
+	r.recordActivity(ctx, version, created)
+	r.reconcileExpiry(ctx, version, created, true)
+	version.Status.ObservedGeneration = version.Generation
+
+	// A spec update restarts the idle period.
+	version.Generation = 2
+	r.recordActivity(ctx, version, created.Add(50*time.Minute))
+	_, result, _ := r.reconcileExpiry(ctx, version, created.Add(50*time.Minute), true)
+	if want := created.Add(110 * time.Minute); !version.Status.ExpiresAt.Time.Equal(want) {
+		t.Errorf("expiresAt = %v, want %v", version.Status.ExpiresAt, want)
+	}
+	if result.RequeueAfter != time.Hour {
+		t.Errorf("without Prometheus the expiry is waited out, requeue %v", result.RequeueAfter)
+	}
+}
+
+func TestActivityFromRequests(t *testing.T) {
+	requests := "3"
+	prometheus := fakePrometheusFunc(t, func(query string) (string, bool) {
+		return requests, query == `sum(increase(nginx_ingress_controller_requests{exported_namespace="default",exported_service="version-1"}[5m]))`
+	})
+
+	created := time.Now().Truncate(time.Second)
+	version := expiringVersion(created)
+	version.Status.ObservedGeneration = 1
+	version.Status.LastActivityTime = &metav1.Time{Time: created}
+	version.Spec.ExpireAfterIdle = &metav1.Duration{Duration: time.Hour}
+	version.Spec.TTL = &metav1.Duration{Duration: 24 * time.Hour}
+	r := &DeploymentVersionReconciler{PrometheusURL: prometheus.URL}
+	ctx := context.Background()
+
+	now := created.Add(30 * time.Minute)
+	r.recordActivity(ctx, version, now)
+	_, result, _ := r.reconcileExpiry(ctx, version, now, true)
+	if !version.Status.LastActivityTime.Time.Equal(now) {
+		t.Errorf("lastActivityTime = %v, want %v", version.Status.LastActivityTime, now)
+	}
+	if result.RequeueAfter != activityInterval {
+		t.Errorf("requeue after %v, want the activity interval", result.RequeueAfter)
+	}
+
+	requests = "0"
+	r.recordActivity(ctx, version, now.Add(activityInterval))
+	r.reconcileExpiry(ctx, version, now.Add(activityInterval), true)
+	if !version.Status.LastActivityTime.Time.Equal(now) {
+		t.Errorf("an idle interval must keep the last activity, got %v", version.Status.LastActivityTime)
+	}
+	if want := now.Add(time.Hour); !version.Status.ExpiresAt.Time.Equal(want) {
+		t.Errorf("expiresAt = %v, want %v", version.Status.ExpiresAt, want)
+	}
+}
+
+func TestIdleUnknownWhilePrometheusFails(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer prometheus.Close()
+
+	created := time.Now().Truncate(time.Second)
+	version := expiringVersion(created)
+	version.Status.ObservedGeneration = 1
+	version.Status.LastActivityTime = &metav1.Time{Time: created}
+	version.Spec.ExpireAfterIdle = &metav1.Duration{Duration: time.Hour}
+	version.Spec.Sleep = &kyaninusv1.SleepPolicy{AfterIdle: metav1.Duration{Duration: 30 * time.Minute}}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(version).Build(),
+		Scheme:        scheme,
+		PrometheusURL: prometheus.URL,
+	}
+	ctx := context.Background()
+
+	now := created.Add(2 * time.Hour)
+	err := r.recordActivity(ctx, version, now)
+	if err == nil {
+		t.Fatal("expected the activity query to fail")
+	}
+	idleKnown := err == nil
+
+	deploy := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(3)}}
+	version.Status.Sleep = &kyaninusv1.SleepStatus{Since: &metav1.Time{Time: created}}
+	if result := r.reconcileSleep(ctx, version, deploy, now, idleKnown); result.RequeueAfter != activityInterval {
+		t.Errorf("sleep requeue after %v, want the activity interval", result.RequeueAfter)
+	}
+	if version.Status.Sleep.Asleep || *deploy.Spec.Replicas != 3 {
+		t.Errorf("a version of unknown activity must stay awake, status %+v", version.Status.Sleep)
+	}
+
+	expired, result, err := r.reconcileExpiry(ctx, version, now, idleKnown)
+	if err != nil || expired {
+		t.Fatalf("a version of unknown activity must not expire, expired %t err %v", expired, err)
+	}
+	if result.RequeueAfter != activityInterval {
+		t.Errorf("expiry requeue after %v, want the activity interval", result.RequeueAfter)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(version), &kyaninusv1.DeploymentVersion{}); err != nil {
+		t.Errorf("expected the version to be kept, got %v", err)
+	}
+
+	version.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+	if expired, _, _ := r.reconcileExpiry(ctx, version, now, idleKnown); !expired {
+		t.Error("expected the TTL to expire the version regardless of its activity")
+	}
+}
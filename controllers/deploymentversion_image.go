@@ -0,0 +1,322 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// defaultImagePollInterval is how often the registry of an ImagePolicy is
+// polled when the policy sets no interval.
+const defaultImagePollInterval = 5 * time.Minute
+
+// reconcileImagePolicy polls the registry of the ImagePolicy of a version once
+// its interval has passed, or its spec changed, and pins the container of
+// newDeploy to the resolved digest. When the registry cannot be polled the
+// last resolved digest stays pinned.
+func (r *DeploymentVersionReconciler) reconcileImagePolicy(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, newDeploy *appsv1.Deployment, now time.Time) ctrl.Result {
+	log := log.FromContext(ctx)
+	status := &deploymentVersion.Status
+	policy := deploymentVersion.Spec.ImagePolicy
+
+	if policy == nil {
+		status.Image = nil
+		meta.RemoveStatusCondition(&status.Conditions, kyaninusv1.ConditionImageResolved)
+		return ctrl.Result{}
+	}
+	interval := defaultImagePollInterval
+	if policy.Interval != nil && policy.Interval.Duration > 0 {
+		interval = policy.Interval.Duration
+	}
+
+	podSpec := &newDeploy.Spec.Template.Spec
+	var container *corev1.Container
+	for _, c := range append(containerPointers(podSpec.InitContainers), containerPointers(podSpec.Containers)...) {
+		if c.Name == policy.Container {
+			container = c
+		}
+	}
+	if container == nil {
+		setCondition(deploymentVersion, kyaninusv1.ConditionImageResolved, metav1.ConditionFalse, "ContainerNotFound",
+			fmt.Sprintf("container %q not found in the pod template", policy.Container))
+		return ctrl.Result{}
+	}
+
+	repositoryName := policy.Repository
+	if repositoryName == "" {
+		repositoryName = container.Image
+	}
+	repository := parseImageRepository(repositoryName)
+
+	resolved := status.Image
+	if resolved != nil && (resolved.Container != policy.Container || !strings.HasPrefix(resolved.Image, repository.String()+"@")) {
+		resolved = nil
+	}
+	due := resolved == nil || resolved.LastPollTime == nil ||
+		status.ObservedGeneration != deploymentVersion.Generation ||
+		now.Sub(resolved.LastPollTime.Time) >= interval
+
+	if due {
+		tag, digest, err := r.resolveImage(ctx, deploymentVersion, repository)
+		if err != nil {
+			log.Error(err, fmt.Sprintf("%s %s", "Unable to resolve image of", repository))
+			setCondition(deploymentVersion, kyaninusv1.ConditionImageResolved, metav1.ConditionFalse, "PollFailed", err.Error())
+			if resolved != nil {
+				resolved.LastPollTime = &metav1.Time{Time: now}
+			}
+		} else {
+			image := repository.String() + "@" + digest
+			if resolved == nil || resolved.Image != image {
+				log.Info(fmt.Sprintf("%s %s", "Pinning image", image))
+			}
+			resolved = &kyaninusv1.ImageStatus{
+				Container:    policy.Container,
+				Tag:          tag,
+				Digest:       digest,
+				Image:        image,
+				LastPollTime: &metav1.Time{Time: now},
+			}
+			setCondition(deploymentVersion, kyaninusv1.ConditionImageResolved, metav1.ConditionTrue, "Resolved",
+				fmt.Sprintf("Resolved %s:%s to %s", repository, tag, digest))
+		}
+	}
+	status.Image = resolved
+
+	if resolved == nil {
+		return ctrl.Result{RequeueAfter: interval}
+	}
+	container.Image = resolved.Image
+
+	requeueAfter := resolved.LastPollTime.Add(interval).Sub(now)
+	if requeueAfter <= 0 {
+		requeueAfter = interval
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}
+}
+
+// resolveImage selects a tag of the repository by the ImagePolicy of the
+// version, and returns it with the digest of its manifest. Tags that cannot
+// be resolved are skipped when selecting the latest one.
+func (r *DeploymentVersionReconciler) resolveImage(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, repository imageRepository) (string, string, error) {
+	log := log.FromContext(ctx)
+	policy := deploymentVersion.Spec.ImagePolicy
+	pattern, err := regexp.Compile(policy.TagPattern)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid tag pattern: %w", err)
+	}
+
+	registry := &registryClient{repository: repository, httpClient: r.HTTPClient}
+	if policy.PullSecretRef != nil {
+		if registry.username, registry.password, err = r.registryCredentials(ctx, deploymentVersion.Namespace, policy.PullSecretRef.Name, repository.Host); err != nil {
+			return "", "", err
+		}
+	}
+
+	tags, err := registry.tags(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to list tags of %s: %w", repository, err)
+	}
+	var candidates []string
+	for _, tag := range tags {
+		if pattern.MatchString(tag) {
+			candidates = append(candidates, tag)
+		}
+	}
+	// Ties are broken by the tag name, so the selection is stable.
+	sort.Strings(candidates)
+
+	if policy.Select == kyaninusv1.ImageSelectSemver {
+		var best string
+		var bestVersion semver
+		for _, tag := range candidates {
+			version, ok := parseSemver(tag)
+			if ok && (best == "" || version.compare(bestVersion) >= 0) {
+				best, bestVersion = tag, version
+			}
+		}
+		if best == "" {
+			return "", "", fmt.Errorf("no tag of %s matching %q is a semantic version", repository, policy.TagPattern)
+		}
+		digest, err := registry.digest(ctx, best)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to resolve %s:%s: %w", repository, best, err)
+		}
+		return best, digest, nil
+	}
+
+	var best, bestDigest string
+	var bestCreated time.Time
+	skipped := 0
+	for _, tag := range candidates {
+		digest, created, err := r.imageCreated(ctx, registry, tag)
+		if err != nil {
+			// A broken tag must not hold back the other ones.
+			log.Error(err, fmt.Sprintf("%s %s:%s", "Skipping unresolvable tag", repository, tag))
+			skipped++
+			continue
+		}
+		if best == "" || !created.Before(bestCreated) {
+			best, bestDigest, bestCreated = tag, digest, created
+		}
+	}
+	if best == "" && skipped > 0 {
+		return "", "", fmt.Errorf("none of the %d tags of %s matching %q could be resolved", skipped, repository, policy.TagPattern)
+	}
+	if best == "" {
+		return "", "", fmt.Errorf("no tag of %s matches %q", repository, policy.TagPattern)
+	}
+	return best, bestDigest, nil
+}
+
+// imageCreated returns the digest of a tag and the creation time of its image.
+// Only the digest is fetched for an image whose creation time is cached.
+func (r *DeploymentVersionReconciler) imageCreated(ctx context.Context, registry *registryClient, tag string) (string, time.Time, error) {
+	digest, err := registry.digest(ctx, tag)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if created, found := imageCreationTimes.get(registry.repository, digest); found {
+		return digest, created, nil
+	}
+	_, created, err := registry.created(ctx, digest)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	imageCreationTimes.set(registry.repository, digest, created)
+	return digest, created, nil
+}
+
+// registryCredentials reads the username and password of a registry host from
+// a kubernetes.io/dockerconfigjson Secret.
+func (r *DeploymentVersionReconciler) registryCredentials(ctx context.Context, namespace, name, host string) (string, string, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &secret); err != nil {
+		return "", "", fmt.Errorf("unable to read pull secret %s: %w", name, err)
+	}
+	var config struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+		return "", "", fmt.Errorf("decoding pull secret %s: %w", name, err)
+	}
+
+	keys := []string{host, "https://" + host, "https://" + host + "/v1/", "https://" + host + "/v2/"}
+	if host == "docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+	for _, key := range keys {
+		auth, found := config.Auths[key]
+		if !found {
+			continue
+		}
+		if auth.Username == "" && auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("decoding pull secret %s: %w", name, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				auth.Username, auth.Password = parts[0], parts[1]
+			}
+		}
+		return auth.Username, auth.Password, nil
+	}
+	return "", "", fmt.Errorf("pull secret %s has no credentials for %s", name, host)
+}
+
+// semver is a semantic version, https://semver.org.
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+var semverPattern = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+// parseSemver parses a tag such as v1.2.3 or 1.2.3-rc.1.
+func parseSemver(tag string) (semver, bool) {
+	match := semverPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return semver{}, false
+	}
+	var version semver
+	var err error
+	for i, part := range []*int{&version.major, &version.minor, &version.patch} {
+		if *part, err = strconv.Atoi(match[i+1]); err != nil {
+			return semver{}, false
+		}
+	}
+	if match[4] != "" {
+		version.prerelease = strings.Split(match[4], ".")
+	}
+	return version, true
+}
+
+// compare orders versions by precedence, returning -1, 0 or 1. Pre-releases
+// precede their release.
+func (v semver) compare(other semver) int {
+	for _, pair := range [][2]int{{v.major, other.major}, {v.minor, other.minor}, {v.patch, other.patch}} {
+		if pair[0] != pair[1] {
+			return compareInts(pair[0], pair[1])
+		}
+	}
+	switch {
+	case len(v.prerelease) == 0 && len(other.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(other.prerelease); i++ {
+		a, b := v.prerelease[i], other.prerelease[i]
+		if a == b {
+			continue
+		}
+		aNum, aErr := strconv.Atoi(a)
+		bNum, bErr := strconv.Atoi(b)
+		switch {
+		case aErr == nil && bErr == nil:
+			return compareInts(aNum, bNum)
+		case aErr == nil:
+			// Numeric identifiers precede alphanumeric ones.
+			return -1
+		case bErr == nil:
+			return 1
+		case a < b:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return compareInts(len(v.prerelease), len(other.prerelease))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
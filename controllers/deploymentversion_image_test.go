@@ -0,0 +1,453 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// fakeRegistry is an in-process registry serving the myapp repository
+// through the OCI distribution API. Tag listings are paged two tags at a time.
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	tags      map[string]string
+	requests  int
+	// gets counts the GET requests by path.
+	gets map[string]int
+
+	// username and password, when set, are required by a token service
+	// issuing the bearer token of the registry.
+	username, password string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	registry := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}, tags: map[string]string{}, gets: map[string]int{}}
+	registry.Server = httptest.NewTLSServer(http.HandlerFunc(registry.serve))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// repository is the myapp repository as written in image references.
+func (f *fakeRegistry) repository() string {
+	return strings.TrimPrefix(f.URL, "https://") + "/myapp"
+}
+
+// push stores an image created at the given time under a tag, and returns
+// the digest of its manifest.
+func (f *fakeRegistry) push(tag string, created time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config := []byte(fmt.Sprintf(`{"created":%q,"architecture":"amd64","os":"linux"}`, created.Format(time.RFC3339)))
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	f.blobs[configDigest] = config
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q}}`, configDigest))
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	f.manifests[digest] = manifest
+	f.tags[tag] = digest
+	return digest
+}
+
+// pushIndex stores an index of the image of tag under another tag.
+func (f *fakeRegistry) pushIndex(tag, imageTag string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[`+
+		`{"digest":"sha256:arm","platform":{"architecture":"arm64","os":"linux"}},`+
+		`{"digest":%q,"platform":{"architecture":"amd64","os":"linux"}}]}`, f.tags[imageTag]))
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(index))
+	f.manifests[digest] = index
+	f.tags[tag] = digest
+	return digest
+}
+
+// pushBroken stores an image under a tag whose config is missing, so that its
+// creation time cannot be read.
+func (f *fakeRegistry) pushBroken(tag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:missing"}}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	f.manifests[digest] = manifest
+	f.tags[tag] = digest
+}
+
+func (f *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if req.Method == http.MethodGet {
+		f.gets[req.URL.Path]++
+	}
+
+	if req.URL.Path == "/token" {
+		if username, password, _ := req.BasicAuth(); username != f.username || password != f.password {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:myapp:pull" {
+			http.Error(w, "bad scope", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"pull-token"}`)
+		return
+	}
+	if f.username != "" && req.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, f.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/v2/myapp/tags/list":
+		var tags []string
+		for tag := range f.tags {
+			if tag > req.URL.Query().Get("last") {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		if len(tags) > 2 {
+			tags = tags[:2]
+			w.Header().Set("Link", fmt.Sprintf(`</v2/myapp/tags/list?n=2&last=%s>; rel="next"`, tags[1]))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "myapp", "tags": tags})
+	case strings.HasPrefix(req.URL.Path, "/v2/myapp/manifests/"):
+		reference := strings.TrimPrefix(req.URL.Path, "/v2/myapp/manifests/")
+		digest, found := f.tags[reference]
+		if !found {
+			digest = reference
+		}
+		manifest, found := f.manifests[digest]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		if req.Method == http.MethodGet {
+			w.Write(manifest)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v2/myapp/blobs/"):
+		blob, found := f.blobs[strings.TrimPrefix(req.URL.Path, "/v2/myapp/blobs/")]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(blob)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeRegistry) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func imagePolicyVersion(policy *kyaninusv1.ImagePolicy) *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-main", Namespace: "default", Generation: 1},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp", ImagePolicy: policy},
+		Status:     kyaninusv1.DeploymentVersionStatus{ObservedGeneration: 1},
+	}
+}
+
+func newImageReconciler(t *testing.T, registry *fakeRegistry, objs ...client.Object) *DeploymentVersionReconciler {
+	return &DeploymentVersionReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(objs...).Build(),
+		HTTPClient: registry.Client(),
+	}
+}
+
+func TestImagePolicyLatest(t *testing.T) {
+	registry := newFakeRegistry(t)
+	start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	registry.push("main-1a2b3c4", start)
+	newest := registry.push("main-5d6e7f8", start.Add(2*time.Hour))
+	registry.push("main-9a8b7c6", start.Add(time.Hour))
+	registry.push("release-1", start.Add(3*time.Hour))
+
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{
+		Container:  "app",
+		TagPattern: "^main-",
+		Interval:   &metav1.Duration{Duration: 10 * time.Minute},
+	})
+	r := newImageReconciler(t, registry)
+	ctx := context.Background()
+	now := time.Now()
+
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	result := r.reconcileImagePolicy(ctx, version, deploy, now)
+	want := registry.repository() + "@" + newest
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != want {
+		t.Fatalf("image = %s, want %s", got, want)
+	}
+	if status := version.Status.Image; status == nil || status.Tag != "main-5d6e7f8" || status.Digest != newest || status.Image != want {
+		t.Errorf("unexpected image status %+v", version.Status.Image)
+	}
+	if !meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionImageResolved) {
+		t.Errorf("expected ImageResolved, conditions %+v", version.Status.Conditions)
+	}
+	if result.RequeueAfter != 10*time.Minute {
+		t.Errorf("requeue after %v, want the interval", result.RequeueAfter)
+	}
+
+	// Within the interval the registry is not polled, but the digest stays pinned.
+	newer := registry.push("main-0f0f0f0", start.Add(4*time.Hour))
+	requests := registry.requestCount()
+	deploy = testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	result = r.reconcileImagePolicy(ctx, version, deploy, now.Add(4*time.Minute))
+	if registry.requestCount() != requests {
+		t.Error("expected the registry not to be polled within the interval")
+	}
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != want {
+		t.Errorf("image = %s, want it to stay pinned", got)
+	}
+	if result.RequeueAfter != 6*time.Minute {
+		t.Errorf("requeue after %v, want the rest of the interval", result.RequeueAfter)
+	}
+
+	r.reconcileImagePolicy(ctx, version, deploy, now.Add(10*time.Minute))
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != registry.repository()+"@"+newer {
+		t.Errorf("image = %s, want the newly pushed digest", got)
+	}
+}
+
+func TestImagePolicyLatestIndex(t *testing.T) {
+	registry := newFakeRegistry(t)
+	start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	registry.push("main-1a2b3c4-amd64", start.Add(time.Hour))
+	registry.push("main-5d6e7f8-amd64", start)
+	index := registry.pushIndex("main-1a2b3c4", "main-1a2b3c4-amd64")
+	registry.pushIndex("main-5d6e7f8", "main-5d6e7f8-amd64")
+
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{Container: "app", TagPattern: `^main-[0-9a-f]+$`})
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	newImageReconciler(t, registry).reconcileImagePolicy(context.Background(), version, deploy, time.Now())
+
+	if status := version.Status.Image; status == nil || status.Tag != "main-1a2b3c4" || status.Digest != index {
+		t.Errorf("expected the index of the newest image, got %+v", version.Status.Image)
+	}
+}
+
+func TestImagePolicyLatestCachesCreationTimes(t *testing.T) {
+	registry := newFakeRegistry(t)
+	start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	registry.push("main-1a2b3c4", start)
+	registry.push("main-5d6e7f8", start.Add(time.Hour))
+	registry.push("main-9a8b7c6-amd64", start.Add(2*time.Hour))
+	newest := registry.pushIndex("main-9a8b7c6", "main-9a8b7c6-amd64")
+
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{Container: "app", TagPattern: `^main-[0-9a-f]+$`})
+	r := newImageReconciler(t, registry)
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+		r.reconcileImagePolicy(ctx, version, deploy, now.Add(time.Duration(i)*defaultImagePollInterval))
+		if status := version.Status.Image; status == nil || status.Digest != newest {
+			t.Fatalf("poll %d: expected the newest index, got %+v", i, version.Status.Image)
+		}
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for path, gets := range registry.gets {
+		if gets > 1 && !strings.HasSuffix(path, "/tags/list") {
+			t.Errorf("%s was fetched %d times, want its creation time cached", path, gets)
+		}
+	}
+}
+
+func TestImagePolicyLatestSkipsBrokenTags(t *testing.T) {
+	registry := newFakeRegistry(t)
+	start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	resolvable := registry.push("main-1a2b3c4", start)
+	registry.pushBroken("main-5d6e7f8")
+
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{Container: "app", TagPattern: "^main-"})
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	newImageReconciler(t, registry).reconcileImagePolicy(context.Background(), version, deploy, time.Now())
+
+	if status := version.Status.Image; status == nil || status.Tag != "main-1a2b3c4" || status.Digest != resolvable {
+		t.Errorf("expected the resolvable tag, got %+v", version.Status.Image)
+	}
+	if !meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionImageResolved) {
+		t.Errorf("expected ImageResolved, conditions %+v", version.Status.Conditions)
+	}
+
+	registry.pushBroken("main-1a2b3c4")
+	version = imagePolicyVersion(&kyaninusv1.ImagePolicy{Container: "app", TagPattern: "^main-"})
+	newImageReconciler(t, registry).reconcileImagePolicy(context.Background(), version, deploy, time.Now())
+	if meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionImageResolved) {
+		t.Error("expected no image to resolve when every tag is broken")
+	}
+}
+
+func TestImagePolicySemver(t *testing.T) {
+	registry := newFakeRegistry(t)
+	created := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, tag := range []string{"v1.2.0", "v1.10.0-rc.1", "v2.0.0-beta.1", "latest", "v1.9.3"} {
+		registry.push(tag, created)
+	}
+	release := registry.push("v1.10.0", created.Add(-time.Hour))
+
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{
+		Container:  "app",
+		Repository: registry.repository(),
+		TagPattern: `^v1\.`,
+		Select:     kyaninusv1.ImageSelectSemver,
+	})
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, "myapp:1")
+	newImageReconciler(t, registry).reconcileImagePolicy(context.Background(), version, deploy, time.Now())
+
+	if status := version.Status.Image; status == nil || status.Tag != "v1.10.0" || status.Digest != release {
+		t.Fatalf("expected the highest v1 release, got %+v", version.Status.Image)
+	}
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != registry.repository()+"@"+release {
+		t.Errorf("image = %s", got)
+	}
+}
+
+func TestImagePolicyPullSecret(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.username, registry.password = "ci", "hunter2"
+	digest := registry.push("main-1a2b3c4", time.Now())
+
+	host := strings.TrimPrefix(registry.URL, "https://")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(fmt.Sprintf(`{"auths":{%q:{"auth":"Y2k6aHVudGVyMg=="}}}`, host)),
+		},
+	}
+	policy := &kyaninusv1.ImagePolicy{Container: "app", PullSecretRef: &corev1.LocalObjectReference{Name: "registry"}}
+	version := imagePolicyVersion(policy)
+	r := newImageReconciler(t, registry, secret)
+	ctx := context.Background()
+	now := time.Now()
+
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	r.reconcileImagePolicy(ctx, version, deploy, now)
+	if status := version.Status.Image; status == nil || status.Digest != digest {
+		t.Fatalf("expected the image to resolve with the pull secret, got %+v (conditions %+v)", status, version.Status.Conditions)
+	}
+
+	// Without credentials the poll fails, and the last digest stays pinned.
+	policy.PullSecretRef = nil
+	deploy = testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	result := r.reconcileImagePolicy(ctx, version, deploy, now.Add(defaultImagePollInterval))
+	cond := meta.FindStatusCondition(version.Status.Conditions, kyaninusv1.ConditionImageResolved)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "PollFailed" {
+		t.Errorf("expected PollFailed, got %+v", cond)
+	}
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != registry.repository()+"@"+digest {
+		t.Errorf("image = %s, want the last resolved digest", got)
+	}
+	if result.RequeueAfter != defaultImagePollInterval {
+		t.Errorf("requeue after %v, want the interval", result.RequeueAfter)
+	}
+}
+
+func TestImagePolicyUnknownContainer(t *testing.T) {
+	registry := newFakeRegistry(t)
+	version := imagePolicyVersion(&kyaninusv1.ImagePolicy{Container: "sidecar"})
+	deploy := testDeployment("myapp-main", map[string]string{"app": "myapp"}, registry.repository()+":main")
+	newImageReconciler(t, registry).reconcileImagePolicy(context.Background(), version, deploy, time.Now())
+
+	cond := meta.FindStatusCondition(version.Status.Conditions, kyaninusv1.ConditionImageResolved)
+	if cond == nil || cond.Reason != "ContainerNotFound" {
+		t.Errorf("expected ContainerNotFound, got %+v", cond)
+	}
+	if registry.requestCount() != 0 {
+		t.Error("expected the registry not to be polled")
+	}
+}
+
+func TestRegistryTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Accept connections and never answer the TLS handshake.
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	defer func(timeout time.Duration) { registryTimeout = timeout }(registryTimeout)
+	registryTimeout = 50 * time.Millisecond
+
+	registry := &registryClient{repository: imageRepository{Host: listener.Addr().String(), Name: "myapp"}}
+	if _, err := registry.tags(context.Background()); err == nil {
+		t.Fatal("expected a hung registry to time out")
+	}
+}
+
+func TestParseImageRepository(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                                  "docker.io/library/nginx",
+		"nginx:1.21":                             "docker.io/library/nginx",
+		"acme/myapp:main":                        "docker.io/acme/myapp",
+		"ghcr.io/acme/myapp:main":                "ghcr.io/acme/myapp",
+		"localhost:5000/myapp:main":              "localhost:5000/myapp",
+		"registry.example.com/myapp@sha256:0a1b": "registry.example.com/myapp",
+	}
+	for image, want := range tests {
+		if got := parseImageRepository(image).String(); got != want {
+			t.Errorf("parseImageRepository(%q) = %s, want %s", image, got, want)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	// Each version precedes the next.
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "v1.0.0", "1.0.1", "1.10.0", "2.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, okA := parseSemver(ordered[i-1])
+		b, okB := parseSemver(ordered[i])
+		if !okA || !okB {
+			t.Fatalf("unable to parse %s or %s", ordered[i-1], ordered[i])
+		}
+		if a.compare(b) != -1 || b.compare(a) != 1 {
+			t.Errorf("expected %s to precede %s", ordered[i-1], ordered[i])
+		}
+	}
+	for _, tag := range []string{"latest", "1.2", "01.2.3", "main-1a2b3c4"} {
+		if _, ok := parseSemver(tag); ok {
+			t.Errorf("expected %s not to be a semantic version", tag)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// isolateVersion adds the version label to the selector and pod template of
+// the generated Deployment, and relabels its pods where a Service of the base
+// Deployment would otherwise select them. The outcome is recorded in the
+// Isolated condition.
+func (r *DeploymentVersionReconciler) isolateVersion(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, baseDeploy *appsv1.Deployment, newDeploy *appsv1.Deployment) error {
+	log := log.FromContext(ctx)
+
+	spec := &newDeploy.Spec
+	if spec.Selector == nil {
+		spec.Selector = &metav1.LabelSelector{}
+	}
+	if spec.Selector.MatchLabels == nil {
+		spec.Selector.MatchLabels = map[string]string{}
+	}
+	if spec.Template.Labels == nil {
+		spec.Template.Labels = map[string]string{}
+	}
+	spec.Selector.MatchLabels[kyaninusv1.VersionLabel] = deploymentVersion.Name
+	spec.Template.Labels[kyaninusv1.VersionLabel] = deploymentVersion.Name
+
+	baseServices, err := r.baseServices(ctx, deploymentVersion, baseDeploy)
+	if err != nil {
+		return err
+	}
+
+	var shared []string
+	for _, service := range baseServices {
+		if !labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(spec.Template.Labels)) {
+			continue
+		}
+		if !relabelVersionPods(spec, service.Spec.Selector, deploymentVersion.Name) {
+			shared = append(shared, service.Name)
+			continue
+		}
+		log.Info(fmt.Sprintf("%s %s", "Relabelled version pods to leave base service", service.Name))
+	}
+
+	if len(shared) > 0 {
+		setCondition(deploymentVersion, kyaninusv1.ConditionIsolated, metav1.ConditionFalse, "SharedPods",
+			fmt.Sprintf("Base services %s select the pods of the version", strings.Join(shared, ", ")))
+		return nil
+	}
+	setCondition(deploymentVersion, kyaninusv1.ConditionIsolated, metav1.ConditionTrue, "Isolated", "")
+	return nil
+}
+
+// baseServices lists the Services, in the namespace of the version, that
+// select the pods of the base Deployment and were not generated for a version.
+func (r *DeploymentVersionReconciler) baseServices(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, baseDeploy *appsv1.Deployment) ([]corev1.Service, error) {
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services, client.InNamespace(deploymentVersion.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var selected []corev1.Service
+	for _, service := range services.Items {
+		if len(service.Spec.Selector) == 0 {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&service); owner != nil && owner.Kind == "DeploymentVersion" {
+			continue
+		}
+		if deploymentVersion.Spec.ServiceRef != nil && baseDeploy.Namespace == deploymentVersion.Namespace &&
+			service.Name == deploymentVersion.Spec.ServiceRef.Name {
+			selected = append(selected, service)
+			continue
+		}
+		if labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(baseDeploy.Spec.Template.Labels)) {
+			selected = append(selected, service)
+		}
+	}
+	return selected, nil
+}
+
+// relabelVersionPods suffixes one of the labels a base Service selects on with
+// the version name, in both the pod template and the selector of the generated
+// Deployment. It reports false when no label can be changed.
+func relabelVersionPods(spec *appsv1.DeploymentSpec, serviceSelector map[string]string, version string) bool {
+	keys := make([]string, 0, len(serviceSelector))
+	for key := range serviceSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == kyaninusv1.VersionLabel || selectorExpressionsUse(spec.Selector, key) {
+			continue
+		}
+		value := fmt.Sprintf("%s-%s", serviceSelector[key], version)
+		if len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+
+		spec.Template.Labels[key] = value
+		if _, ok := spec.Selector.MatchLabels[key]; ok {
+			spec.Selector.MatchLabels[key] = value
+		}
+		return true
+	}
+	return false
+}
+
+func selectorExpressionsUse(selector *metav1.LabelSelector, key string) bool {
+	for _, requirement := range selector.MatchExpressions {
+		if requirement.Key == key {
+			return true
+		}
+	}
+	return false
+}
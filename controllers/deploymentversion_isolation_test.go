@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func TestVersionIsolation(t *testing.T) {
+	baseLabels := map[string]string{"app": "myapp", "tier": "web"}
+	base := testDeployment("myapp", baseLabels, "myapp:1")
+	baseService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "myapp"}},
+	}
+	otherService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "other"}},
+	}
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2"},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:      "myapp",
+			Namespace: "default",
+			DeploymentSpec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "myapp:2"}},
+			}}},
+		},
+	}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, baseService, otherService, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var clone appsv1.Deployment
+	if err := r.Get(ctx, types.NamespacedName{Name: "myapp-v2", Namespace: "default"}, &clone); err != nil {
+		t.Fatal(err)
+	}
+	podLabels := labels.Set(clone.Spec.Template.Labels)
+	if podLabels[kyaninusv1.VersionLabel] != "myapp-v2" || clone.Spec.Selector.MatchLabels[kyaninusv1.VersionLabel] != "myapp-v2" {
+		t.Errorf("expected the version label on the selector and pods, got %v and %v", clone.Spec.Selector.MatchLabels, podLabels)
+	}
+	if labels.SelectorFromSet(baseService.Spec.Selector).Matches(podLabels) {
+		t.Errorf("the base service must not select the version pods %v", podLabels)
+	}
+	if labels.SelectorFromSet(base.Spec.Selector.MatchLabels).Matches(podLabels) {
+		t.Errorf("the base deployment must not select the version pods %v", podLabels)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(clone.Spec.Selector)
+	if err != nil || !selector.Matches(podLabels) {
+		t.Errorf("the clone selector %v must select its own pods %v", clone.Spec.Selector, podLabels)
+	}
+	if podLabels["tier"] != "web" {
+		t.Errorf("labels not selected by base services must be kept, got %v", podLabels)
+	}
+	if !meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionIsolated) {
+		t.Errorf("expected an Isolated condition, got %v", version.Status.Conditions)
+	}
+}
+
+func TestVersionIsolationRecreatesCloneWithOldSelector(t *testing.T) {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp", Namespace: "default"},
+	}
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp"}, "myapp:1")
+	isController := true
+	clone.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: kyaninusv1.GroupVersion.String(), Kind: "DeploymentVersion", Name: "myapp-v2", UID: "v2", Controller: &isController,
+	}}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, clone, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var recreated appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(clone), &recreated); err != nil {
+		t.Fatal(err)
+	}
+	if recreated.Spec.Selector.MatchLabels[kyaninusv1.VersionLabel] != "myapp-v2" {
+		t.Errorf("expected the clone to be recreated with the version selector, got %v", recreated.Spec.Selector)
+	}
+}
+
+func TestVersionIsolationReportsSharedPods(t *testing.T) {
+	spec := &appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels:      map[string]string{},
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"myapp"}}},
+		},
+		Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "myapp"}}},
+	}
+	if relabelVersionPods(spec, map[string]string{"app": "myapp"}, "myapp-v2") {
+		t.Errorf("a label used by selector expressions must not be relabelled")
+	}
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/imdario/mergo"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// mergeDeploymentSpec applies the overrides of a version to the spec of its
+// base Deployment, using the version's merge strategy.
+func mergeDeploymentSpec(base appsv1.DeploymentSpec, deploymentVersion *kyaninusv1.DeploymentVersion) (appsv1.DeploymentSpec, error) {
+	merged := *base.DeepCopy()
+
+	switch deploymentVersion.Spec.MergeStrategy {
+	case kyaninusv1.MergeStrategyMerge, "":
+		err := mergo.Merge(&merged, deploymentVersion.Spec.DeploymentSpec, mergo.WithOverride)
+		return merged, err
+
+	case kyaninusv1.MergeStrategyStrategic:
+		original, err := json.Marshal(merged)
+		if err != nil {
+			return merged, err
+		}
+		patch, err := strategicPatchFor(deploymentVersion.Spec.DeploymentSpec, deploymentVersion.Spec.RawDeploymentSpec)
+		if err != nil {
+			return merged, err
+		}
+		out, err := strategicpatch.StrategicMergePatch(original, patch, appsv1.DeploymentSpec{})
+		if err != nil {
+			return merged, err
+		}
+		return unmarshalDeploymentSpec(out)
+
+	case kyaninusv1.MergeStrategyJSONPatch:
+		original, err := json.Marshal(merged)
+		if err != nil {
+			return merged, err
+		}
+		out, err := applyJSONPatch(original, deploymentVersion.Spec.JSONPatch)
+		if err != nil {
+			return merged, err
+		}
+		return unmarshalDeploymentSpec(out)
+	}
+
+	return merged, fmt.Errorf("unknown merge strategy %q", deploymentVersion.Spec.MergeStrategy)
+}
+
+// hasShorthands reports whether the version sets images, env or replicas.
+func hasShorthands(deploymentVersion *kyaninusv1.DeploymentVersion) bool {
+	spec := deploymentVersion.Spec
+	return len(spec.Images) > 0 || len(spec.Env) > 0 || spec.Replicas != nil
+}
+
+// applyShorthands sets the images, env and replicas of a version on a merged
+// spec. Images name containers, or init containers, of the pod template; a
+// name matching neither is an error.
+func applyShorthands(spec *appsv1.DeploymentSpec, deploymentVersion *kyaninusv1.DeploymentVersion) error {
+	podSpec := &spec.Template.Spec
+	containers := append(containerPointers(podSpec.InitContainers), containerPointers(podSpec.Containers)...)
+
+	for name, image := range deploymentVersion.Spec.Images {
+		found := false
+		for _, container := range containers {
+			if container.Name == name {
+				container.Image = image
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("container %q not found in the pod template", name)
+		}
+	}
+
+	// Sort the variables so the generated spec is stable across reconciles.
+	names := make([]string, 0, len(deploymentVersion.Spec.Env))
+	for name := range deploymentVersion.Spec.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, container := range containerPointers(podSpec.Containers) {
+		for _, name := range names {
+			setEnv(container, corev1.EnvVar{Name: name, Value: deploymentVersion.Spec.Env[name]})
+		}
+	}
+
+	if deploymentVersion.Spec.Replicas != nil {
+		replicas := *deploymentVersion.Spec.Replicas
+		spec.Replicas = &replicas
+	}
+	return nil
+}
+
+// setEnv replaces the variable of the same name on a container, or appends it.
+func setEnv(container *corev1.Container, env corev1.EnvVar) {
+	for i := range container.Env {
+		if container.Env[i].Name == env.Name {
+			container.Env[i] = env
+			return
+		}
+	}
+	container.Env = append(container.Env, env)
+}
+
+// applyJSONPatch applies RFC 6902 operations to a JSON document.
+func applyJSONPatch(doc []byte, operations []kyaninusv1.JSONPatchOperation) ([]byte, error) {
+	ops, err := json.Marshal(operations)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(ops)
+	if err != nil {
+		return nil, err
+	}
+	return patch.Apply(doc)
+}
+
+// strategicPatchFor renders the overrides as a strategic merge patch. It is
+// built from the raw overrides when the version was decoded from JSON, as
+// marshalling the typed overrides drops the fields set to false, 0 or "".
+// Nulls left by unset fields are dropped, as a patch would read them as
+// deletions.
+func strategicPatchFor(overrides appsv1.DeploymentSpec, raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(overrides); err != nil {
+			return nil, err
+		}
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, err
+	}
+	return json.Marshal(dropNulls(patch))
+}
+
+func dropNulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if field == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = dropNulls(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = dropNulls(v[i])
+		}
+	}
+	return value
+}
+
+func unmarshalDeploymentSpec(data []byte) (appsv1.DeploymentSpec, error) {
+	var spec appsv1.DeploymentSpec
+	err := json.Unmarshal(data, &spec)
+	return spec, err
+}
@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func mergeBase() appsv1.DeploymentSpec {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1").Spec
+	base.Replicas = int32Ptr(3)
+	base.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}}
+	base.Template.Spec.Containers = append(base.Template.Spec.Containers, corev1.Container{Name: "sidecar", Image: "proxy:1"})
+	return base
+}
+
+func containerImages(spec appsv1.DeploymentSpec) map[string]string {
+	images := map[string]string{}
+	for _, c := range spec.Template.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+	return images
+}
+
+func TestMergeDeploymentSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy kyaninusv1.MergeStrategy
+		spec     appsv1.DeploymentSpec
+		patch    []kyaninusv1.JSONPatchOperation
+		// raw is the version spec as JSON, decoded instead of spec.
+		raw   string
+		base  func(base *appsv1.DeploymentSpec)
+		check func(t *testing.T, merged appsv1.DeploymentSpec)
+	}{
+		{
+			name:     "merge replaces the container list",
+			strategy: kyaninusv1.MergeStrategyMerge,
+			spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "myapp:2"}},
+			}}},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if images := containerImages(merged); len(images) != 1 || images["app"] != "myapp:2" {
+					t.Errorf("containers = %v, want only app=myapp:2", images)
+				}
+				if *merged.Replicas != 3 {
+					t.Errorf("replicas = %d, want the base 3", *merged.Replicas)
+				}
+			},
+		},
+		{
+			name: "merge is the default",
+			spec: appsv1.DeploymentSpec{Replicas: int32Ptr(0)},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if *merged.Replicas != 3 {
+					t.Errorf("replicas = %d, a zero value must not override the base", *merged.Replicas)
+				}
+			},
+		},
+		{
+			name:     "strategic merges containers by name",
+			strategy: kyaninusv1.MergeStrategyStrategic,
+			spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "myapp:2"}},
+			}}},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				images := containerImages(merged)
+				if len(images) != 2 || images["app"] != "myapp:2" || images["sidecar"] != "proxy:1" {
+					t.Errorf("containers = %v, want app=myapp:2 and the base sidecar", images)
+				}
+				if env := merged.Template.Spec.Containers[0].Env; len(env) != 1 || env[0].Value != "info" {
+					t.Errorf("env = %v, want the base env kept", env)
+				}
+				if merged.Selector == nil || merged.Selector.MatchLabels["app"] != "myapp" {
+					t.Errorf("selector = %v, want the base selector kept", merged.Selector)
+				}
+			},
+		},
+		{
+			name:     "strategic overrides zero replicas",
+			strategy: kyaninusv1.MergeStrategyStrategic,
+			spec:     appsv1.DeploymentSpec{Replicas: int32Ptr(0)},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if *merged.Replicas != 0 {
+					t.Errorf("replicas = %d, want 0", *merged.Replicas)
+				}
+				if len(merged.Template.Spec.Containers) != 2 {
+					t.Errorf("unset overrides must leave the base containers, got %v", containerImages(merged))
+				}
+			},
+		},
+		{
+			name: "strategic overrides false bools",
+			raw:  `{"mergeStrategy":"strategic","deploymentSpec":{"paused":false,"template":{"spec":{"hostNetwork":false}}}}`,
+			base: func(base *appsv1.DeploymentSpec) {
+				base.Paused = true
+				base.Template.Spec.HostNetwork = true
+			},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if merged.Paused || merged.Template.Spec.HostNetwork {
+					t.Errorf("paused = %t hostNetwork = %t, want both false", merged.Paused, merged.Template.Spec.HostNetwork)
+				}
+				if len(merged.Template.Spec.Containers) != 2 {
+					t.Errorf("unset overrides must leave the base containers, got %v", containerImages(merged))
+				}
+			},
+		},
+		{
+			name: "strategic overrides zero ints",
+			raw:  `{"mergeStrategy":"strategic","deploymentSpec":{"minReadySeconds":0}}`,
+			base: func(base *appsv1.DeploymentSpec) {
+				base.MinReadySeconds = 30
+			},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if merged.MinReadySeconds != 0 {
+					t.Errorf("minReadySeconds = %d, want 0", merged.MinReadySeconds)
+				}
+				if *merged.Replicas != 3 {
+					t.Errorf("replicas = %d, want the base 3", *merged.Replicas)
+				}
+			},
+		},
+		{
+			name:     "jsonpatch applies operations",
+			strategy: kyaninusv1.MergeStrategyJSONPatch,
+			spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "ignored", Image: "ignored"}},
+			}}},
+			patch: []kyaninusv1.JSONPatchOperation{
+				{Op: "replace", Path: "/replicas", Value: &apiextensionsv1.JSON{Raw: []byte("0")}},
+				{Op: "replace", Path: "/template/spec/containers/0/image", Value: &apiextensionsv1.JSON{Raw: []byte(`"myapp:2"`)}},
+				{Op: "remove", Path: "/template/spec/containers/1"},
+				{Op: "add", Path: "/paused", Value: &apiextensionsv1.JSON{Raw: []byte("true")}},
+			},
+			check: func(t *testing.T, merged appsv1.DeploymentSpec) {
+				if *merged.Replicas != 0 || !merged.Paused {
+					t.Errorf("replicas = %d paused = %t, want 0 and true", *merged.Replicas, merged.Paused)
+				}
+				if images := containerImages(merged); len(images) != 1 || images["app"] != "myapp:2" {
+					t.Errorf("containers = %v, want only app=myapp:2", images)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := &kyaninusv1.DeploymentVersion{Spec: kyaninusv1.DeploymentVersionSpec{
+				MergeStrategy:  tt.strategy,
+				DeploymentSpec: tt.spec,
+				JSONPatch:      tt.patch,
+			}}
+			if tt.raw != "" {
+				if err := json.Unmarshal([]byte(tt.raw), &version.Spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			base := mergeBase()
+			if tt.base != nil {
+				tt.base(&base)
+			}
+
+			merged, err := mergeDeploymentSpec(base, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, merged)
+
+			if containerImages(base)["app"] != "myapp:1" {
+				t.Errorf("the base spec must not be modified")
+			}
+		})
+	}
+}
+
+func TestMergeDeploymentSpecErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy kyaninusv1.MergeStrategy
+		patch    []kyaninusv1.JSONPatchOperation
+	}{
+		{name: "unknown strategy", strategy: "overlay"},
+		{
+			name:     "jsonpatch path missing",
+			strategy: kyaninusv1.MergeStrategyJSONPatch,
+			patch:    []kyaninusv1.JSONPatchOperation{{Op: "remove", Path: "/template/spec/containers/5"}},
+		},
+		{
+			name:     "jsonpatch test failing",
+			strategy: kyaninusv1.MergeStrategyJSONPatch,
+			patch:    []kyaninusv1.JSONPatchOperation{{Op: "test", Path: "/replicas", Value: &apiextensionsv1.JSON{Raw: []byte("7")}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := &kyaninusv1.DeploymentVersion{Spec: kyaninusv1.DeploymentVersionSpec{
+				MergeStrategy: tt.strategy,
+				JSONPatch:     tt.patch,
+			}}
+			if _, err := mergeDeploymentSpec(mergeBase(), version); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestApplyShorthands(t *testing.T) {
+	version := &kyaninusv1.DeploymentVersion{Spec: kyaninusv1.DeploymentVersionSpec{
+		Images:   map[string]string{"sidecar": "proxy:2"},
+		Env:      map[string]string{"LOG_LEVEL": "debug", "FEATURE": "on"},
+		Replicas: int32Ptr(1),
+	}}
+	spec := mergeBase()
+
+	if err := applyShorthands(&spec, version); err != nil {
+		t.Fatal(err)
+	}
+	if images := containerImages(spec); images["app"] != "myapp:1" || images["sidecar"] != "proxy:2" {
+		t.Errorf("containers = %v, want only the sidecar image replaced", images)
+	}
+	app := spec.Template.Spec.Containers[0]
+	want := []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}, {Name: "FEATURE", Value: "on"}}
+	if len(app.Env) != len(want) || app.Env[0] != want[0] || app.Env[1] != want[1] {
+		t.Errorf("app env = %v, want %v", app.Env, want)
+	}
+	if sidecar := spec.Template.Spec.Containers[1]; len(sidecar.Env) != 2 {
+		t.Errorf("sidecar env = %v, want the variables set on every container", sidecar.Env)
+	}
+	if *spec.Replicas != 1 {
+		t.Errorf("replicas = %d, want 1", *spec.Replicas)
+	}
+}
+
+func TestApplyShorthandsAfterMerge(t *testing.T) {
+	version := &kyaninusv1.DeploymentVersion{Spec: kyaninusv1.DeploymentVersionSpec{
+		DeploymentSpec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "myapp:2"}},
+		}}},
+		Images: map[string]string{"app": "myapp:3"},
+	}}
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+
+	_, view, err := mergeWorkload(toWorkload(t, base), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if images := containerImages(view.Spec); images["app"] != "myapp:3" {
+		t.Errorf("containers = %v, want the shorthand to win over the merged spec", images)
+	}
+}
+
+func TestApplyShorthandsUnknownContainer(t *testing.T) {
+	version := &kyaninusv1.DeploymentVersion{Spec: kyaninusv1.DeploymentVersionSpec{
+		Images: map[string]string{"worker": "worker:2"},
+	}}
+	spec := mergeBase()
+	if err := applyShorthands(&spec, version); err == nil {
+		t.Error("expected an error for a container missing from the pod template")
+	}
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// reconcilePromotion writes the merged spec of a version onto its base
+// workload when Spec.Promote is set and the current generation has not been
+// promoted yet. The base keeps its own selector and pod labels so that its
+// Service and ReplicaSets stay attached.
+func (r *DeploymentVersionReconciler) reconcilePromotion(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, baseWorkload *unstructured.Unstructured, generated *unstructured.Unstructured) error {
+	log := log.FromContext(ctx)
+
+	if !deploymentVersion.Spec.Promote || deploymentVersion.Status.PromotedGeneration == deploymentVersion.Generation {
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("%s %s %s %s", "Promoting version", deploymentVersion.Name, "onto base deployment", baseWorkload.GetName()))
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		promoted, err := promotedWorkload(deploymentVersion, baseWorkload, generated)
+		if err != nil {
+			return err
+		}
+		err = r.Update(ctx, promoted)
+		if apierrors.IsConflict(err) {
+			// The base changed meanwhile, e.g. it was scaled; promote onto
+			// its latest version.
+			latest := newWorkload(baseWorkload.GroupVersionKind())
+			if err := r.Get(ctx, client.ObjectKeyFromObject(baseWorkload), latest); err != nil {
+				return err
+			}
+			baseWorkload = latest
+		}
+		return err
+	})
+	if err != nil {
+		log.Error(err, "Error promoting version onto base deployment")
+		setCondition(deploymentVersion, kyaninusv1.ConditionPromoted, metav1.ConditionFalse, "PromotionFailed", err.Error())
+		r.event(deploymentVersion, corev1.EventTypeWarning, "PromotionFailed", "Unable to promote onto base %s %s: %v", baseWorkload.GetKind(), baseWorkload.GetName(), err)
+		return err
+	}
+
+	now := metav1.Now()
+	deploymentVersion.Status.PromotedGeneration = deploymentVersion.Generation
+	deploymentVersion.Status.PromotedAt = &now
+	setCondition(deploymentVersion, kyaninusv1.ConditionPromoted, metav1.ConditionTrue, "Promoted",
+		fmt.Sprintf("Promoted onto base %s %s/%s", baseWorkload.GetKind(), baseWorkload.GetNamespace(), baseWorkload.GetName()))
+	r.event(deploymentVersion, corev1.EventTypeNormal, "Promoted", "Promoted generation %d onto base %s %s/%s",
+		deploymentVersion.Generation, baseWorkload.GetKind(), baseWorkload.GetNamespace(), baseWorkload.GetName())
+
+	if deploymentVersion.Spec.DeleteOthersOnPromote {
+		return r.deleteOtherVersions(ctx, deploymentVersion)
+	}
+	return nil
+}
+
+// promotedWorkload is the base workload with the spec of the generated
+// workload, keeping the selector and pod labels of the base, the immutable
+// fields of a base StatefulSet, and the references of the base to its own
+// ConfigMaps and Secrets rather than the clones of the version.
+func promotedWorkload(deploymentVersion *kyaninusv1.DeploymentVersion, baseWorkload, generated *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	baseDeploy, err := workloadView(baseWorkload)
+	if err != nil {
+		return nil, err
+	}
+
+	promoted := baseWorkload.DeepCopy()
+	promoted.Object["spec"] = runtime.DeepCopyJSONValue(generated.Object["spec"])
+	view, err := workloadView(promoted)
+	if err != nil {
+		return nil, err
+	}
+	spec := view.Spec
+	spec.Selector = baseDeploy.Spec.Selector
+	spec.Template.Labels = baseDeploy.Spec.Template.Labels
+	// The clones are deleted with the version, the base keeps its own
+	// ConfigMaps and Secrets.
+	configMaps, secrets := baseResourceNames(deploymentVersion)
+	rewritePodReferences(&spec.Template.Spec, configMaps, secrets)
+	if sleep := deploymentVersion.Status.Sleep; sleep != nil && sleep.Asleep {
+		// A sleeping version is scaled to zero, the base keeps serving.
+		replicas := sleep.Replicas
+		spec.Replicas = &replicas
+	}
+	if err := setWorkloadSpec(promoted, spec); err != nil {
+		return nil, err
+	}
+	if promoted.GetKind() == "StatefulSet" {
+		// The API server refuses changes to these fields of a StatefulSet, and
+		// the serviceName of the clone names the Service of the version.
+		for _, field := range statefulSetImmutableFields {
+			if value, found, _ := unstructured.NestedFieldCopy(baseWorkload.Object, "spec", field); found {
+				if err := unstructured.SetNestedField(promoted.Object, value, "spec", field); err != nil {
+					return nil, err
+				}
+			} else {
+				unstructured.RemoveNestedField(promoted.Object, "spec", field)
+			}
+		}
+	}
+	return promoted, nil
+}
+
+// statefulSetImmutableFields are the spec fields of a StatefulSet, besides
+// its selector, that cannot change once it is created.
+var statefulSetImmutableFields = []string{"serviceName", "volumeClaimTemplates", "podManagementPolicy"}
+
+// deleteOtherVersions deletes every other DeploymentVersion of the same base
+// Deployment.
+func (r *DeploymentVersionReconciler) deleteOtherVersions(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) error {
+	log := log.FromContext(ctx)
+
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.List(ctx, &versions); err != nil {
+		return err
+	}
+
+	for i := range versions.Items {
+		other := &versions.Items[i]
+		if other.UID == deploymentVersion.UID ||
+			other.Spec.Name != deploymentVersion.Spec.Name ||
+			other.Spec.Namespace != deploymentVersion.Spec.Namespace {
+			continue
+		}
+
+		log.Info(fmt.Sprintf("%s %s/%s", "Deleting version superseded by promotion", other.Namespace, other.Name))
+		if err := r.Delete(ctx, other); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		r.event(other, corev1.EventTypeNormal, "Deleted", "Deleted, superseded by the promotion of %s", deploymentVersion.Name)
+		r.event(deploymentVersion, corev1.EventTypeNormal, "Deleted", "Deleted superseded version %s", other.Name)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := kyaninusv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func testDeployment(name string, labels map[string]string, image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp-v2"}, "myapp:2")
+
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2", Generation: 3},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name: "myapp", Namespace: "default", Promote: true, DeleteOthersOnPromote: true,
+		},
+	}
+	other := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v3", Namespace: "default", UID: "v3"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp", Namespace: "default"},
+	}
+	unrelated := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "otherapp-v1", Namespace: "default", UID: "o1"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "otherapp", Namespace: "default"},
+	}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, version, other, unrelated).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), base); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcilePromotion(ctx, version, toWorkload(t, base), toWorkload(t, clone)); err != nil {
+		t.Fatal(err)
+	}
+
+	var promoted appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &promoted); err != nil {
+		t.Fatal(err)
+	}
+	if image := promoted.Spec.Template.Spec.Containers[0].Image; image != "myapp:2" {
+		t.Errorf("base image = %s, want the promoted myapp:2", image)
+	}
+	if promoted.Spec.Selector.MatchLabels["app"] != "myapp" || promoted.Spec.Template.Labels["app"] != "myapp" {
+		t.Errorf("base selector and labels must be kept, got %v %v", promoted.Spec.Selector, promoted.Spec.Template.Labels)
+	}
+
+	if version.Status.PromotedGeneration != 3 || version.Status.PromotedAt == nil {
+		t.Errorf("promotion not recorded in status: %+v", version.Status)
+	}
+	if !meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionPromoted) {
+		t.Errorf("expected a Promoted condition")
+	}
+
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.List(ctx, &versions); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range versions.Items {
+		names = append(names, v.Name)
+	}
+	if len(names) != 2 || names[0] != "myapp-v2" || names[1] != "otherapp-v1" {
+		t.Errorf("expected only the other version of the same base to be deleted, left %v", names)
+	}
+}
+
+func TestPromotionRestoresBaseResources(t *testing.T) {
+	version := resourceVersion()
+	version.Spec.Promote = true
+	version.Generation = 1
+	scheme := newTestScheme(t)
+	base, newDeploy := resourceDeployments()
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(resourceBaseObjects(), base, version)...).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if err := r.reconcileResources(ctx, version, base, newDeploy); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), base); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcilePromotion(ctx, version, toWorkload(t, base), toWorkload(t, newDeploy)); err != nil {
+		t.Fatal(err)
+	}
+
+	var promoted appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &promoted); err != nil {
+		t.Fatal(err)
+	}
+	spec := promoted.Spec.Template.Spec
+	if image := spec.Containers[0].Image; image != "myapp:2" {
+		t.Errorf("base image = %s, want the promoted myapp:2", image)
+	}
+	if got := spec.Containers[0].EnvFrom[0].ConfigMapRef.Name; got != "myapp-config" {
+		t.Errorf("envFrom configMapRef = %s, want the base ConfigMap outliving the version", got)
+	}
+	if got := spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name; got != "myapp-secret" {
+		t.Errorf("env secretKeyRef = %s, want the base Secret outliving the version", got)
+	}
+	if got := spec.Volumes[0].ConfigMap.Name; got != "myapp-config" {
+		t.Errorf("volume configMap = %s, want the base ConfigMap outliving the version", got)
+	}
+}
+
+func TestPromotionKeepsStatefulSetImmutableFields(t *testing.T) {
+	base := testStatefulSet("db", map[string]string{"app": "db"}, "db:1")
+	base.Spec.PodManagementPolicy = appsv1.ParallelPodManagement
+	headless := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-headless", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone, Selector: map[string]string{"app": "db"}},
+	}
+	version := statefulSetVersion()
+	version.Spec.ServiceRef = &corev1.LocalObjectReference{Name: "db-headless"}
+	version.Spec.Promote = true
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, headless, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var promoted appsv1.StatefulSet
+	if err := r.Get(ctx, client.ObjectKeyFromObject(base), &promoted); err != nil {
+		t.Fatal(err)
+	}
+	if image := promoted.Spec.Template.Spec.Containers[0].Image; image != "db:2" {
+		t.Errorf("base image = %s, want the promoted db:2", image)
+	}
+	if promoted.Spec.ServiceName != "db-headless" {
+		t.Errorf("base serviceName = %s, want its own db-headless", promoted.Spec.ServiceName)
+	}
+	if promoted.Spec.PodManagementPolicy != appsv1.ParallelPodManagement || len(promoted.Spec.VolumeClaimTemplates) != 1 {
+		t.Errorf("base StatefulSet fields must be kept, got %+v", promoted.Spec)
+	}
+	if !meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionPromoted) {
+		t.Errorf("expected the version to be promoted, got %+v", version.Status.Conditions)
+	}
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+//+kubebuilder:rbac:groups="",resources=configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+
+// clonedResourceName is the name of the clone of a base object for a version.
+func clonedResourceName(baseName string, deploymentVersion *kyaninusv1.DeploymentVersion) string {
+	return fmt.Sprintf("%s-%s", baseName, deploymentVersion.Name)
+}
+
+// reconcileResources clones the Resources of the version next to it and
+// points the pod template of the generated Deployment at the cloned
+// ConfigMaps and Secrets. Clones of resources no longer listed are deleted.
+func (r *DeploymentVersionReconciler) reconcileResources(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, baseDeploy, newDeploy *appsv1.Deployment) error {
+	log := log.FromContext(ctx)
+	status := &deploymentVersion.Status
+
+	configMaps := map[string]string{}
+	secrets := map[string]string{}
+	var cloned []kyaninusv1.ClonedResource
+
+	for _, resource := range deploymentVersion.Spec.Resources {
+		clone, err := r.cloneResource(ctx, deploymentVersion, resource, baseDeploy, newDeploy)
+		if err != nil {
+			// Keep track of the clones made so far, so none are orphaned.
+			status.Resources = mergeClonedResources(status.Resources, cloned)
+			return fmt.Errorf("unable to clone %s %s: %w", resource.Kind, resource.Name, err)
+		}
+		cloned = append(cloned, kyaninusv1.ClonedResource{
+			APIVersion: clone.GetAPIVersion(),
+			Kind:       clone.GetKind(),
+			Name:       clone.GetName(),
+		})
+
+		gvk := clone.GroupVersionKind()
+		if gvk.Group != "" {
+			continue
+		}
+		switch gvk.Kind {
+		case "ConfigMap":
+			configMaps[resource.Name] = clone.GetName()
+		case "Secret":
+			secrets[resource.Name] = clone.GetName()
+		}
+	}
+
+	rewritePodReferences(&newDeploy.Spec.Template.Spec, configMaps, secrets)
+
+	for _, stale := range status.Resources {
+		if containsClonedResource(cloned, stale) {
+			continue
+		}
+		log.Info(fmt.Sprintf("%s %s %s", "Removing cloned resource", stale.Kind, stale.Name))
+		if err := r.deleteClonedResource(ctx, deploymentVersion, stale); err != nil {
+			status.Resources = mergeClonedResources(status.Resources, cloned)
+			return err
+		}
+	}
+	status.Resources = cloned
+	return nil
+}
+
+// cloneResource creates or updates the clone of a single base object.
+func (r *DeploymentVersionReconciler) cloneResource(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, resource kyaninusv1.VersionResource, baseDeploy, newDeploy *appsv1.Deployment) (*unstructured.Unstructured, error) {
+	log := log.FromContext(ctx)
+
+	if gvk := schema.FromAPIVersionAndKind(resource.APIVersion, resource.Kind); gvk.Group == "" && gvk.Kind == "Secret" &&
+		deploymentVersion.Spec.Namespace != deploymentVersion.Namespace {
+		// Whoever may create a version must not read the Secrets of other
+		// namespaces through the controller.
+		return nil, fmt.Errorf("secret %s of namespace %s cannot be cloned into namespace %s",
+			resource.Name, deploymentVersion.Spec.Namespace, deploymentVersion.Namespace)
+	}
+
+	base := &unstructured.Unstructured{}
+	base.SetAPIVersion(resource.APIVersion)
+	base.SetKind(resource.Kind)
+	if err := r.Get(ctx, types.NamespacedName{Namespace: deploymentVersion.Spec.Namespace, Name: resource.Name}, base); err != nil {
+		return nil, err
+	}
+
+	clone, err := newClonedResource(base, resource, deploymentVersion, baseDeploy, newDeploy)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctrl.SetControllerReference(deploymentVersion, clone, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(clone.GroupVersionKind())
+	err = r.Get(ctx, client.ObjectKeyFromObject(clone), existing)
+	if apierrors.IsNotFound(err) {
+		log.Info(fmt.Sprintf("%s %s %s", "Cloning resource", clone.GetKind(), clone.GetName()))
+		return clone, r.Create(ctx, clone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !metav1.IsControlledBy(existing, deploymentVersion) {
+		return nil, fmt.Errorf("%s %s already exists and is not owned by DeploymentVersion %s",
+			clone.GetKind(), clone.GetName(), deploymentVersion.Name)
+	}
+	clone.SetResourceVersion(existing.GetResourceVersion())
+	return clone, r.Update(ctx, clone)
+}
+
+// newClonedResource copies a base object under the name of its clone,
+// retargets the HorizontalPodAutoscalers and PodDisruptionBudgets of the base
+// workload at the generated one, and applies the overrides of the version.
+func newClonedResource(base *unstructured.Unstructured, resource kyaninusv1.VersionResource, deploymentVersion *kyaninusv1.DeploymentVersion, baseDeploy, newDeploy *appsv1.Deployment) (*unstructured.Unstructured, error) {
+	clone := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	for key, value := range base.Object {
+		if key == "metadata" || key == "status" {
+			continue
+		}
+		clone.Object[key] = runtime.DeepCopyJSONValue(value)
+	}
+	clone.SetLabels(base.GetLabels())
+	clone.SetAnnotations(cloneAnnotations(base.GetAnnotations()))
+
+	gvk := base.GroupVersionKind()
+	switch {
+	case gvk.Group == "autoscaling" && gvk.Kind == "HorizontalPodAutoscaler":
+		kind, _, _ := unstructured.NestedString(clone.Object, "spec", "scaleTargetRef", "kind")
+		name, _, _ := unstructured.NestedString(clone.Object, "spec", "scaleTargetRef", "name")
+		if kind == deploymentVersion.WorkloadGroupVersionKind().Kind && name == baseDeploy.Name {
+			if err := unstructured.SetNestedField(clone.Object, newDeploy.Name, "spec", "scaleTargetRef", "name"); err != nil {
+				return nil, err
+			}
+		}
+	case gvk.Group == "policy" && gvk.Kind == "PodDisruptionBudget" && newDeploy.Spec.Selector != nil:
+		selector, err := runtime.DefaultUnstructuredConverter.ToUnstructured(newDeploy.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if err := unstructured.SetNestedMap(clone.Object, selector, "spec", "selector"); err != nil {
+			return nil, err
+		}
+	}
+
+	if resource.Patch != nil || len(resource.JSONPatch) > 0 {
+		doc, err := json.Marshal(clone.Object)
+		if err != nil {
+			return nil, err
+		}
+		if resource.Patch != nil {
+			if doc, err = jsonpatch.MergePatch(doc, resource.Patch.Raw); err != nil {
+				return nil, err
+			}
+		}
+		if len(resource.JSONPatch) > 0 {
+			if doc, err = applyJSONPatch(doc, resource.JSONPatch); err != nil {
+				return nil, err
+			}
+		}
+		clone.Object = map[string]interface{}{}
+		if err := utiljson.Unmarshal(doc, &clone.Object); err != nil {
+			return nil, err
+		}
+	}
+
+	// Patches may not move the clone away from the version.
+	clone.SetGroupVersionKind(gvk)
+	clone.SetName(clonedResourceName(base.GetName(), deploymentVersion))
+	clone.SetNamespace(deploymentVersion.Namespace)
+	return clone, nil
+}
+
+// deleteClonedResource deletes a clone made for the version, if it still
+// controls it.
+func (r *DeploymentVersionReconciler) deleteClonedResource(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, resource kyaninusv1.ClonedResource) error {
+	clone := &unstructured.Unstructured{}
+	clone.SetGroupVersionKind(schema.FromAPIVersionAndKind(resource.APIVersion, resource.Kind))
+	if err := r.Get(ctx, types.NamespacedName{Namespace: deploymentVersion.Namespace, Name: resource.Name}, clone); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(clone, deploymentVersion) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, clone))
+}
+
+// baseResourceNames maps the names of the ConfigMaps and Secrets cloned for a
+// version back to the base objects they were cloned from.
+func baseResourceNames(deploymentVersion *kyaninusv1.DeploymentVersion) (configMaps, secrets map[string]string) {
+	configMaps = map[string]string{}
+	secrets = map[string]string{}
+	for _, resource := range deploymentVersion.Spec.Resources {
+		gvk := schema.FromAPIVersionAndKind(resource.APIVersion, resource.Kind)
+		if gvk.Group != "" {
+			continue
+		}
+		switch gvk.Kind {
+		case "ConfigMap":
+			configMaps[clonedResourceName(resource.Name, deploymentVersion)] = resource.Name
+		case "Secret":
+			secrets[clonedResourceName(resource.Name, deploymentVersion)] = resource.Name
+		}
+	}
+	return configMaps, secrets
+}
+
+// rewritePodReferences points the ConfigMap and Secret references of a pod
+// spec at their clones.
+func rewritePodReferences(spec *corev1.PodSpec, configMaps, secrets map[string]string) {
+	rename := func(names map[string]string, name *string) {
+		if renamed, ok := names[*name]; ok {
+			*name = renamed
+		}
+	}
+
+	for i := range spec.Volumes {
+		source := &spec.Volumes[i].VolumeSource
+		if source.ConfigMap != nil {
+			rename(configMaps, &source.ConfigMap.Name)
+		}
+		if source.Secret != nil {
+			rename(secrets, &source.Secret.SecretName)
+		}
+		if source.Projected != nil {
+			for j := range source.Projected.Sources {
+				projection := &source.Projected.Sources[j]
+				if projection.ConfigMap != nil {
+					rename(configMaps, &projection.ConfigMap.Name)
+				}
+				if projection.Secret != nil {
+					rename(secrets, &projection.Secret.Name)
+				}
+			}
+		}
+	}
+
+	containers := append([]*corev1.Container{}, containerPointers(spec.InitContainers)...)
+	containers = append(containers, containerPointers(spec.Containers)...)
+	for _, container := range containers {
+		for i := range container.EnvFrom {
+			envFrom := &container.EnvFrom[i]
+			if envFrom.ConfigMapRef != nil {
+				rename(configMaps, &envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				rename(secrets, &envFrom.SecretRef.Name)
+			}
+		}
+		for i := range container.Env {
+			valueFrom := container.Env[i].ValueFrom
+			if valueFrom == nil {
+				continue
+			}
+			if valueFrom.ConfigMapKeyRef != nil {
+				rename(configMaps, &valueFrom.ConfigMapKeyRef.Name)
+			}
+			if valueFrom.SecretKeyRef != nil {
+				rename(secrets, &valueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+
+	for i := range spec.ImagePullSecrets {
+		rename(secrets, &spec.ImagePullSecrets[i].Name)
+	}
+}
+
+func containerPointers(containers []corev1.Container) []*corev1.Container {
+	pointers := make([]*corev1.Container, len(containers))
+	for i := range containers {
+		pointers[i] = &containers[i]
+	}
+	return pointers
+}
+
+func containsClonedResource(resources []kyaninusv1.ClonedResource, resource kyaninusv1.ClonedResource) bool {
+	for _, r := range resources {
+		if r == resource {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeClonedResources(a, b []kyaninusv1.ClonedResource) []kyaninusv1.ClonedResource {
+	merged := append([]kyaninusv1.ClonedResource{}, a...)
+	for _, resource := range b {
+		if !containsClonedResource(merged, resource) {
+			merged = append(merged, resource)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func resourceVersion() *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2"},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:      "myapp",
+			Namespace: "default",
+			Resources: []kyaninusv1.VersionResource{
+				{
+					APIVersion: "v1", Kind: "ConfigMap", Name: "myapp-config",
+					Patch: &apiextensionsv1.JSON{Raw: []byte(`{"data":{"FEATURE":"on"}}`)},
+				},
+				{APIVersion: "v1", Kind: "Secret", Name: "myapp-secret"},
+				{APIVersion: "autoscaling/v2beta2", Kind: "HorizontalPodAutoscaler", Name: "myapp"},
+				{APIVersion: "policy/v1", Kind: "PodDisruptionBudget", Name: "myapp"},
+			},
+		},
+	}
+}
+
+func resourceBaseObjects() []client.Object {
+	return []client.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "myapp-config", Namespace: "default", Labels: map[string]string{"app": "myapp"}},
+			Data:       map[string]string{"FEATURE": "off", "LEVEL": "info"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "myapp-secret", Namespace: "default"},
+			Data:       map[string][]byte{"token": []byte("s3cret")},
+		},
+		&autoscalingv2beta2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default"},
+			Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "myapp"},
+				MaxReplicas:    5,
+			},
+		},
+		&policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default"},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "myapp"}},
+			},
+			Status: policyv1.PodDisruptionBudgetStatus{DesiredHealthy: 1},
+		},
+	}
+}
+
+func resourceDeployments() (*appsv1.Deployment, *appsv1.Deployment) {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	clone := testDeployment("myapp-v2", map[string]string{"app": "myapp", kyaninusv1.VersionLabel: "myapp-v2"}, "myapp:2")
+	spec := &clone.Spec.Template.Spec
+	spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "myapp-config"}}},
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "shared-config"}}},
+	}
+	spec.Containers[0].Env = []corev1.EnvVar{{
+		Name: "TOKEN",
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "myapp-secret"}, Key: "token",
+		}},
+	}}
+	spec.Volumes = []corev1.Volume{{
+		Name: "config",
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "myapp-config"},
+		}},
+	}}
+	return base, clone
+}
+
+func TestReconcileResourcesClonesAndRewrites(t *testing.T) {
+	version := resourceVersion()
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(resourceBaseObjects(), version)...).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+	base, newDeploy := resourceDeployments()
+
+	if err := r.reconcileResources(ctx, version, base, newDeploy); err != nil {
+		t.Fatal(err)
+	}
+
+	var configMap corev1.ConfigMap
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-config-myapp-v2"}, &configMap); err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data["FEATURE"] != "on" || configMap.Data["LEVEL"] != "info" {
+		t.Errorf("cloned ConfigMap data %v, want the base with the patch applied", configMap.Data)
+	}
+	if !metav1.IsControlledBy(&configMap, version) {
+		t.Error("expected the cloned ConfigMap to be owned by the version")
+	}
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-secret-myapp-v2"}, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["token"]) != "s3cret" {
+		t.Errorf("cloned Secret data %v", secret.Data)
+	}
+
+	var hpa autoscalingv2beta2.HorizontalPodAutoscaler
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-myapp-v2"}, &hpa); err != nil {
+		t.Fatal(err)
+	}
+	if hpa.Spec.ScaleTargetRef.Name != "myapp-v2" || hpa.Spec.MaxReplicas != 5 {
+		t.Errorf("cloned HPA spec %+v, want it to scale the generated Deployment", hpa.Spec)
+	}
+
+	var pdb policyv1.PodDisruptionBudget
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-myapp-v2"}, &pdb); err != nil {
+		t.Fatal(err)
+	}
+	if pdb.Spec.Selector.MatchLabels[kyaninusv1.VersionLabel] != "myapp-v2" {
+		t.Errorf("cloned PDB selector %v, want the generated Deployment's", pdb.Spec.Selector)
+	}
+	if pdb.Status.DesiredHealthy != 0 {
+		t.Error("the status of the base must not be cloned")
+	}
+
+	container := newDeploy.Spec.Template.Spec.Containers[0]
+	if got := container.EnvFrom[0].ConfigMapRef.Name; got != "myapp-config-myapp-v2" {
+		t.Errorf("envFrom configMapRef = %s, want the clone", got)
+	}
+	if got := container.EnvFrom[1].ConfigMapRef.Name; got != "shared-config" {
+		t.Errorf("envFrom configMapRef = %s, want uncloned ConfigMaps left alone", got)
+	}
+	if got := container.Env[0].ValueFrom.SecretKeyRef.Name; got != "myapp-secret-myapp-v2" {
+		t.Errorf("env secretKeyRef = %s, want the clone", got)
+	}
+	if got := newDeploy.Spec.Template.Spec.Volumes[0].ConfigMap.Name; got != "myapp-config-myapp-v2" {
+		t.Errorf("volume configMap = %s, want the clone", got)
+	}
+	if len(version.Status.Resources) != 4 {
+		t.Errorf("status resources %v, want the 4 clones", version.Status.Resources)
+	}
+}
+
+func TestReconcileResourcesRemovesStaleClones(t *testing.T) {
+	version := resourceVersion()
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(resourceBaseObjects(), version)...).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+	base, newDeploy := resourceDeployments()
+
+	if err := r.reconcileResources(ctx, version, base, newDeploy); err != nil {
+		t.Fatal(err)
+	}
+
+	version.Spec.Resources = version.Spec.Resources[:1]
+	_, newDeploy = resourceDeployments()
+	if err := r.reconcileResources(ctx, version, base, newDeploy); err != nil {
+		t.Fatal(err)
+	}
+
+	var secret corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-secret-myapp-v2"}, &secret)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the clone of a removed resource to be deleted, got %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-secret"}, &secret); err != nil {
+		t.Errorf("expected the base Secret to be kept, got %v", err)
+	}
+	if len(version.Status.Resources) != 1 {
+		t.Errorf("status resources %v, want only the ConfigMap clone", version.Status.Resources)
+	}
+	if got := newDeploy.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name; got != "myapp-secret" {
+		t.Errorf("env secretKeyRef = %s, want the base Secret once it is no longer cloned", got)
+	}
+}
+
+func TestReconcileResourcesSkipsUnownedClone(t *testing.T) {
+	version := resourceVersion()
+	version.Spec.Resources = version.Spec.Resources[:1]
+	unowned := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "myapp-config-myapp-v2", Namespace: "default"}}
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(resourceBaseObjects(), version, unowned)...).Build(),
+		Scheme: scheme,
+	}
+	base, newDeploy := resourceDeployments()
+
+	if err := r.reconcileResources(context.Background(), version, base, newDeploy); err == nil {
+		t.Fatal("expected an error for a clone name taken by an unowned ConfigMap")
+	}
+	if got := newDeploy.Spec.Template.Spec.Volumes[0].ConfigMap.Name; got != "myapp-config" {
+		t.Errorf("volume configMap = %s, want it left alone", got)
+	}
+}
+
+func TestReconcileResourcesRefusesCrossNamespaceSecret(t *testing.T) {
+	version := resourceVersion()
+	version.Spec.Namespace = "payments"
+	version.Spec.Resources = []kyaninusv1.VersionResource{{APIVersion: "v1", Kind: "Secret", Name: "payments-key"}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments-key", Namespace: "payments"},
+		Data:       map[string][]byte{"key": []byte("s3cret")},
+	}
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, version).Build(),
+		Scheme: scheme,
+	}
+	base, newDeploy := resourceDeployments()
+
+	if err := r.reconcileResources(context.Background(), version, base, newDeploy); err == nil {
+		t.Fatal("expected an error cloning a Secret of another namespace")
+	}
+	var cloned corev1.Secret
+	err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "payments-key-myapp-v2"}, &cloned)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the Secret not to be copied, got %v", err)
+	}
+}
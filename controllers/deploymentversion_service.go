@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imdario/mergo"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileService clones the base Service named by Spec.ServiceRef under the
+// version's name and points its selector at the pods of the generated
+// Deployment. When no ServiceRef is set, a previously cloned Service is removed.
+func (r *DeploymentVersionReconciler) reconcileService(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, deploy *appsv1.Deployment) error {
+	log := log.FromContext(ctx)
+
+	serviceName := types.NamespacedName{Namespace: deploymentVersion.Namespace, Name: deploymentVersion.Name}
+
+	var existingService corev1.Service
+	haveService := true
+	if err := r.Get(ctx, serviceName, &existingService); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		haveService = false
+	}
+
+	if deploymentVersion.Spec.ServiceRef == nil {
+		deploymentVersion.Status.ServiceName = ""
+		if haveService && metav1.IsControlledBy(&existingService, deploymentVersion) {
+			log.Info(fmt.Sprintf("%s %s", "Removing service for version", serviceName.Name))
+			return client.IgnoreNotFound(r.Delete(ctx, &existingService))
+		}
+		return nil
+	}
+
+	if haveService && !metav1.IsControlledBy(&existingService, deploymentVersion) {
+		return fmt.Errorf("service %s already exists and is not owned by DeploymentVersion %s", serviceName, deploymentVersion.Name)
+	}
+
+	baseService := &corev1.Service{}
+	baseServiceName := types.NamespacedName{Namespace: deploymentVersion.Spec.Namespace, Name: deploymentVersion.Spec.ServiceRef.Name}
+	if err := r.Get(ctx, baseServiceName, baseService); err != nil {
+		log.Error(err, "Unable to fetch base Service")
+		return err
+	}
+
+	newService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        serviceName.Name,
+			Namespace:   serviceName.Namespace,
+			Labels:      baseService.Labels,
+			Annotations: baseService.Annotations,
+		},
+		Spec: *baseService.Spec.DeepCopy(),
+	}
+
+	// Cluster assigned addresses and ports belong to the base Service. A
+	// headless base stays headless, so that StatefulSet pods keep their DNS
+	// records.
+	if newService.Spec.ClusterIP != corev1.ClusterIPNone {
+		newService.Spec.ClusterIP = ""
+		newService.Spec.ClusterIPs = nil
+	}
+	newService.Spec.HealthCheckNodePort = 0
+	for i := range newService.Spec.Ports {
+		newService.Spec.Ports[i].NodePort = 0
+	}
+
+	if deploymentVersion.Spec.ServiceOverrides != nil {
+		if err := mergo.Merge(&newService.Spec, *deploymentVersion.Spec.ServiceOverrides, mergo.WithOverride); err != nil {
+			log.Error(err, "Error merging service configuration")
+			return err
+		}
+	}
+
+	newService.Spec.Selector = versionPodLabels(deploy)
+
+	if err := ctrl.SetControllerReference(deploymentVersion, newService, r.Scheme); err != nil {
+		return err
+	}
+
+	if haveService {
+		// The API server refuses changes to an allocated cluster IP.
+		newService.ResourceVersion = existingService.ResourceVersion
+		newService.Spec.ClusterIP = existingService.Spec.ClusterIP
+		newService.Spec.ClusterIPs = existingService.Spec.ClusterIPs
+		if err := r.Update(ctx, newService); err != nil {
+			log.Error(err, "Error updating existing service")
+			return err
+		}
+	} else {
+		if err := r.Create(ctx, newService); err != nil {
+			log.Error(err, "Error creating new service")
+			return err
+		}
+	}
+
+	deploymentVersion.Status.ServiceName = newService.Name
+	return nil
+}
+
+// versionPodLabels returns the labels identifying the pods of a generated
+// Deployment.
+func versionPodLabels(deploy *appsv1.Deployment) map[string]string {
+	labels := map[string]string{}
+	for k, v := range deploy.Spec.Template.Labels {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func TestReconcileServiceClusterIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		clusterIP string
+		want      string
+	}{
+		{name: "allocated address is released", clusterIP: "10.0.0.12", want: ""},
+		{name: "headless base stays headless", clusterIP: corev1.ClusterIPNone, want: corev1.ClusterIPNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					ClusterIP:  tt.clusterIP,
+					ClusterIPs: []string{tt.clusterIP},
+					Selector:   map[string]string{"app": "myapp"},
+					Ports:      []corev1.ServicePort{{Name: "http", Port: 80}},
+				},
+			}
+			version := eventVersion()
+			version.Spec.ServiceRef = &corev1.LocalObjectReference{Name: "myapp"}
+			deploy := testDeployment("myapp-v2", map[string]string{"app": "myapp", kyaninusv1.VersionLabel: "myapp-v2"}, "myapp:2")
+
+			r, _ := newEventReconciler(t, base, version)
+			ctx := context.Background()
+			if err := r.reconcileService(ctx, version, deploy); err != nil {
+				t.Fatal(err)
+			}
+
+			var clone corev1.Service
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-v2"}, &clone); err != nil {
+				t.Fatal(err)
+			}
+			if clone.Spec.ClusterIP != tt.want {
+				t.Errorf("clusterIP = %q, want %q", clone.Spec.ClusterIP, tt.want)
+			}
+			if clone.Spec.Selector[kyaninusv1.VersionLabel] != "myapp-v2" {
+				t.Errorf("selector = %v, want the version pods", clone.Spec.Selector)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// reconcileSleep puts an idle version to sleep, or wakes it once it is active
+// again, and scales the generated Deployment to zero while it sleeps. The
+// activator wakes a version by clearing Status.Sleep.Asleep itself. Unless
+// idleKnown, the activity of the version could not be queried and it is kept
+// awake until the next activity interval.
+func (r *DeploymentVersionReconciler) reconcileSleep(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion, newDeploy *appsv1.Deployment, now time.Time, idleKnown bool) ctrl.Result {
+	log := log.FromContext(ctx)
+	status := &deploymentVersion.Status
+	policy := deploymentVersion.Spec.Sleep
+
+	if policy == nil {
+		status.Sleep = nil
+		return ctrl.Result{}
+	}
+	if status.Sleep == nil {
+		status.Sleep = &kyaninusv1.SleepStatus{Since: &metav1.Time{Time: now}}
+	}
+	sleep := status.Sleep
+
+	lastActivity := sleep.Since.Time
+	if status.LastActivityTime != nil && status.LastActivityTime.After(lastActivity) {
+		lastActivity = status.LastActivityTime.Time
+	}
+
+	if sleep.Asleep && lastActivity.After(sleep.Since.Time) {
+		log.Info(fmt.Sprintf("%s %s", "Waking version", deploymentVersion.Name))
+		sleep.Asleep = false
+		sleep.Since = &metav1.Time{Time: now}
+		lastActivity = now
+	}
+
+	if !sleep.Asleep && !idleKnown {
+		return ctrl.Result{RequeueAfter: activityInterval}
+	}
+	if !sleep.Asleep && now.Sub(lastActivity) >= policy.AfterIdle.Duration {
+		log.Info(fmt.Sprintf("%s %s", "Putting idle version to sleep", deploymentVersion.Name))
+		sleep.Asleep = true
+		sleep.Since = &metav1.Time{Time: now}
+		sleep.Replicas = 1
+		if newDeploy.Spec.Replicas != nil {
+			sleep.Replicas = *newDeploy.Spec.Replicas
+		}
+	}
+
+	if sleep.Asleep {
+		zero := int32(0)
+		newDeploy.Spec.Replicas = &zero
+		return ctrl.Result{}
+	}
+
+	requeueAfter := lastActivity.Add(policy.AfterIdle.Duration).Sub(now)
+	if r.PrometheusURL != "" && requeueAfter > activityInterval {
+		requeueAfter = activityInterval
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}
+}
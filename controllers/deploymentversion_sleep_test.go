@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func TestSleepAfterIdle(t *testing.T) {
+	created := time.Now().Truncate(time.Second)
+	version := expiringVersion(created)
+	version.Spec.Sleep = &kyaninusv1.SleepPolicy{AfterIdle: metav1.Duration{Duration: 30 * time.Minute}}
+	r := &DeploymentVersionReconciler{}
+	ctx := context.Background()
+
+	r.recordActivity(ctx, version, created)
+	deploy := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(3)}}
+	r.reconcileSleep(ctx, version, deploy, created, true)
+	result := r.reconcileSleep(ctx, version, deploy, created.Add(10*time.Minute), true)
+	if version.Status.Sleep == nil || version.Status.Sleep.Asleep {
+		t.Fatalf("expected the version to be awake, status %+v", version.Status.Sleep)
+	}
+	if *deploy.Spec.Replicas != 3 {
+		t.Errorf("an awake version keeps its replicas, got %d", *deploy.Spec.Replicas)
+	}
+	if result.RequeueAfter != 20*time.Minute {
+		t.Errorf("requeue after %v, want 20m", result.RequeueAfter)
+	}
+
+	deploy = &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(3)}}
+	r.reconcileSleep(ctx, version, deploy, created.Add(30*time.Minute), true)
+	if !version.Status.Sleep.Asleep {
+		t.Fatal("expected the idle version to sleep")
+	}
+	if version.Status.Sleep.Replicas != 3 {
+		t.Errorf("sleep replicas = %d, want 3", version.Status.Sleep.Replicas)
+	}
+	if *deploy.Spec.Replicas != 0 {
+		t.Errorf("a sleeping version is scaled to zero, got %d", *deploy.Spec.Replicas)
+	}
+}
+
+func TestSleepWakesOnActivity(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	version := expiringVersion(now.Add(-time.Hour))
+	version.Spec.Sleep = &kyaninusv1.SleepPolicy{AfterIdle: metav1.Duration{Duration: 30 * time.Minute}}
+	version.Status.LastActivityTime = &metav1.Time{Time: now.Add(-time.Hour)}
+	version.Status.Sleep = &kyaninusv1.SleepStatus{
+		Asleep:   true,
+		Since:    &metav1.Time{Time: now.Add(-20 * time.Minute)},
+		Replicas: 2,
+	}
+	r := &DeploymentVersionReconciler{}
+	ctx := context.Background()
+
+	deploy := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(2)}}
+	r.reconcileSleep(ctx, version, deploy, now, true)
+	if !version.Status.Sleep.Asleep || *deploy.Spec.Replicas != 0 {
+		t.Fatalf("expected the version to stay asleep, status %+v replicas %d", version.Status.Sleep, *deploy.Spec.Replicas)
+	}
+
+	version.Status.LastActivityTime = &metav1.Time{Time: now.Add(-time.Minute)}
+	deploy = &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(2)}}
+	r.reconcileSleep(ctx, version, deploy, now, true)
+	if version.Status.Sleep.Asleep {
+		t.Fatal("expected activity to wake the version")
+	}
+	if *deploy.Spec.Replicas != 2 {
+		t.Errorf("an awake version keeps its replicas, got %d", *deploy.Spec.Replicas)
+	}
+}
+
+func TestSleepDisabled(t *testing.T) {
+	version := expiringVersion(time.Now())
+	version.Status.Sleep = &kyaninusv1.SleepStatus{Asleep: true}
+	r := &DeploymentVersionReconciler{}
+
+	deploy := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(2)}}
+	result := r.reconcileSleep(context.Background(), version, deploy, time.Now(), true)
+	if version.Status.Sleep != nil {
+		t.Errorf("expected the sleep status to be cleared, got %+v", version.Status.Sleep)
+	}
+	if *deploy.Spec.Replicas != 2 || result.RequeueAfter != 0 {
+		t.Errorf("replicas %d requeue %v", *deploy.Spec.Replicas, result.RequeueAfter)
+	}
+}
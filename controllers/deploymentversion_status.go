@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// setCondition records a condition on the DeploymentVersion, stamped with the
+// generation it was computed from.
+func setCondition(deploymentVersion *kyaninusv1.DeploymentVersion, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&deploymentVersion.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: deploymentVersion.Generation,
+	})
+}
+
+// mirrorDeploymentStatus copies the replica counts and rollout state of the
+// generated Deployment onto the DeploymentVersion status.
+func mirrorDeploymentStatus(deploymentVersion *kyaninusv1.DeploymentVersion, deploy *appsv1.Deployment) {
+	status := &deploymentVersion.Status
+	status.DeploymentName = deploy.Name
+	status.DeploymentUID = deploy.UID
+	status.Replicas = deploy.Status.Replicas
+	status.ReadyReplicas = deploy.Status.ReadyReplicas
+	status.AvailableReplicas = deploy.Status.AvailableReplicas
+
+	desired := int32(1)
+	if deploy.Spec.Replicas != nil {
+		desired = *deploy.Spec.Replicas
+	}
+
+	rolledOut := deploy.Status.ObservedGeneration >= deploy.Generation &&
+		deploy.Status.UpdatedReplicas >= desired &&
+		deploy.Status.AvailableReplicas >= desired
+	if rolledOut {
+		setCondition(deploymentVersion, kyaninusv1.ConditionProgressing, metav1.ConditionFalse, "RolloutComplete",
+			fmt.Sprintf("Deployment %s has %d/%d replicas available", deploy.Name, deploy.Status.AvailableReplicas, desired))
+	} else {
+		setCondition(deploymentVersion, kyaninusv1.ConditionProgressing, metav1.ConditionTrue, "RollingOut",
+			fmt.Sprintf("Deployment %s has %d/%d replicas available", deploy.Name, deploy.Status.AvailableReplicas, desired))
+	}
+
+	for _, cond := range deploy.Status.Conditions {
+		failed := (cond.Type == appsv1.DeploymentReplicaFailure && cond.Status == corev1.ConditionTrue) ||
+			(cond.Type == appsv1.DeploymentProgressing && cond.Status == corev1.ConditionFalse)
+		if failed {
+			setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionTrue, cond.Reason, cond.Message)
+			return
+		}
+	}
+	setCondition(deploymentVersion, kyaninusv1.ConditionDegraded, metav1.ConditionFalse, "Reconciled", "")
+}
+
+// summarizeReady derives the Ready condition from the other conditions.
+func summarizeReady(deploymentVersion *kyaninusv1.DeploymentVersion) {
+	conditions := deploymentVersion.Status.Conditions
+
+	for _, conditionType := range []string{kyaninusv1.ConditionBaseFound, kyaninusv1.ConditionMerged, kyaninusv1.ConditionIsolated} {
+		if cond := meta.FindStatusCondition(conditions, conditionType); cond != nil && cond.Status != metav1.ConditionTrue {
+			setCondition(deploymentVersion, kyaninusv1.ConditionReady, metav1.ConditionFalse, cond.Reason, cond.Message)
+			return
+		}
+	}
+	if cond := meta.FindStatusCondition(conditions, kyaninusv1.ConditionDegraded); cond != nil && cond.Status == metav1.ConditionTrue {
+		setCondition(deploymentVersion, kyaninusv1.ConditionReady, metav1.ConditionFalse, cond.Reason, cond.Message)
+		return
+	}
+	if cond := meta.FindStatusCondition(conditions, kyaninusv1.ConditionProgressing); cond == nil || cond.Status != metav1.ConditionFalse {
+		setCondition(deploymentVersion, kyaninusv1.ConditionReady, metav1.ConditionFalse, "RollingOut", "Waiting for the generated Deployment to become available")
+		return
+	}
+	setCondition(deploymentVersion, kyaninusv1.ConditionReady, metav1.ConditionTrue, "Available", "")
+}
+
+// updateStatus writes the DeploymentVersion status through the status
+// subresource. A conflict is returned as is: the status was written meanwhile,
+// e.g. by the activator waking the version, and must be reconciled again
+// rather than overwritten.
+func (r *DeploymentVersionReconciler) updateStatus(ctx context.Context, deploymentVersion *kyaninusv1.DeploymentVersion) error {
+	deploymentVersion.Status.ObservedGeneration = deploymentVersion.Generation
+	summarizeReady(deploymentVersion)
+
+	return r.Status().Update(ctx, deploymentVersion)
+}
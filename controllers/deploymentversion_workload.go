@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"encoding/json"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=argoproj.io,resources=rollouts,verbs=get;list;watch;create;update;patch;delete
+
+// rolloutGroupVersionKind is the kind of Argo Rollouts.
+var rolloutGroupVersionKind = schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+
+// newWorkload returns an empty workload of the given kind.
+func newWorkload(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	workload := &unstructured.Unstructured{}
+	workload.SetGroupVersionKind(gvk)
+	return workload
+}
+
+func isDeployment(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == appsv1.GroupName && gvk.Kind == "Deployment"
+}
+
+// workloadView presents a workload as a Deployment, so that merging,
+// isolation and sleeping work the same for every kind. Deployments convert in
+// full. Other workloads carry the metadata, the replicas, selector, template,
+// minReadySeconds and revisionHistoryLimit they share with Deployments, and
+// the replica counts of their status.
+func workloadView(workload *unstructured.Unstructured) (*appsv1.Deployment, error) {
+	view := &appsv1.Deployment{}
+	if isDeployment(workload.GroupVersionKind()) {
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(workload.Object, view)
+		return view, err
+	}
+
+	if metadata, ok := workload.Object["metadata"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(metadata, &view.ObjectMeta); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := &view.Spec
+	if replicas, found, _ := unstructured.NestedInt64(workload.Object, "spec", "replicas"); found {
+		r := int32(replicas)
+		spec.Replicas = &r
+	}
+	if limit, found, _ := unstructured.NestedInt64(workload.Object, "spec", "revisionHistoryLimit"); found {
+		l := int32(limit)
+		spec.RevisionHistoryLimit = &l
+	}
+	if seconds, found, _ := unstructured.NestedInt64(workload.Object, "spec", "minReadySeconds"); found {
+		spec.MinReadySeconds = int32(seconds)
+	}
+	if selector, found, _ := unstructured.NestedMap(workload.Object, "spec", "selector"); found {
+		spec.Selector = &metav1.LabelSelector{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selector, spec.Selector); err != nil {
+			return nil, err
+		}
+	}
+	if template, found, _ := unstructured.NestedMap(workload.Object, "spec", "template"); found {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, &spec.Template); err != nil {
+			return nil, err
+		}
+	}
+
+	// Rollouts report their observed generation as a string, so only the
+	// counts every workload reports as integers are read.
+	status := &view.Status
+	for field, count := range map[string]*int32{
+		"replicas":          &status.Replicas,
+		"readyReplicas":     &status.ReadyReplicas,
+		"availableReplicas": &status.AvailableReplicas,
+		"updatedReplicas":   &status.UpdatedReplicas,
+	} {
+		if value, found, _ := unstructured.NestedInt64(workload.Object, "status", field); found {
+			*count = int32(value)
+		}
+	}
+	// StatefulSets only report available replicas since Kubernetes 1.22, and
+	// without minReadySeconds their ready replicas are available.
+	if _, found, _ := unstructured.NestedInt64(workload.Object, "status", "availableReplicas"); !found && spec.MinReadySeconds == 0 {
+		status.AvailableReplicas = status.ReadyReplicas
+	}
+	status.ObservedGeneration = view.Generation
+	if generation, found, _ := unstructured.NestedInt64(workload.Object, "status", "observedGeneration"); found {
+		status.ObservedGeneration = generation
+	}
+	return view, nil
+}
+
+// setWorkloadSpec writes the spec of a Deployment view back onto a workload.
+// Deployments take the whole spec, other workloads the fields they share with
+// Deployments.
+func setWorkloadSpec(workload *unstructured.Unstructured, spec appsv1.DeploymentSpec) error {
+	if isDeployment(workload.GroupVersionKind()) {
+		out, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&spec)
+		if err != nil {
+			return err
+		}
+		return unstructured.SetNestedField(workload.Object, out, "spec")
+	}
+
+	setOptional := func(value *int32, field string) error {
+		if value == nil {
+			unstructured.RemoveNestedField(workload.Object, "spec", field)
+			return nil
+		}
+		return unstructured.SetNestedField(workload.Object, int64(*value), "spec", field)
+	}
+	if err := setOptional(spec.Replicas, "replicas"); err != nil {
+		return err
+	}
+	if err := setOptional(spec.RevisionHistoryLimit, "revisionHistoryLimit"); err != nil {
+		return err
+	}
+	if spec.MinReadySeconds == 0 {
+		unstructured.RemoveNestedField(workload.Object, "spec", "minReadySeconds")
+	} else if err := unstructured.SetNestedField(workload.Object, int64(spec.MinReadySeconds), "spec", "minReadySeconds"); err != nil {
+		return err
+	}
+
+	if spec.Selector != nil {
+		selector, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec.Selector)
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedMap(workload.Object, selector, "spec", "selector"); err != nil {
+			return err
+		}
+	}
+	template, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&spec.Template)
+	if err != nil {
+		return err
+	}
+	return unstructured.SetNestedMap(workload.Object, template, "spec", "template")
+}
+
+// setVersionServiceName points a cloned StatefulSet governed by the base
+// Service of the version at the Service cloned for the version, so that the
+// DNS records of its pods resolve through it.
+func setVersionServiceName(workload *unstructured.Unstructured, deploymentVersion *kyaninusv1.DeploymentVersion) error {
+	if workload.GetKind() != "StatefulSet" || deploymentVersion.Spec.ServiceRef == nil {
+		return nil
+	}
+	serviceName, _, _ := unstructured.NestedString(workload.Object, "spec", "serviceName")
+	if serviceName != deploymentVersion.Spec.ServiceRef.Name {
+		return nil
+	}
+	return unstructured.SetNestedField(workload.Object, deploymentVersion.Name, "spec", "serviceName")
+}
+
+// mergeWorkload applies the overrides of a version to its base workload and
+// returns the Deployment view of the result. JSON patches apply to the whole
+// spec of the workload; the other strategies merge the Deployment view. The
+// images, env and replicas shorthands are applied last.
+func mergeWorkload(base *unstructured.Unstructured, deploymentVersion *kyaninusv1.DeploymentVersion) (*unstructured.Unstructured, *appsv1.Deployment, error) {
+	merged := base.DeepCopy()
+
+	if deploymentVersion.Spec.MergeStrategy == kyaninusv1.MergeStrategyJSONPatch && !isDeployment(base.GroupVersionKind()) {
+		spec, _, _ := unstructured.NestedMap(base.Object, "spec")
+		original, err := json.Marshal(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, err := applyJSONPatch(original, deploymentVersion.Spec.JSONPatch)
+		if err != nil {
+			return nil, nil, err
+		}
+		patched := map[string]interface{}{}
+		if err := utiljson.Unmarshal(out, &patched); err != nil {
+			return nil, nil, err
+		}
+		merged.Object["spec"] = patched
+		view, err := workloadView(merged)
+		if err != nil || !hasShorthands(deploymentVersion) {
+			return merged, view, err
+		}
+		if err := applyShorthands(&view.Spec, deploymentVersion); err != nil {
+			return nil, nil, err
+		}
+		if err := setWorkloadSpec(merged, view.Spec); err != nil {
+			return nil, nil, err
+		}
+		return merged, view, nil
+	}
+
+	view, err := workloadView(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec, err := mergeDeploymentSpec(view.Spec, deploymentVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := applyShorthands(&spec, deploymentVersion); err != nil {
+		return nil, nil, err
+	}
+	if err := setWorkloadSpec(merged, spec); err != nil {
+		return nil, nil, err
+	}
+	view.Spec = spec
+	return merged, view, nil
+}
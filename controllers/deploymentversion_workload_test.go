@@ -0,0 +1,320 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// toWorkload converts a typed workload to the unstructured form the
+// reconciler handles.
+func toWorkload(t *testing.T, obj client.Object) *unstructured.Unstructured {
+	t.Helper()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workload := &unstructured.Unstructured{Object: content}
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		workload.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+	case *appsv1.StatefulSet:
+		workload.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("StatefulSet"))
+	}
+	return workload
+}
+
+func testStatefulSet(name string, labels map[string]string, image string) *appsv1.StatefulSet {
+	replicas := int32(3)
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: name + "-headless",
+			Selector:    &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: image}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+			}},
+		},
+	}
+}
+
+func statefulSetVersion() *kyaninusv1.DeploymentVersion {
+	return &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-v2", Namespace: "default", UID: "v2", Generation: 1},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:        "db",
+			Namespace:   "default",
+			WorkloadRef: &kyaninusv1.WorkloadReference{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			DeploymentSpec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "db:2"}}},
+				},
+			},
+		},
+	}
+}
+
+func TestWorkloadViewRoundTrip(t *testing.T) {
+	workload := toWorkload(t, testStatefulSet("db", map[string]string{"app": "db"}, "db:1"))
+
+	view, err := workloadView(workload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *view.Spec.Replicas != 3 || view.Spec.Selector.MatchLabels["app"] != "db" ||
+		view.Spec.Template.Spec.Containers[0].Image != "db:1" {
+		t.Fatalf("unexpected view %+v", view.Spec)
+	}
+
+	view.Spec.Template.Spec.Containers[0].Image = "db:2"
+	zero := int32(0)
+	view.Spec.Replicas = &zero
+	if err := setWorkloadSpec(workload, view.Spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var statefulSet appsv1.StatefulSet
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(workload.Object, &statefulSet); err != nil {
+		t.Fatal(err)
+	}
+	if statefulSet.Spec.Template.Spec.Containers[0].Image != "db:2" || *statefulSet.Spec.Replicas != 0 {
+		t.Errorf("view changes not written back, got %+v", statefulSet.Spec)
+	}
+	if statefulSet.Spec.ServiceName != "db-headless" || len(statefulSet.Spec.VolumeClaimTemplates) != 1 {
+		t.Errorf("fields outside the view must be kept, got %+v", statefulSet.Spec)
+	}
+}
+
+func TestMergeWorkloadJSONPatchOnWholeSpec(t *testing.T) {
+	version := statefulSetVersion()
+	version.Spec.MergeStrategy = kyaninusv1.MergeStrategyJSONPatch
+	version.Spec.JSONPatch = []kyaninusv1.JSONPatchOperation{
+		{Op: "replace", Path: "/serviceName", Value: &apiextensionsv1.JSON{Raw: []byte(`"db-v2-headless"`)}},
+	}
+
+	merged, view, err := mergeWorkload(toWorkload(t, testStatefulSet("db", map[string]string{"app": "db"}, "db:1")), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := unstructured.NestedString(merged.Object, "spec", "serviceName"); name != "db-v2-headless" {
+		t.Errorf("serviceName = %s, want the patched db-v2-headless", name)
+	}
+	if view.Spec.Template.Spec.Containers[0].Image != "db:1" {
+		t.Errorf("unexpected view %+v", view.Spec)
+	}
+}
+
+func TestMergeWorkloadShorthandsAfterJSONPatch(t *testing.T) {
+	version := statefulSetVersion()
+	version.Spec.MergeStrategy = kyaninusv1.MergeStrategyJSONPatch
+	version.Spec.JSONPatch = []kyaninusv1.JSONPatchOperation{
+		{Op: "replace", Path: "/serviceName", Value: &apiextensionsv1.JSON{Raw: []byte(`"db-v2-headless"`)}},
+	}
+	version.Spec.Images = map[string]string{"app": "db:2"}
+	version.Spec.Replicas = int32Ptr(1)
+
+	merged, view, err := mergeWorkload(toWorkload(t, testStatefulSet("db", map[string]string{"app": "db"}, "db:1")), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := unstructured.NestedString(merged.Object, "spec", "serviceName"); name != "db-v2-headless" {
+		t.Errorf("serviceName = %s, want the patched db-v2-headless", name)
+	}
+	containers, _, _ := unstructured.NestedSlice(merged.Object, "spec", "template", "spec", "containers")
+	if image, _, _ := unstructured.NestedString(containers[0].(map[string]interface{}), "image"); image != "db:2" {
+		t.Errorf("merged image = %s, want db:2", image)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(merged.Object, "spec", "replicas"); replicas != 1 || *view.Spec.Replicas != 1 {
+		t.Errorf("replicas = %d, want 1", replicas)
+	}
+}
+
+func TestReconcileStatefulSetVersion(t *testing.T) {
+	base := testStatefulSet("db", map[string]string{"app": "db"}, "db:1")
+	version := statefulSetVersion()
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var clone appsv1.StatefulSet
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "db-v2"}, &clone); err != nil {
+		t.Fatal(err)
+	}
+	if image := clone.Spec.Template.Spec.Containers[0].Image; image != "db:2" {
+		t.Errorf("clone image = %s, want the override db:2", image)
+	}
+	if clone.Spec.Selector.MatchLabels[kyaninusv1.VersionLabel] != "db-v2" {
+		t.Errorf("clone selector %v, want the version label", clone.Spec.Selector)
+	}
+	if clone.Spec.ServiceName != "db-headless" || len(clone.Spec.VolumeClaimTemplates) != 1 || *clone.Spec.Replicas != 3 {
+		t.Errorf("StatefulSet fields of the base must be kept, got %+v", clone.Spec)
+	}
+	if !metav1.IsControlledBy(&clone, version) {
+		t.Error("expected the clone to be owned by the version")
+	}
+	if version.Status.DeploymentName != "db-v2" {
+		t.Errorf("status names %q, want the generated StatefulSet", version.Status.DeploymentName)
+	}
+
+	var untouched appsv1.Deployment
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "db-v2"}, &untouched); err == nil {
+		t.Error("no Deployment should be generated for a StatefulSet version")
+	}
+}
+
+func TestReconcileDeploymentVersionWithoutWorkloadRef(t *testing.T) {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	base.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-v2", Namespace: "default", UID: "v2", Generation: 1},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:      "myapp",
+			Namespace: "default",
+			DeploymentSpec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "myapp:2"}}},
+				},
+			},
+		},
+	}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	// The second pass updates the Deployment created by the first.
+	for i := 0; i < 2; i++ {
+		if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var clone appsv1.Deployment
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "myapp-v2"}, &clone); err != nil {
+		t.Fatal(err)
+	}
+	if image := clone.Spec.Template.Spec.Containers[0].Image; image != "myapp:2" {
+		t.Errorf("clone image = %s, want the override myapp:2", image)
+	}
+	if clone.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType {
+		t.Errorf("clone strategy = %s, want the base Deployment's", clone.Spec.Strategy.Type)
+	}
+	if !metav1.IsControlledBy(&clone, version) {
+		t.Error("expected the clone to be owned by the version")
+	}
+}
+
+func TestReconcileStatefulSetVersionService(t *testing.T) {
+	base := testStatefulSet("db", map[string]string{"app": "db"}, "db:1")
+	headless := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-headless", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  map[string]string{"app": "db"},
+			Ports:     []corev1.ServicePort{{Name: "sql", Port: 5432}},
+		},
+	}
+	version := statefulSetVersion()
+	version.Spec.ServiceRef = &corev1.LocalObjectReference{Name: "db-headless"}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, headless, version).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	if _, err := r.reconcileDeployment(ctx, version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var clone appsv1.StatefulSet
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "db-v2"}, &clone); err != nil {
+		t.Fatal(err)
+	}
+	if clone.Spec.ServiceName != "db-v2" {
+		t.Errorf("clone serviceName = %s, want the version Service db-v2", clone.Spec.ServiceName)
+	}
+	var service corev1.Service
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "db-v2"}, &service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("version Service clusterIP = %q, want it headless like its base", service.Spec.ClusterIP)
+	}
+}
+
+func TestWorkloadViewAvailableFromReady(t *testing.T) {
+	statefulSet := testStatefulSet("db-v2", map[string]string{"app": "db"}, "db:2")
+	statefulSet.Status = appsv1.StatefulSetStatus{Replicas: 3, ReadyReplicas: 3, UpdatedReplicas: 3}
+
+	view, err := workloadView(toWorkload(t, statefulSet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.Status.AvailableReplicas != 3 {
+		t.Errorf("available replicas = %d, want the ready replicas of a StatefulSet not reporting them", view.Status.AvailableReplicas)
+	}
+
+	statefulSet.Spec.MinReadySeconds = 10
+	view, err = workloadView(toWorkload(t, statefulSet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.Status.AvailableReplicas != 0 {
+		t.Errorf("available replicas = %d, want none reported while minReadySeconds applies", view.Status.AvailableReplicas)
+	}
+}
+
+func TestBaseWorkloadChanged(t *testing.T) {
+	old := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	old.Generation = 1
+
+	status := old.DeepCopy()
+	status.Status.ReadyReplicas = 1
+	if baseWorkloadChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: status}) {
+		t.Error("a status update of the base must not reconcile its versions")
+	}
+
+	spec := old.DeepCopy()
+	spec.Generation = 2
+	if !baseWorkloadChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: spec}) {
+		t.Error("a spec update of the base must reconcile its versions")
+	}
+
+	labels := old.DeepCopy()
+	labels.Labels = map[string]string{"team": "shop"}
+	if !baseWorkloadChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: labels}) {
+		t.Error("a label update of the base must reconcile its versions")
+	}
+}
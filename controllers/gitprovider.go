@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// gitRef is a branch, or the head branch of an open pull request.
+type gitRef struct {
+	Branch string
+	SHA    string
+	// Number is the number of the pull request, zero for branches.
+	Number int
+}
+
+// gitPageSize is the number of items requested per page of a listing.
+const gitPageSize = 50
+
+// gitProviderTimeout bounds each request to a Git provider, so that a hung
+// provider does not hold up the reconcile workers.
+var gitProviderTimeout = 30 * time.Second
+
+// gitProviderClient lists the branches and open pull requests of a repository
+// on GitHub or Gitea. Both serve the same shape of listings, except for the
+// commit of a branch, and page them the same way.
+type gitProviderClient struct {
+	provider   kyaninusv1.GitProvider
+	token      string
+	httpClient *http.Client
+}
+
+// refs lists the branches, or open pull requests, of the repository.
+func (c *gitProviderClient) refs(ctx context.Context, source kyaninusv1.GitSource) ([]gitRef, error) {
+	if source == kyaninusv1.GitSourceBranches {
+		return c.branches(ctx)
+	}
+	return c.pullRequests(ctx)
+}
+
+func (c *gitProviderClient) branches(ctx context.Context) ([]gitRef, error) {
+	var refs []gitRef
+	err := c.list(ctx, "branches", nil, func(page json.RawMessage) (int, error) {
+		var branches []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				// GitHub reports the sha of the commit, Gitea its id.
+				SHA string `json:"sha"`
+				ID  string `json:"id"`
+			} `json:"commit"`
+		}
+		if err := json.Unmarshal(page, &branches); err != nil {
+			return 0, err
+		}
+		for _, branch := range branches {
+			sha := branch.Commit.SHA
+			if sha == "" {
+				sha = branch.Commit.ID
+			}
+			refs = append(refs, gitRef{Branch: branch.Name, SHA: sha})
+		}
+		return len(branches), nil
+	})
+	return refs, err
+}
+
+func (c *gitProviderClient) pullRequests(ctx context.Context) ([]gitRef, error) {
+	var refs []gitRef
+	err := c.list(ctx, "pulls", url.Values{"state": {"open"}}, func(page json.RawMessage) (int, error) {
+		var pulls []struct {
+			Number int    `json:"number"`
+			State  string `json:"state"`
+			Head   struct {
+				Ref string `json:"ref"`
+				SHA string `json:"sha"`
+			} `json:"head"`
+		}
+		if err := json.Unmarshal(page, &pulls); err != nil {
+			return 0, err
+		}
+		for _, pull := range pulls {
+			if pull.State != "" && pull.State != "open" {
+				continue
+			}
+			refs = append(refs, gitRef{Branch: pull.Head.Ref, SHA: pull.Head.SHA, Number: pull.Number})
+		}
+		return len(pulls), nil
+	})
+	return refs, err
+}
+
+// list fetches every page of a repository listing, handing each one to
+// decode, which returns the number of items on the page.
+func (c *gitProviderClient) list(ctx context.Context, resource string, query url.Values, decode func(json.RawMessage) (int, error)) error {
+	for page := 1; ; page++ {
+		values := url.Values{"page": {fmt.Sprint(page)}}
+		for key, value := range query {
+			values[key] = value
+		}
+		if c.provider.Type == kyaninusv1.GitProviderGitea {
+			values.Set("limit", fmt.Sprint(gitPageSize))
+		} else {
+			values.Set("per_page", fmt.Sprint(gitPageSize))
+		}
+
+		body, err := c.get(ctx, c.repositoryURL()+"/"+resource+"?"+values.Encode())
+		if err != nil {
+			return err
+		}
+		count, err := decode(body)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", resource, err)
+		}
+		if count < gitPageSize {
+			return nil
+		}
+	}
+}
+
+func (c *gitProviderClient) get(ctx context.Context, endpoint string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: gitProviderTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// repositoryURL is the API URL of the repository.
+func (c *gitProviderClient) repositoryURL() string {
+	base := strings.TrimSuffix(c.provider.URL, "/")
+	switch {
+	case c.provider.Type == kyaninusv1.GitProviderGitea:
+		base += "/api/v1"
+	case base == "":
+		base = "https://api.github.com"
+	}
+	return fmt.Sprintf("%s/repos/%s/%s", base, url.PathEscape(c.provider.Owner), url.PathEscape(c.provider.Repository))
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+var (
+	// reconcileOutcomes counts the reconciles of DeploymentVersions by their
+	// result and the reason of the resulting Ready condition.
+	reconcileOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kyaninus_reconcile_total",
+		Help: "Reconciles of DeploymentVersions by result and reason.",
+	}, []string{"result", "reason"})
+
+	// mergeDuration observes how long merging the overrides of a version onto
+	// its base takes.
+	mergeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kyaninus_merge_duration_seconds",
+		Help:    "Time taken to merge the overrides of a DeploymentVersion onto its base.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"strategy"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(reconcileOutcomes, mergeDuration)
+}
+
+// recordReconcile counts a reconcile of the version by its result and the
+// reason of its Ready condition.
+func recordReconcile(deploymentVersion *kyaninusv1.DeploymentVersion, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	reason := "Unknown"
+	if cond := meta.FindStatusCondition(deploymentVersion.Status.Conditions, kyaninusv1.ConditionReady); cond != nil {
+		reason = cond.Reason
+	}
+	reconcileOutcomes.WithLabelValues(result, reason).Inc()
+}
+
+// observeMerge records the duration of a merge started at start.
+func observeMerge(deploymentVersion *kyaninusv1.DeploymentVersion, start time.Time) {
+	strategy := string(deploymentVersion.Spec.MergeStrategy)
+	if strategy == "" {
+		strategy = string(kyaninusv1.MergeStrategyMerge)
+	}
+	mergeDuration.WithLabelValues(strategy).Observe(time.Since(start).Seconds())
+}
+
+var (
+	versionsDesc = prometheus.NewDesc("kyaninus_versions",
+		"DeploymentVersions per base workload. Versions created by a VersionGenerator carry its name.",
+		[]string{"namespace", "base_namespace", "base", "kind", "generator"}, nil)
+	versionAgeDesc = prometheus.NewDesc("kyaninus_version_age_seconds",
+		"Time since the DeploymentVersion was created.",
+		[]string{"namespace", "name", "base"}, nil)
+	versionReadyReplicasDesc = prometheus.NewDesc("kyaninus_version_ready_replicas",
+		"Ready replicas of the workload generated for the DeploymentVersion.",
+		[]string{"namespace", "name", "base"}, nil)
+)
+
+// versionCollector reports the DeploymentVersions in the cache of the
+// manager when it is scraped, so the series of deleted versions disappear
+// with them.
+type versionCollector struct {
+	reader client.Reader
+	now    func() time.Time
+}
+
+// registerVersionCollector registers a versionCollector reading through
+// reader. Registering it again, as tests setting up several managers do,
+// is not an error.
+func registerVersionCollector(reader client.Reader) error {
+	err := metrics.Registry.Register(&versionCollector{reader: reader, now: time.Now})
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		return nil
+	}
+	return err
+}
+
+// Describe implements prometheus.Collector.
+func (c *versionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- versionsDesc
+	ch <- versionAgeDesc
+	ch <- versionReadyReplicasDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *versionCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var versions kyaninusv1.DeploymentVersionList
+	if err := c.reader.List(ctx, &versions); err != nil {
+		ch <- prometheus.NewInvalidMetric(versionsDesc, err)
+		return
+	}
+
+	type baseKey struct {
+		namespace, baseNamespace, base, kind, generator string
+	}
+	counts := map[baseKey]int{}
+	now := c.now()
+	for i := range versions.Items {
+		version := &versions.Items[i]
+		if !version.DeletionTimestamp.IsZero() {
+			continue
+		}
+		baseNamespace := version.Spec.Namespace
+		if baseNamespace == "" {
+			baseNamespace = version.Namespace
+		}
+		key := baseKey{
+			namespace:     version.Namespace,
+			baseNamespace: baseNamespace,
+			base:          version.Spec.Name,
+			kind:          version.WorkloadGroupVersionKind().Kind,
+			generator:     version.Labels[kyaninusv1.GeneratorLabel],
+		}
+		counts[key]++
+
+		ch <- prometheus.MustNewConstMetric(versionAgeDesc, prometheus.GaugeValue,
+			now.Sub(version.CreationTimestamp.Time).Seconds(), version.Namespace, version.Name, version.Spec.Name)
+		ch <- prometheus.MustNewConstMetric(versionReadyReplicasDesc, prometheus.GaugeValue,
+			float64(version.Status.ReadyReplicas), version.Namespace, version.Name, version.Spec.Name)
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(versionsDesc, prometheus.GaugeValue, float64(count),
+			key.namespace, key.baseNamespace, key.base, key.kind, key.generator)
+	}
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func TestVersionCollector(t *testing.T) {
+	created := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	version := func(name, base string, labels map[string]string, ready int32) *kyaninusv1.DeploymentVersion {
+		return &kyaninusv1.DeploymentVersion{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "previews", Labels: labels, CreationTimestamp: metav1.Time{Time: created}},
+			Spec:       kyaninusv1.DeploymentVersionSpec{Name: base},
+			Status:     kyaninusv1.DeploymentVersionStatus{ReadyReplicas: ready},
+		}
+	}
+	generated := map[string]string{kyaninusv1.GeneratorLabel: "previews"}
+
+	collector := &versionCollector{
+		reader: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+			version("myapp-pr-41", "myapp", generated, 1),
+			version("myapp-pr-42", "myapp", generated, 2),
+			version("myapp-canary", "myapp", nil, 3),
+			version("billing-v2", "billing", nil, 0),
+		).Build(),
+		now: func() time.Time { return created.Add(time.Hour) },
+	}
+
+	expected := `
+# HELP kyaninus_versions DeploymentVersions per base workload. Versions created by a VersionGenerator carry its name.
+# TYPE kyaninus_versions gauge
+kyaninus_versions{base="billing",base_namespace="previews",generator="",kind="Deployment",namespace="previews"} 1
+kyaninus_versions{base="myapp",base_namespace="previews",generator="",kind="Deployment",namespace="previews"} 1
+kyaninus_versions{base="myapp",base_namespace="previews",generator="previews",kind="Deployment",namespace="previews"} 2
+# HELP kyaninus_version_ready_replicas Ready replicas of the workload generated for the DeploymentVersion.
+# TYPE kyaninus_version_ready_replicas gauge
+kyaninus_version_ready_replicas{base="billing",name="billing-v2",namespace="previews"} 0
+kyaninus_version_ready_replicas{base="myapp",name="myapp-canary",namespace="previews"} 3
+kyaninus_version_ready_replicas{base="myapp",name="myapp-pr-41",namespace="previews"} 1
+kyaninus_version_ready_replicas{base="myapp",name="myapp-pr-42",namespace="previews"} 2
+# HELP kyaninus_version_age_seconds Time since the DeploymentVersion was created.
+# TYPE kyaninus_version_age_seconds gauge
+kyaninus_version_age_seconds{base="billing",name="billing-v2",namespace="previews"} 3600
+kyaninus_version_age_seconds{base="myapp",name="myapp-canary",namespace="previews"} 3600
+kyaninus_version_age_seconds{base="myapp",name="myapp-pr-41",namespace="previews"} 3600
+kyaninus_version_age_seconds{base="myapp",name="myapp-pr-42",namespace="previews"} 3600
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcileOutcomeMetrics(t *testing.T) {
+	base := testDeployment("myapp", map[string]string{"app": "myapp"}, "myapp:1")
+	version := eventVersion()
+	broken := eventVersion()
+	broken.Name = "myapp-v3"
+	broken.Spec.Images = map[string]string{"sidecar": "proxy:2"}
+
+	scheme := newTestScheme(t)
+	r := &DeploymentVersionReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(base, version, broken).Build(),
+		Scheme: scheme,
+	}
+	ctx := context.Background()
+
+	// outcomes counts the reconciles ending with the reason, whatever their result.
+	outcomes := func(reason string) float64 {
+		return testutil.ToFloat64(reconcileOutcomes.WithLabelValues("success", reason)) +
+			testutil.ToFloat64(reconcileOutcomes.WithLabelValues("error", reason))
+	}
+	rollingOut := outcomes("RollingOut")
+	mergeFailed := outcomes("MergeFailed")
+
+	for _, name := range []string{version.Name, broken.Name} {
+		r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}})
+	}
+
+	if got := outcomes("RollingOut") - rollingOut; got != 1 {
+		t.Errorf("counted %v RollingOut reconciles, want 1", got)
+	}
+	if got := outcomes("MergeFailed") - mergeFailed; got != 1 {
+		t.Errorf("counted %v MergeFailed reconciles, want 1", got)
+	}
+	if testutil.CollectAndCount(mergeDuration) == 0 {
+		t.Error("expected the merge duration to be observed")
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prometheusTimeout bounds each Prometheus query, so that a hung server does
+// not hold up the reconcile workers.
+var prometheusTimeout = 30 * time.Second
+
+// prometheusClient runs instant PromQL queries against the Prometheus HTTP API.
+type prometheusClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+// prometheusResponse is the envelope of a Prometheus /api/v1/query response.
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// query runs an instant query that must return a single scalar or vector
+// sample, and returns its value.
+func (c *prometheusClient) query(ctx context.Context, promql string) (float64, error) {
+	endpoint := strings.TrimSuffix(c.url, "/") + "/api/v1/query?" + url.Values{"query": {promql}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: prometheusTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body prometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("decoding prometheus response: %w", err)
+	}
+	if body.Status != "success" {
+		return 0, fmt.Errorf("prometheus query failed: %s", body.Error)
+	}
+
+	// A sample is a [timestamp, "value"] pair.
+	var sample []interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, err
+		}
+	case "vector":
+		var vector []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, err
+		}
+		if len(vector) != 1 {
+			return 0, fmt.Errorf("query %q returned %d samples, expected 1", promql, len(vector))
+		}
+		sample = vector[0].Value
+	default:
+		return 0, fmt.Errorf("unsupported prometheus result type %q", body.Data.ResultType)
+	}
+
+	if len(sample) != 2 {
+		return 0, fmt.Errorf("malformed prometheus sample %v", sample)
+	}
+	value, ok := sample[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("malformed prometheus sample %v", sample)
+	}
+	return strconv.ParseFloat(value, 64)
+}
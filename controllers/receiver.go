@@ -0,0 +1,442 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a payload, as sha256=<hex>. It
+// is the header GitHub signs its webhooks with, and generic payloads use it
+// too.
+const SignatureHeader = "X-Hub-Signature-256"
+
+// maxPayloadSize bounds the size of the payloads read by the Receiver.
+const maxPayloadSize = 1 << 20
+
+// Receiver accepts webhooks pushed by CI systems and Git hosting services, and
+// creates, updates or deletes DeploymentVersions in response. GitHub push and
+// pull request events are applied to the VersionGenerators of their
+// repository, generic payloads name the version directly.
+type Receiver struct {
+	Client client.Client
+	Scheme *runtime.Scheme
+
+	// Addr is the address the receiver listens on.
+	Addr string
+	// Secret is the key the payloads are signed with.
+	Secret []byte
+	// AllowList maps the namespaces the receiver may change to what may be
+	// changed in them. Other namespaces are never touched.
+	AllowList map[string]ReceiverAllowList
+}
+
+// ReceiverAllowList lists what the Receiver may change in a namespace. An
+// entry of "*" allows everything.
+type ReceiverAllowList struct {
+	// Repositories are the owner/name of the repositories whose GitHub events
+	// are applied to the VersionGenerators of the namespace.
+	Repositories []string `json:"repositories,omitempty"`
+	// Bases are the base workloads generic payloads may change the versions of.
+	Bases []string `json:"bases,omitempty"`
+}
+
+// ReadReceiverAllowList reads the per-namespace allow-lists of the Receiver
+// from a YAML or JSON file of the form
+//
+//	namespaces:
+//	  previews:
+//	    repositories: [my-org/my-app]
+//	    bases: [my-app]
+func ReadReceiverAllowList(path string) (map[string]ReceiverAllowList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config struct {
+		Namespaces map[string]ReceiverAllowList `json:"namespaces"`
+	}
+	if err := yaml.NewYAMLOrJSONDecoder(file, 4096).Decode(&config); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return config.Namespaces, nil
+}
+
+// receivedVersion reports a version changed by a payload.
+type receivedVersion struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+}
+
+// receiverError is an error answered with a status other than 500.
+type receiverError struct {
+	status int
+	err    error
+}
+
+func (e *receiverError) Error() string { return e.err.Error() }
+
+func newReceiverError(status int, format string, args ...interface{}) error {
+	return &receiverError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// Start serves the receiver until the context is done. It implements
+// manager.Runnable.
+func (r *Receiver) Start(ctx context.Context) error {
+	server := &http.Server{Addr: r.Addr, Handler: r}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+// NeedLeaderElection lets every replica of the manager serve webhooks.
+func (r *Receiver) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP verifies the signature of a payload and applies it. GitHub events
+// are posted to /hooks/github, generic payloads to /hooks/generic.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger := log.Log.WithName("receiver").WithValues("path", req.URL.Path)
+	ctx := log.IntoContext(req.Context(), logger)
+
+	var handle func(context.Context, *http.Request, []byte) ([]receivedVersion, error)
+	switch req.URL.Path {
+	case "/hooks/github":
+		handle = r.handleGitHub
+	case "/hooks/generic":
+		handle = r.handleGeneric
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPayloadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxPayloadSize {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !r.validSignature(body, req.Header.Get(SignatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	versions, err := handle(ctx, req, body)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var receiverErr *receiverError
+		if errors.As(err, &receiverErr) {
+			status = receiverErr.status
+		} else {
+			logger.Error(err, "Unable to apply payload")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]receivedVersion{"versions": versions})
+}
+
+// validSignature checks the HMAC-SHA256 of a payload against its signature.
+func (r *Receiver) validSignature(body []byte, signature string) bool {
+	if len(r.Secret) == 0 || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, r.Secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// allowed reports whether a namespace allows a repository or base, as listed
+// by entries.
+func (r *Receiver) allowed(namespace, value string, entries func(ReceiverAllowList) []string) bool {
+	allowList, ok := r.AllowList[namespace]
+	if !ok {
+		return false
+	}
+	for _, entry := range entries(allowList) {
+		if entry == "*" || strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedRepositories(allowList ReceiverAllowList) []string { return allowList.Repositories }
+
+func allowedBases(allowList ReceiverAllowList) []string { return allowList.Bases }
+
+// gitHubEvent holds the fields of GitHub push and pull_request events the
+// receiver reads.
+type gitHubEvent struct {
+	// Push events.
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+
+	// Pull request events.
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// handleGitHub applies a push or pull_request event to the VersionGenerators
+// polling its repository. Pushes update the versions of branches, pull
+// request events those of pull requests. Other events are acknowledged and
+// ignored.
+func (r *Receiver) handleGitHub(ctx context.Context, req *http.Request, body []byte) ([]receivedVersion, error) {
+	var event gitHubEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, newReceiverError(http.StatusBadRequest, "invalid payload: %v", err)
+	}
+
+	var source kyaninusv1.GitSource
+	var ref gitRef
+	remove := false
+	switch req.Header.Get("X-GitHub-Event") {
+	case "push":
+		if !strings.HasPrefix(event.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		source = kyaninusv1.GitSourceBranches
+		ref = gitRef{Branch: strings.TrimPrefix(event.Ref, "refs/heads/"), SHA: event.After}
+		remove = event.Deleted
+	case "pull_request":
+		switch event.Action {
+		case "opened", "reopened", "synchronize":
+		case "closed":
+			remove = true
+		default:
+			return nil, nil
+		}
+		source = kyaninusv1.GitSourcePullRequests
+		ref = gitRef{Branch: event.PullRequest.Head.Ref, SHA: event.PullRequest.Head.SHA, Number: event.Number}
+	default:
+		return nil, nil
+	}
+	if event.Repository.FullName == "" || ref.Branch == "" {
+		return nil, newReceiverError(http.StatusBadRequest, "the payload names no repository or branch")
+	}
+
+	generators, err := r.generatorsFor(ctx, event.Repository.FullName, source)
+	if err != nil {
+		return nil, err
+	}
+
+	reconciler := &VersionGeneratorReconciler{Client: r.Client, Scheme: r.Scheme}
+	var versions []receivedVersion
+	for i := range generators {
+		generator := &generators[i]
+		render, err := newVersionRenderer(generator)
+		if err != nil {
+			return versions, err
+		}
+		if !render.matches(ref) {
+			continue
+		}
+
+		name, ok := generatedVersionName(generator, ref)
+		if !ok {
+			continue
+		}
+		if remove {
+			var version kyaninusv1.DeploymentVersion
+			err := r.Client.Get(ctx, types.NamespacedName{Namespace: generator.Namespace, Name: name}, &version)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return versions, err
+			}
+			if err := reconciler.deleteVersion(ctx, generator, &version); err != nil {
+				return versions, err
+			}
+			versions = append(versions, receivedVersion{Namespace: generator.Namespace, Name: name, Action: "deleted"})
+			continue
+		}
+
+		version, _, err := render.version(ref)
+		if err != nil {
+			return versions, err
+		}
+		if err := reconciler.applyVersion(ctx, generator, version); err != nil {
+			return versions, err
+		}
+		versions = append(versions, receivedVersion{Namespace: generator.Namespace, Name: name, Action: "applied"})
+	}
+	return versions, nil
+}
+
+// generatorsFor lists the VersionGenerators of a repository and source in the
+// namespaces allowing that repository.
+func (r *Receiver) generatorsFor(ctx context.Context, repository string, source kyaninusv1.GitSource) ([]kyaninusv1.VersionGenerator, error) {
+	var generators []kyaninusv1.VersionGenerator
+	for namespace := range r.AllowList {
+		if !r.allowed(namespace, repository, allowedRepositories) {
+			continue
+		}
+		var list kyaninusv1.VersionGeneratorList
+		if err := r.Client.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		for _, generator := range list.Items {
+			provider := generator.Spec.Provider
+			generatorSource := generator.Spec.Source
+			if generatorSource == "" {
+				generatorSource = kyaninusv1.GitSourcePullRequests
+			}
+			if generatorSource == source && strings.EqualFold(provider.Owner+"/"+provider.Repository, repository) {
+				generators = append(generators, generator)
+			}
+		}
+	}
+	return generators, nil
+}
+
+// genericPayload creates or updates a version with the given images, or
+// deletes it.
+type genericPayload struct {
+	// Action is apply, the default, or delete.
+	Action    string            `json:"action"`
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Base      string            `json:"base"`
+	Images    map[string]string `json:"images"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// handleGeneric applies a generic payload. The base of the version must be
+// allowed in its namespace.
+func (r *Receiver) handleGeneric(ctx context.Context, req *http.Request, body []byte) ([]receivedVersion, error) {
+	var payload genericPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, newReceiverError(http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	if payload.Namespace == "" || payload.Name == "" {
+		return nil, newReceiverError(http.StatusBadRequest, "the namespace and name of the version must be set")
+	}
+	if _, ok := r.AllowList[payload.Namespace]; !ok {
+		return nil, newReceiverError(http.StatusForbidden, "namespace %s is not allowed", payload.Namespace)
+	}
+	received := []receivedVersion{{Namespace: payload.Namespace, Name: payload.Name}}
+	key := types.NamespacedName{Namespace: payload.Namespace, Name: payload.Name}
+
+	switch payload.Action {
+	case "delete":
+		var version kyaninusv1.DeploymentVersion
+		if err := r.Client.Get(ctx, key, &version); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		if !r.allowed(payload.Namespace, version.Spec.Name, allowedBases) {
+			return nil, newReceiverError(http.StatusForbidden, "versions of %s are not allowed in namespace %s", version.Spec.Name, payload.Namespace)
+		}
+		log.FromContext(ctx).Info(fmt.Sprintf("%s %s", "Deleting received version", payload.Name))
+		if err := client.IgnoreNotFound(r.Client.Delete(ctx, &version)); err != nil {
+			return nil, err
+		}
+		received[0].Action = "deleted"
+		return received, nil
+
+	case "apply", "":
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var version kyaninusv1.DeploymentVersion
+			err := r.Client.Get(ctx, key, &version)
+			if apierrors.IsNotFound(err) {
+				return r.createReceivedVersion(ctx, payload)
+			}
+			if err != nil {
+				return err
+			}
+			if payload.Base != "" && payload.Base != version.Spec.Name {
+				return newReceiverError(http.StatusConflict, "version %s is a version of %s, not %s", payload.Name, version.Spec.Name, payload.Base)
+			}
+			if !r.allowed(payload.Namespace, version.Spec.Name, allowedBases) {
+				return newReceiverError(http.StatusForbidden, "versions of %s are not allowed in namespace %s", version.Spec.Name, payload.Namespace)
+			}
+			version.Spec.Images = mergeStringMaps(version.Spec.Images, payload.Images)
+			version.Labels = mergeStringMaps(version.Labels, payload.Labels)
+			log.FromContext(ctx).Info(fmt.Sprintf("%s %s", "Updating received version", payload.Name))
+			return r.Client.Update(ctx, &version)
+		})
+		if err != nil {
+			return nil, err
+		}
+		received[0].Action = "applied"
+		return received, nil
+	}
+	return nil, newReceiverError(http.StatusBadRequest, "unknown action %q", payload.Action)
+}
+
+func (r *Receiver) createReceivedVersion(ctx context.Context, payload genericPayload) error {
+	if payload.Base == "" {
+		return newReceiverError(http.StatusBadRequest, "the base of a new version must be set")
+	}
+	if !r.allowed(payload.Namespace, payload.Base, allowedBases) {
+		return newReceiverError(http.StatusForbidden, "versions of %s are not allowed in namespace %s", payload.Base, payload.Namespace)
+	}
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: payload.Name, Namespace: payload.Namespace, Labels: payload.Labels},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:      payload.Base,
+			Namespace: payload.Namespace,
+			Images:    payload.Images,
+		},
+	}
+	log.FromContext(ctx).Info(fmt.Sprintf("%s %s", "Creating received version", payload.Name))
+	return r.Client.Create(ctx, version)
+}
@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+var receiverSecret = []byte("It's a Secret to Everybody")
+
+func newTestReceiver(t *testing.T, objs ...client.Object) *Receiver {
+	scheme := newTestScheme(t)
+	return &Receiver{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme: scheme,
+		Secret: receiverSecret,
+		AllowList: map[string]ReceiverAllowList{
+			"previews": {Repositories: []string{"acme/myapp"}, Bases: []string{"myapp"}},
+			"default":  {Repositories: []string{"acme/other"}},
+		},
+	}
+}
+
+func receiverGenerator(namespace string, source kyaninusv1.GitSource) *kyaninusv1.VersionGenerator {
+	generator := testGenerator("")
+	generator.Namespace = namespace
+	generator.Spec.Source = source
+	generator.Spec.Pattern = "^feature/"
+	return generator
+}
+
+// replay posts a recorded payload to the receiver, signed with key.
+func replay(t *testing.T, r *Receiver, path, event, file string, key []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "receiver", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if event != "" {
+		req.Header.Set("X-GitHub-Event", event)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReceiverGitHubPullRequestLifecycle(t *testing.T) {
+	generator := receiverGenerator("previews", kyaninusv1.GitSourcePullRequests)
+	// A generator of the same repository in a namespace that does not allow it.
+	disallowed := receiverGenerator("default", kyaninusv1.GitSourcePullRequests)
+	r := newTestReceiver(t, generator, disallowed)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "previews", Name: "previews-pr-42"}
+
+	rec := replay(t, r, "/hooks/github", "pull_request", "github_pull_request_opened.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("opened: status %d: %s", rec.Code, rec.Body)
+	}
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Client.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if got := version.Spec.Images["app"]; got != "myapp:feature-login-9f2c8e0" {
+		t.Errorf("image = %s, want myapp:feature-login-9f2c8e0", got)
+	}
+	if !metav1.IsControlledBy(&version, generator) {
+		t.Error("expected the version to be owned by the generator")
+	}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: "default", Name: "previews-pr-42"}, &version)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected no version in a namespace not allowing the repository, got %v", err)
+	}
+
+	rec = replay(t, r, "/hooks/github", "pull_request", "github_pull_request_synchronize.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("synchronize: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := r.Client.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if got := version.Spec.Images["app"]; got != "myapp:feature-login-b3d1f7a" {
+		t.Errorf("image = %s, want the pushed commit", got)
+	}
+
+	rec = replay(t, r, "/hooks/github", "pull_request", "github_pull_request_closed.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("closed: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := r.Client.Get(ctx, key, &version); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the version of the closed pull request to be deleted, got %v", err)
+	}
+}
+
+func TestReceiverGitHubPush(t *testing.T) {
+	branches := receiverGenerator("previews", kyaninusv1.GitSourceBranches)
+	branches.Name = "branches"
+	pulls := receiverGenerator("previews", kyaninusv1.GitSourcePullRequests)
+	r := newTestReceiver(t, branches, pulls)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "previews", Name: "branches-feature-checkout-97cc63d5"}
+
+	rec := replay(t, r, "/hooks/github", "push", "github_push.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("push: status %d: %s", rec.Code, rec.Body)
+	}
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Client.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if got := version.Spec.Images["app"]; got != "myapp:feature-checkout-5e8a2c7" {
+		t.Errorf("image = %s", got)
+	}
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.Client.List(ctx, &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions.Items) != 1 {
+		t.Errorf("got %d versions, want pushes to only reach branch generators", len(versions.Items))
+	}
+
+	rec = replay(t, r, "/hooks/github", "push", "github_push_tag.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tag push: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = replay(t, r, "/hooks/github", "push", "github_push_deleted.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deleted push: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := r.Client.Get(ctx, key, &version); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the version of the deleted branch to be deleted, got %v", err)
+	}
+}
+
+func TestReceiverGeneric(t *testing.T) {
+	r := newTestReceiver(t)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "previews", Name: "myapp-build-1187"}
+
+	rec := replay(t, r, "/hooks/generic", "", "generic_apply.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply: status %d: %s", rec.Code, rec.Body)
+	}
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Client.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Spec.Name != "myapp" || version.Spec.Namespace != "previews" ||
+		version.Spec.Images["app"] != "registry.example.com/myapp:build-1187" || version.Labels["app"] != "myapp" {
+		t.Errorf("unexpected version %+v", version)
+	}
+
+	// Applying again updates the images of the existing version.
+	version.Spec.Images["app"] = "registry.example.com/myapp:build-1186"
+	if err := r.Client.Update(ctx, &version); err != nil {
+		t.Fatal(err)
+	}
+	rec = replay(t, r, "/hooks/generic", "", "generic_apply.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply again: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := r.Client.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Spec.Images["app"] != "registry.example.com/myapp:build-1187" {
+		t.Errorf("image = %s, want it updated", version.Spec.Images["app"])
+	}
+
+	rec = replay(t, r, "/hooks/generic", "", "generic_delete.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := r.Client.Get(ctx, key, &version); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the version to be deleted, got %v", err)
+	}
+}
+
+func TestReceiverRejects(t *testing.T) {
+	otherBase := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-build-1187", Namespace: "previews"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "billing"},
+	}
+
+	tests := []struct {
+		name   string
+		objs   []client.Object
+		mutate func(r *Receiver)
+		path   string
+		file   string
+		key    []byte
+		want   int
+	}{
+		{name: "wrong signature", path: "/hooks/generic", file: "generic_apply.json", key: []byte("guess"), want: http.StatusUnauthorized},
+		{
+			name:   "no secret configured",
+			mutate: func(r *Receiver) { r.Secret = nil },
+			path:   "/hooks/generic", file: "generic_apply.json", key: nil, want: http.StatusUnauthorized,
+		},
+		{
+			name:   "namespace not allowed",
+			mutate: func(r *Receiver) { delete(r.AllowList, "previews") },
+			path:   "/hooks/generic", file: "generic_apply.json", want: http.StatusForbidden,
+		},
+		{
+			name:   "base not allowed",
+			mutate: func(r *Receiver) { r.AllowList["previews"] = ReceiverAllowList{Bases: []string{"billing"}} },
+			path:   "/hooks/generic", file: "generic_apply.json", want: http.StatusForbidden,
+		},
+		{name: "version of another base", objs: []client.Object{otherBase}, path: "/hooks/generic", file: "generic_apply.json", want: http.StatusConflict},
+		{name: "delete version of a base not allowed", objs: []client.Object{otherBase}, path: "/hooks/generic", file: "generic_delete.json", want: http.StatusForbidden},
+		{name: "unknown path", path: "/hooks/gitlab", file: "generic_apply.json", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestReceiver(t, tt.objs...)
+			if tt.mutate != nil {
+				tt.mutate(r)
+			}
+			key := tt.key
+			if key == nil {
+				key = receiverSecret
+			}
+			rec := replay(t, r, tt.path, "", tt.file, key)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestReceiverIgnoresOtherEvents(t *testing.T) {
+	r := newTestReceiver(t, receiverGenerator("previews", kyaninusv1.GitSourcePullRequests))
+	rec := replay(t, r, "/hooks/github", "ping", "github_ping.json", receiverSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ping: status %d: %s", rec.Code, rec.Body)
+	}
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.Client.List(context.Background(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions.Items) != 0 {
+		t.Errorf("got %d versions, want none for a ping", len(versions.Items))
+	}
+}
+
+func TestReadReceiverAllowList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow-list.yaml")
+	config := "namespaces:\n  previews:\n    repositories: [acme/myapp]\n    bases: [myapp]\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	allowList, err := ReadReceiverAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := allowList["previews"]; len(got.Repositories) != 1 || got.Repositories[0] != "acme/myapp" || got.Bases[0] != "myapp" {
+		t.Errorf("allow-list %+v", allowList)
+	}
+}
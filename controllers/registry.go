@@ -0,0 +1,372 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestMediaTypes are the manifest and index media types accepted from a
+// registry.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// maxManifestSize bounds the manifests and image configs read from a registry.
+const maxManifestSize = 4 << 20
+
+// imageRepository is a repository of a registry served through the OCI
+// distribution API.
+type imageRepository struct {
+	// Host is the registry host, with its port.
+	Host string
+	// Name is the repository path within the registry.
+	Name string
+}
+
+// parseImageRepository splits an image reference into its registry and
+// repository, dropping any tag or digest. Images without a registry host are
+// on Docker Hub.
+func parseImageRepository(image string) imageRepository {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return imageRepository{Host: parts[0], Name: parts[1]}
+	}
+	if len(parts) == 1 {
+		image = "library/" + image
+	}
+	return imageRepository{Host: "docker.io", Name: image}
+}
+
+// String is the repository as written in image references.
+func (r imageRepository) String() string {
+	return r.Host + "/" + r.Name
+}
+
+// registryTimeout bounds each request to a registry, so that a hung registry
+// does not hold up the reconcile workers.
+var registryTimeout = 30 * time.Second
+
+// imageCreationTimes caches the creation time of the images of a digest, which
+// never changes, so that polling a repository by creation time only fetches
+// the manifests and configs of images it has not seen yet.
+var imageCreationTimes = &creationTimeCache{}
+
+// maxCachedCreationTimes bounds the creation times kept in memory. The cache
+// starts over once it is full.
+const maxCachedCreationTimes = 10000
+
+// creationTimeCache holds image creation times by repository and digest.
+type creationTimeCache struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func (c *creationTimeCache) get(repository imageRepository, digest string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	created, found := c.times[repository.String()+"@"+digest]
+	return created, found
+}
+
+func (c *creationTimeCache) set(repository imageRepository, digest string, created time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.times == nil || len(c.times) >= maxCachedCreationTimes {
+		c.times = map[string]time.Time{}
+	}
+	c.times[repository.String()+"@"+digest] = created
+}
+
+// registryClient reads the tags and manifests of a repository. It answers
+// the Bearer and Basic challenges of the registry with the given credentials,
+// or anonymously.
+type registryClient struct {
+	repository imageRepository
+	username   string
+	password   string
+	httpClient *http.Client
+
+	// authorization is the Authorization header obtained from the last
+	// challenge.
+	authorization string
+}
+
+// manifest is an image manifest or index.
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// tags lists the tags of the repository, following the Link headers of
+// paginated listings.
+func (c *registryClient) tags(ctx context.Context) ([]string, error) {
+	var tags []string
+	next := "/v2/" + c.repository.Name + "/tags/list"
+	for next != "" {
+		resp, err := c.do(ctx, http.MethodGet, next, "application/json")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding tags of %s: %w", c.repository, err)
+		}
+		tags = append(tags, page.Tags...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// digest resolves a tag to the digest of its manifest.
+func (c *registryClient) digest(ctx context.Context, tag string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, "/v2/"+c.repository.Name+"/manifests/"+tag, strings.Join(manifestMediaTypes, ", "))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	// Registries need not report the digest, which is then computed from
+	// the manifest itself.
+	digest, _, err := c.manifest(ctx, tag)
+	return digest, err
+}
+
+// manifest fetches the manifest of a tag or digest, and returns its digest.
+func (c *registryClient) manifest(ctx context.Context, reference string) (string, *manifest, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v2/"+c.repository.Name+"/manifests/"+reference, strings.Join(manifestMediaTypes, ", "))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return "", nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return "", nil, fmt.Errorf("decoding manifest %s of %s: %w", reference, c.repository, err)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return digest, &m, nil
+}
+
+// created returns the digest of a tag, or digest, and the creation time of
+// its image. The image of an index is its linux/amd64 image, or else its
+// first one.
+func (c *registryClient) created(ctx context.Context, tag string) (string, time.Time, error) {
+	digest, m, err := c.manifest(ctx, tag)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if len(m.Manifests) > 0 {
+		image := m.Manifests[0].Digest
+		for _, entry := range m.Manifests {
+			if entry.Platform.OS == "linux" && entry.Platform.Architecture == "amd64" {
+				image = entry.Digest
+				break
+			}
+		}
+		if _, m, err = c.manifest(ctx, image); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return "", time.Time{}, fmt.Errorf("manifest %s of %s has no image config", tag, c.repository)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/v2/"+c.repository.Name+"/blobs/"+m.Config.Digest, "")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	var config struct {
+		Created time.Time `json:"created"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&config); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding image config of %s:%s: %w", c.repository, tag, err)
+	}
+	return digest, config.Created, nil
+}
+
+// do sends a request to the registry, answering an authentication challenge
+// once. Responses other than 200 OK are returned as errors.
+func (c *registryClient) do(ctx context.Context, method, path, accept string) (*http.Response, error) {
+	resp, err := c.send(ctx, method, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authorize(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = c.send(ctx, method, path, accept); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *registryClient) send(ctx context.Context, method, path, accept string) (*http.Response, error) {
+	endpoint := path
+	if !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + c.registryHost() + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	return c.client().Do(req)
+}
+
+// authorize answers a WWW-Authenticate challenge, fetching a pull token from
+// the realm of a Bearer challenge.
+func (c *registryClient) authorize(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry %s requires credentials", c.repository.Host)
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry %s sent an unsupported challenge %q", c.repository.Host, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme != "https" {
+		return fmt.Errorf("registry %s sent an invalid token realm %q", c.repository.Host, params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+c.repository.Name+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s returned %s", realm.Host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("decoding registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// registryHost is the host serving the registry API; Docker Hub serves it
+// from another host than the one in image references.
+func (c *registryClient) registryHost() string {
+	if c.repository.Host == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return c.repository.Host
+}
+
+func (c *registryClient) client() *http.Client {
+	if c.httpClient == nil {
+		return &http.Client{Timeout: registryTimeout}
+	}
+	return c.httpClient
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters, e.g. Bearer realm="https://auth.example.com/token",service="registry".
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) == 2 {
+		for _, match := range challengeParam.FindAllStringSubmatch(parts[1], -1) {
+			value := match[2]
+			if value == "" {
+				value = match[3]
+			}
+			params[strings.ToLower(match[1])] = value
+		}
+	}
+	return parts[0], params
+}
+
+// challengeParam matches a key="value" or key=value challenge parameter.
+var challengeParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// nextLink returns the target of the rel="next" Link header of a paginated
+// listing, e.g. </v2/myapp/tags/list?last=v1.2.0&n=100>; rel="next".
+func nextLink(header string) string {
+	parts := strings.SplitN(header, ";", 2)
+	if len(parts) != 2 || !strings.Contains(parts[1], `rel="next"`) {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+}
@@ -0,0 +1,388 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// RouterReconciler reconciles a Router object
+type RouterReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// versionRoute is a route to a single DeploymentVersion, computed from the base
+// Ingress independently of the proxy it is rendered for.
+type versionRoute struct {
+	// Version is the name of the routed DeploymentVersion.
+	Version string
+	// BaseHost is the host of the base Ingress rule the route was derived from.
+	BaseHost string
+	Host     string
+	Path     string
+	PathType networkingv1.PathType
+	// StripPrefix is the version prefix of a path route, which proxies that
+	// support it remove before forwarding.
+	StripPrefix string
+	// Pin is set for Header mode routes, which only match pinned requests.
+	Pin *routePin
+	// Weight is the percentage of unpinned requests split off the base
+	// Service, set for Header mode routes of weighted versions.
+	Weight *int32
+	// Canary names the nginx canary Ingress holding a Header mode route.
+	Canary string
+	// Service is the version Service and port the route sends traffic to.
+	Service networkingv1.IngressServiceBackend
+	// BaseService is the base Service and port of the base Ingress rule.
+	BaseService networkingv1.IngressServiceBackend
+}
+
+// routePin pins requests carrying a header or cookie value to a version.
+type routePin struct {
+	Header string
+	Cookie string
+	Value  string
+}
+
+// String renders the pin as shown in the Router status.
+func (p *routePin) String() string {
+	if p.Header != "" {
+		return p.Header + "=" + p.Value
+	}
+	return "Cookie:" + p.Cookie + "=" + p.Value
+}
+
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=routers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=routers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=routers/finalizers,verbs=update
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile generates an Ingress, or Traefik IngressRoute, holding one route
+// per ready DeploymentVersion selected by the Router. The routes are derived from the rules of the base
+// Ingress whose backend is the version's base Service.
+func (r *RouterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var router kyaninusv1.Router
+	if err := r.Get(ctx, req.NamespacedName, &router); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "Unable to fetch Router")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	unrouted, reconcileErr := r.reconcileRoutes(ctx, &router)
+	switch {
+	case reconcileErr != nil:
+		log.Error(reconcileErr, "Error reconciling routes")
+		setRouterCondition(&router, metav1.ConditionFalse, "ReconcileFailed", reconcileErr.Error())
+	case len(unrouted) > 0:
+		setRouterCondition(&router, metav1.ConditionFalse, "PinningConflict", fmt.Sprintf(
+			"%s not routed: nginx applies one canary Ingress per host and path, pinning several versions needs a header and spec.activator",
+			strings.Join(unrouted, ", ")))
+	default:
+		setRouterCondition(&router, metav1.ConditionTrue, "Routed", fmt.Sprintf("%d version routes", len(router.Status.Routes)))
+	}
+
+	router.Status.ObservedGeneration = router.Generation
+	if err := r.Status().Update(ctx, &router); err != nil {
+		log.Error(err, "Unable to update Router status")
+		if reconcileErr == nil {
+			reconcileErr = err
+		}
+	}
+
+	return ctrl.Result{}, reconcileErr
+}
+
+// routeBackend renders version routes for one kind of reverse proxy. Applying
+// no routes removes everything the backend generated for the Router.
+type routeBackend interface {
+	apply(ctx context.Context, router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, routes []versionRoute) error
+}
+
+// backends returns the route backend for every supported provider.
+func (r *RouterReconciler) backends() map[kyaninusv1.RouterProvider]routeBackend {
+	return map[kyaninusv1.RouterProvider]routeBackend{
+		kyaninusv1.RouterProviderIngress: &ingressBackend{Client: r.Client, Scheme: r.Scheme},
+		kyaninusv1.RouterProviderTraefik: &traefikBackend{Client: r.Client, Scheme: r.Scheme},
+	}
+}
+
+// reconcileRoutes computes the version routes and hands them to the backend
+// of the Router's provider. The other backends are cleared so that switching
+// providers does not leave stale routes behind. It returns the versions the
+// provider cannot route.
+func (r *RouterReconciler) reconcileRoutes(ctx context.Context, router *kyaninusv1.Router) ([]string, error) {
+	baseIngress := &networkingv1.Ingress{}
+	baseIngressName := types.NamespacedName{Namespace: router.Namespace, Name: router.Spec.IngressRef.Name}
+	if err := r.Get(ctx, baseIngressName, baseIngress); err != nil {
+		return nil, fmt.Errorf("unable to fetch base Ingress %s: %w", baseIngressName, err)
+	}
+
+	versions, err := r.selectVersions(ctx, router)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := router.Spec.Provider
+	if provider == "" {
+		provider = kyaninusv1.RouterProviderIngress
+	}
+
+	routes := buildRoutes(router, baseIngress, versions)
+	var unrouted []string
+	pinnedIngresses := provider == kyaninusv1.RouterProviderIngress && router.Spec.Mode == kyaninusv1.RoutingModeHeader
+	if pinnedIngresses {
+		routes, unrouted = assignNginxCanaries(router, routes)
+	}
+
+	router.Status.Routes = nil
+	for _, route := range routes {
+		routeStatus := kyaninusv1.RouteStatus{Version: route.Version, Host: route.Host, Path: route.Path}
+		if route.Pin != nil {
+			routeStatus.Header = route.Pin.String()
+		}
+		routeStatus.Weight = route.Weight
+		router.Status.Routes = append(router.Status.Routes, routeStatus)
+	}
+
+	backends := r.backends()
+	if _, ok := backends[provider]; !ok {
+		return nil, fmt.Errorf("unsupported router provider %q", provider)
+	}
+	for name, backend := range backends {
+		if name == provider {
+			continue
+		}
+		if err := backend.apply(ctx, router, baseIngress, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := backends[provider].apply(ctx, router, baseIngress, routes); err != nil {
+		return nil, err
+	}
+
+	// Pinned nginx routes are spread over several canary Ingresses.
+	router.Status.IngressName = ""
+	if len(routes) > 0 && !pinnedIngresses {
+		router.Status.IngressName = router.Name
+	}
+	return unrouted, nil
+}
+
+// selectVersions lists the DeploymentVersions in the Router's namespace that
+// match its version selector.
+func (r *RouterReconciler) selectVersions(ctx context.Context, router *kyaninusv1.Router) ([]kyaninusv1.DeploymentVersion, error) {
+	selector := labels.Everything()
+	if router.Spec.VersionSelector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(router.Spec.VersionSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid versionSelector: %w", err)
+		}
+	}
+
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.List(ctx, &versions, client.InNamespace(router.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	return versions.Items, nil
+}
+
+// buildRoutes derives the routes for every routable version from the base
+// Ingress rules that send traffic to the version's base Service.
+func buildRoutes(router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, versions []kyaninusv1.DeploymentVersion) []versionRoute {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Name < versions[j].Name })
+
+	rules := baseIngress.Spec.Rules
+	if backend := baseIngress.Spec.DefaultBackend; backend != nil {
+		pathType := networkingv1.PathTypePrefix
+		rules = append(rules, networkingv1.IngressRule{
+			IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+				Paths: []networkingv1.HTTPIngressPath{{Path: "/", PathType: &pathType, Backend: *backend}},
+			}},
+		})
+	}
+
+	var routes []versionRoute
+	for i := range versions {
+		version := &versions[i]
+		if !isRoutable(version) {
+			continue
+		}
+
+		for _, rule := range rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			host := rule.Host
+			if router.Spec.Domain != "" {
+				host = router.Spec.Domain
+			}
+
+			for _, path := range rule.HTTP.Paths {
+				if path.Backend.Service == nil || path.Backend.Service.Name != version.Spec.ServiceRef.Name {
+					continue
+				}
+
+				route := versionRoute{
+					Version:  version.Name,
+					BaseHost: rule.Host,
+					Host:     host,
+					Path:     path.Path,
+					PathType: networkingv1.PathTypePrefix,
+					Service: networkingv1.IngressServiceBackend{
+						Name: version.Status.ServiceName,
+						Port: path.Backend.Service.Port,
+					},
+					BaseService: *path.Backend.Service,
+				}
+				if path.PathType != nil {
+					route.PathType = *path.PathType
+				}
+
+				asleep := version.Status.Sleep != nil && version.Status.Sleep.Asleep
+				if asleep && router.Spec.Activator != nil {
+					// The activator wakes the version and forwards the request.
+					route.Service = *router.Spec.Activator
+				}
+
+				switch router.Spec.Mode {
+				case kyaninusv1.RoutingModeHeader:
+					route.Pin = versionPin(router, version)
+					route.Weight = trafficWeight(version)
+				case kyaninusv1.RoutingModePath:
+					route.Path = "/" + version.Name + strings.TrimSuffix(path.Path, "/")
+					route.PathType = networkingv1.PathTypePrefix
+					if !asleep || router.Spec.Activator == nil {
+						// The activator finds the version from the prefix and strips it.
+						route.StripPrefix = "/" + version.Name
+					}
+				default:
+					if host == "" {
+						// A version subdomain needs a host to hang off.
+						continue
+					}
+					route.Host = version.Name + "." + host
+				}
+
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// versionPin returns the header and cookie match pinning requests to a version.
+func versionPin(router *kyaninusv1.Router, version *kyaninusv1.DeploymentVersion) *routePin {
+	pin := &routePin{Header: kyaninusv1.DefaultPinningHeader, Value: version.PinValue()}
+	if pinning := router.Spec.Pinning; pinning != nil && (pinning.Header != "" || pinning.Cookie != "") {
+		pin.Header = pinning.Header
+		pin.Cookie = pinning.Cookie
+	}
+	return pin
+}
+
+// trafficWeight returns the weight applied to a version: the current step of
+// its canary analysis when it has one, its configured traffic weight otherwise.
+func trafficWeight(version *kyaninusv1.DeploymentVersion) *int32 {
+	var weight int32
+	switch {
+	case version.Spec.Analysis != nil:
+		if version.Status.Analysis == nil {
+			return nil
+		}
+		weight = version.Status.Analysis.Weight
+	case version.Spec.Routing != nil && version.Spec.Routing.TrafficWeight != nil:
+		weight = *version.Spec.Routing.TrafficWeight
+	default:
+		return nil
+	}
+	return &weight
+}
+
+// isRoutable reports whether a DeploymentVersion is ready to receive traffic.
+func isRoutable(version *kyaninusv1.DeploymentVersion) bool {
+	return version.DeletionTimestamp.IsZero() &&
+		version.Spec.ServiceRef != nil &&
+		version.Status.ServiceName != "" &&
+		meta.IsStatusConditionTrue(version.Status.Conditions, kyaninusv1.ConditionReady)
+}
+
+func setRouterCondition(router *kyaninusv1.Router, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&router.Status.Conditions, metav1.Condition{
+		Type:               kyaninusv1.ConditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: router.Generation,
+	})
+}
+
+// routersForVersion maps a DeploymentVersion to the Routers selecting it.
+func (r *RouterReconciler) routersForVersion(obj client.Object) []reconcile.Request {
+	var routers kyaninusv1.RouterList
+	if err := r.List(context.Background(), &routers, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, router := range routers.Items {
+		selector := labels.Everything()
+		if router.Spec.VersionSelector != nil {
+			var err error
+			if selector, err = metav1.LabelSelectorAsSelector(router.Spec.VersionSelector); err != nil {
+				continue
+			}
+		}
+		if selector.Matches(labels.Set(obj.GetLabels())) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&router)})
+		}
+	}
+	return requests
+}
+
+// routersForIngress maps a base Ingress to the Routers referencing it.
+func (r *RouterReconciler) routersForIngress(obj client.Object) []reconcile.Request {
+	var routers kyaninusv1.RouterList
+	if err := r.List(context.Background(), &routers, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, router := range routers.Items {
+		if router.Spec.IngressRef.Name == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&router)})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RouterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&kyaninusv1.Router{}).
+		Owns(&networkingv1.Ingress{}).
+		Watches(&source.Kind{Type: &kyaninusv1.DeploymentVersion{}}, handler.EnqueueRequestsFromMapFunc(r.routersForVersion)).
+		Watches(&source.Kind{Type: &networkingv1.Ingress{}}, handler.EnqueueRequestsFromMapFunc(r.routersForIngress)).
+		Complete(r)
+}
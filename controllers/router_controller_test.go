@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"regexp"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+func routedVersion(name string, ready bool) kyaninusv1.DeploymentVersion {
+	status := metav1.ConditionFalse
+	if ready {
+		status = metav1.ConditionTrue
+	}
+	return kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: kyaninusv1.DeploymentVersionSpec{
+			Name:       "myapp",
+			ServiceRef: &corev1.LocalObjectReference{Name: "myapp"},
+		},
+		Status: kyaninusv1.DeploymentVersionStatus{
+			ServiceName: name,
+			Conditions:  []metav1.Condition{{Type: kyaninusv1.ConditionReady, Status: status}},
+		},
+	}
+}
+
+func baseIngress() *networkingv1.Ingress {
+	pathType := networkingv1.PathTypePrefix
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{
+				Host: "mydomain.com",
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{
+						{
+							Path:     "/",
+							PathType: &pathType,
+							Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+								Name: "myapp", Port: networkingv1.ServiceBackendPort{Number: 80},
+							}},
+						},
+						{
+							Path:     "/other",
+							PathType: &pathType,
+							Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+								Name: "other", Port: networkingv1.ServiceBackendPort{Number: 80},
+							}},
+						},
+					},
+				}},
+			}},
+			TLS: []networkingv1.IngressTLS{{Hosts: []string{"mydomain.com"}, SecretName: "wildcard"}},
+		},
+	}
+}
+
+func TestBuildRoutes(t *testing.T) {
+	versions := []kyaninusv1.DeploymentVersion{
+		routedVersion("version-2", true),
+		routedVersion("version-1", true),
+		routedVersion("not-ready", false),
+	}
+
+	tests := []struct {
+		name  string
+		mode  kyaninusv1.RoutingMode
+		hosts []string
+		paths []string
+	}{
+		{
+			name:  "host",
+			mode:  kyaninusv1.RoutingModeHost,
+			hosts: []string{"version-1.mydomain.com", "version-2.mydomain.com"},
+			paths: []string{"/", "/"},
+		},
+		{
+			name:  "path",
+			mode:  kyaninusv1.RoutingModePath,
+			hosts: []string{"mydomain.com", "mydomain.com"},
+			paths: []string{"/version-1", "/version-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{Mode: tt.mode}}
+			routes := buildRoutes(router, baseIngress(), versions)
+
+			if len(routes) != len(tt.hosts) {
+				t.Fatalf("got %d routes, want %d: %+v", len(routes), len(tt.hosts), routes)
+			}
+			for i, route := range routes {
+				if route.Host != tt.hosts[i] || route.Path != tt.paths[i] {
+					t.Errorf("route %d = %s%s, want %s%s", i, route.Host, route.Path, tt.hosts[i], tt.paths[i])
+				}
+				if route.Service.Name != route.Version || route.Service.Port.Number != 80 {
+					t.Errorf("route %d backend = %+v, want version service on port 80", i, route.Service)
+				}
+			}
+		})
+	}
+}
+
+func TestRewritePathRoutes(t *testing.T) {
+	asleep := routedVersion("version-2", true)
+	asleep.Status.Sleep = &kyaninusv1.SleepStatus{Asleep: true}
+	versions := []kyaninusv1.DeploymentVersion{routedVersion("version-1", true), asleep}
+	activator := networkingv1.IngressServiceBackend{Name: "kyaninus-activator", Port: networkingv1.ServiceBackendPort{Number: 80}}
+	router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{Mode: kyaninusv1.RoutingModePath, Activator: &activator}}
+
+	routes := rewritePathRoutes(buildRoutes(router, baseIngress(), versions))
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2: %+v", len(routes), routes)
+	}
+
+	// nginx anchors regex paths at the start and forwards the second group.
+	tests := []struct {
+		route   int
+		request string
+		want    string
+	}{
+		{route: 0, request: "/version-1", want: "/"},
+		{route: 0, request: "/version-1/cart/items", want: "/cart/items"},
+		{route: 1, request: "/version-2/cart", want: "/version-2/cart"},
+	}
+	for _, tt := range tests {
+		route := routes[tt.route]
+		if route.PathType != networkingv1.PathTypeImplementationSpecific {
+			t.Errorf("route %s path type = %s, want ImplementationSpecific", route.Version, route.PathType)
+		}
+		match := regexp.MustCompile("^" + route.Path).FindStringSubmatch(tt.request)
+		if len(match) != 3 {
+			t.Errorf("route %s path %q does not match %s", route.Version, route.Path, tt.request)
+			continue
+		}
+		if got := "/" + match[2]; got != tt.want {
+			t.Errorf("route %s rewrites %s to %s, want %s", route.Version, tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestRenderIngressSpecHostTLS(t *testing.T) {
+	router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{Mode: kyaninusv1.RoutingModeHost}}
+	base := baseIngress()
+	routes := buildRoutes(router, base, []kyaninusv1.DeploymentVersion{routedVersion("version-1", true)})
+
+	spec := renderIngressSpec(base, routes)
+
+	if len(spec.Rules) != 1 || spec.Rules[0].Host != "version-1.mydomain.com" {
+		t.Fatalf("unexpected rules %+v", spec.Rules)
+	}
+	if len(spec.TLS) != 1 || spec.TLS[0].SecretName != "wildcard" || spec.TLS[0].Hosts[0] != "version-1.mydomain.com" {
+		t.Fatalf("unexpected tls %+v", spec.TLS)
+	}
+}
+
+func TestHeaderRoutes(t *testing.T) {
+	pinned := routedVersion("version-1", true)
+	pinned.Spec.Routing = &kyaninusv1.VersionRouting{PinValue: "feature-123"}
+
+	router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{
+		Mode:    kyaninusv1.RoutingModeHeader,
+		Pinning: &kyaninusv1.VersionPinning{Header: "X-Version", Cookie: "version"},
+	}}
+	routes := buildRoutes(router, baseIngress(), []kyaninusv1.DeploymentVersion{pinned})
+
+	if len(routes) != 1 || routes[0].Host != "mydomain.com" || routes[0].Path != "/" {
+		t.Fatalf("header routes should keep the base host and path, got %+v", routes)
+	}
+
+	annotations := canaryAnnotations(routes[:1])
+	want := map[string]string{
+		nginxCanaryAnnotation:              "true",
+		nginxCanaryByHeaderAnnotation:      "X-Version",
+		nginxCanaryByHeaderValueAnnotation: "feature-123",
+		nginxCanaryByCookieAnnotation:      "version-feature-123",
+	}
+	for k, v := range want {
+		if annotations[k] != v {
+			t.Errorf("annotation %s = %q, want %q", k, annotations[k], v)
+		}
+	}
+
+	match := traefikPinMatcher(routes[0].Pin)
+	wantMatch := "(Headers(`X-Version`, `feature-123`) || HeadersRegexp(`Cookie`, `(^|;\\s*)version=feature-123(;|$)`))"
+	if match != wantMatch {
+		t.Errorf("traefik matcher = %s, want %s", match, wantMatch)
+	}
+}
+
+func TestHeaderRoutesDefaultPin(t *testing.T) {
+	router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{Mode: kyaninusv1.RoutingModeHeader}}
+	routes := buildRoutes(router, baseIngress(), []kyaninusv1.DeploymentVersion{routedVersion("version-1", true)})
+
+	if len(routes) != 1 || routes[0].Pin.String() != "X-Version=version-1" {
+		t.Fatalf("expected the version name pinned by X-Version, got %+v", routes)
+	}
+}
+
+func TestWeightedRoutes(t *testing.T) {
+	weight := int32(25)
+	weighted := routedVersion("version-1", true)
+	weighted.Spec.Routing = &kyaninusv1.VersionRouting{TrafficWeight: &weight}
+
+	router := &kyaninusv1.Router{Spec: kyaninusv1.RouterSpec{Mode: kyaninusv1.RoutingModeHeader}}
+	routes := buildRoutes(router, baseIngress(), []kyaninusv1.DeploymentVersion{weighted})
+
+	if len(routes) != 1 || routes[0].Weight == nil || *routes[0].Weight != 25 {
+		t.Fatalf("expected a route weighted at 25, got %+v", routes)
+	}
+
+	if got := canaryAnnotations(routes[:1])[nginxCanaryWeightAnnotation]; got != "25" {
+		t.Errorf("canary-weight = %q, want 25", got)
+	}
+
+	rules := traefikWeightedRules(routes)
+	if len(rules) != 1 {
+		t.Fatalf("expected one weighted traefik rule, got %d", len(rules))
+	}
+	services := rules[0].(map[string]interface{})["services"].([]interface{})
+	want := []struct {
+		name   string
+		weight int64
+	}{{"myapp", 75}, {"version-1", 25}}
+	if len(services) != len(want) {
+		t.Fatalf("got %d weighted services, want %d", len(services), len(want))
+	}
+	for i, w := range want {
+		service := services[i].(map[string]interface{})
+		if service["name"] != w.name || service["weight"] != w.weight {
+			t.Errorf("service %d = %v, want %s weighted %d", i, service, w.name, w.weight)
+		}
+	}
+}
+
+func TestHeaderRoutesSharingHostAndPath(t *testing.T) {
+	weight := int32(25)
+	pinned := routedVersion("version-1", true)
+	pinned.Spec.Routing = &kyaninusv1.VersionRouting{PinValue: "feature.123", TrafficWeight: &weight}
+	versions := []kyaninusv1.DeploymentVersion{pinned, routedVersion("version-2", true)}
+	activator := networkingv1.IngressServiceBackend{Name: "kyaninus-activator", Port: networkingv1.ServiceBackendPort{Number: 80}}
+
+	router := &kyaninusv1.Router{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp"},
+		Spec:       kyaninusv1.RouterSpec{Mode: kyaninusv1.RoutingModeHeader, Activator: &activator},
+	}
+	routes, unrouted := assignNginxCanaries(router, buildRoutes(router, baseIngress(), versions))
+	if len(unrouted) != 0 || len(routes) != 2 {
+		t.Fatalf("expected both versions routed, got %+v, unrouted %v", routes, unrouted)
+	}
+	for _, route := range routes {
+		if route.Canary != "myapp-pinned" || route.Service.Name != "kyaninus-activator" || route.Weight != nil {
+			t.Errorf("expected an unweighted route through the shared canary to the activator, got %+v", route)
+		}
+	}
+	annotations := canaryAnnotations(routes)
+	if got := annotations[nginxCanaryByHeaderPatternAnnotation]; got != `^(feature\.123|version-2)$` {
+		t.Errorf("canary-by-header-pattern = %q", got)
+	}
+	if _, ok := annotations[nginxCanaryByHeaderValueAnnotation]; ok {
+		t.Error("a shared canary must not match a single header value")
+	}
+	if spec := renderIngressSpec(baseIngress(), routes); len(spec.Rules) != 1 || len(spec.Rules[0].HTTP.Paths) != 1 {
+		t.Errorf("expected a single path to the activator, got %+v", spec.Rules)
+	}
+
+	router.Spec.Activator = nil
+	routes, unrouted = assignNginxCanaries(router, buildRoutes(router, baseIngress(), versions))
+	if len(routes) != 1 || routes[0].Version != "version-1" || routes[0].Canary != "myapp-version-1" {
+		t.Errorf("expected only the first version routed without an activator, got %+v", routes)
+	}
+	if len(unrouted) != 1 || unrouted[0] != "version-2" {
+		t.Errorf("unrouted = %v, want version-2 reported", unrouted)
+	}
+}
@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// ingressBackend renders version routes into networking.k8s.io Ingresses.
+// Host and Path routes share one Ingress named after the Router, where Path
+// routes are rewritten by nginx to strip their version prefix. Header routes
+// become the nginx canary Ingresses assigned by assignNginxCanaries.
+type ingressBackend struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// nginx-ingress canary annotations.
+const (
+	nginxCanaryAnnotation                = "nginx.ingress.kubernetes.io/canary"
+	nginxCanaryByHeaderAnnotation        = "nginx.ingress.kubernetes.io/canary-by-header"
+	nginxCanaryByHeaderValueAnnotation   = "nginx.ingress.kubernetes.io/canary-by-header-value"
+	nginxCanaryByHeaderPatternAnnotation = "nginx.ingress.kubernetes.io/canary-by-header-pattern"
+	nginxCanaryByCookieAnnotation        = "nginx.ingress.kubernetes.io/canary-by-cookie"
+	nginxCanaryWeightAnnotation          = "nginx.ingress.kubernetes.io/canary-weight"
+)
+
+// nginx-ingress rewrite annotations, stripping the version prefix of Path
+// mode routes.
+const (
+	nginxUseRegexAnnotation      = "nginx.ingress.kubernetes.io/use-regex"
+	nginxRewriteTargetAnnotation = "nginx.ingress.kubernetes.io/rewrite-target"
+)
+
+// apply creates, updates or removes the Ingresses generated for the Router so
+// that together they hold exactly the given routes.
+func (b *ingressBackend) apply(ctx context.Context, router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, routes []versionRoute) error {
+	log := log.FromContext(ctx)
+
+	desired := map[string][]versionRoute{}
+	for _, route := range routes {
+		name := router.Name
+		if route.Canary != "" {
+			name = route.Canary
+		}
+		desired[name] = append(desired[name], route)
+	}
+
+	var existing networkingv1.IngressList
+	if err := b.List(ctx, &existing, client.InNamespace(router.Namespace), client.MatchingLabels{routerLabel: router.Name}); err != nil {
+		return err
+	}
+	for i := range existing.Items {
+		ingress := &existing.Items[i]
+		if _, ok := desired[ingress.Name]; ok || !metav1.IsControlledBy(ingress, router) {
+			continue
+		}
+		log.Info(fmt.Sprintf("%s %s", "Removing ingress for router", ingress.Name))
+		if err := b.Delete(ctx, ingress); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ingressRoutes := desired[name]
+		ingress := &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: router.Namespace},
+		}
+
+		_, err := controllerutil.CreateOrUpdate(ctx, b.Client, ingress, func() error {
+			if ingress.ResourceVersion != "" && !metav1.IsControlledBy(ingress, router) {
+				return fmt.Errorf("ingress %s already exists and is not owned by Router %s", name, router.Name)
+			}
+
+			ingress.Labels = map[string]string{}
+			for k, v := range baseIngress.Labels {
+				ingress.Labels[k] = v
+			}
+			ingress.Labels[routerLabel] = router.Name
+
+			ingress.Annotations = map[string]string{}
+			for k, v := range baseIngress.Annotations {
+				ingress.Annotations[k] = v
+			}
+			rendered := ingressRoutes
+			switch {
+			case ingressRoutes[0].Canary != "":
+				for k, v := range canaryAnnotations(ingressRoutes) {
+					ingress.Annotations[k] = v
+				}
+			case router.Spec.Mode == kyaninusv1.RoutingModePath:
+				rendered = rewritePathRoutes(ingressRoutes)
+				ingress.Annotations[nginxUseRegexAnnotation] = "true"
+				ingress.Annotations[nginxRewriteTargetAnnotation] = "/$2"
+			}
+
+			ingress.Spec = renderIngressSpec(baseIngress, rendered)
+			return ctrl.SetControllerReference(router, ingress, b.Scheme)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignNginxCanaries assigns Header mode routes to nginx canary Ingresses.
+// nginx applies a single canary Ingress per host and path, so a version alone
+// on a host and path gets a canary Ingress of its own, sending its pinned and
+// weighted requests to its Service. Versions sharing a host and path are
+// pinned together by a canary Ingress matching all of their pin values, which
+// sends the requests to the activator to be forwarded to their version, and
+// their weights are not applied. Without an activator, or without a pinning
+// header, only the first of them is routed and the others are returned.
+func assignNginxCanaries(router *kyaninusv1.Router, routes []versionRoute) ([]versionRoute, []string) {
+	type hostPath struct{ host, path string }
+	versions := map[hostPath][]string{}
+	for _, route := range routes {
+		key := hostPath{route.Host, route.Path}
+		if names := versions[key]; len(names) == 0 || names[len(names)-1] != route.Version {
+			versions[key] = append(names, route.Version)
+		}
+	}
+
+	shared := map[string]bool{}
+	for _, names := range versions {
+		if len(names) > 1 {
+			shared[strings.Join(names, ",")] = true
+		}
+	}
+	groups := make([]string, 0, len(shared))
+	for group := range shared {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	sharedCanary := func(group string) string {
+		if len(groups) == 1 {
+			return router.Name + "-pinned"
+		}
+		return fmt.Sprintf("%s-pinned-%d", router.Name, sort.SearchStrings(groups, group)+1)
+	}
+
+	var assigned []versionRoute
+	var unrouted []string
+	for _, route := range routes {
+		names := versions[hostPath{route.Host, route.Path}]
+		switch {
+		case len(names) == 1:
+			route.Canary = router.Name + "-" + route.Version
+		case router.Spec.Activator != nil && route.Pin.Header != "":
+			route.Canary = sharedCanary(strings.Join(names, ","))
+			route.Service = *router.Spec.Activator
+			route.Weight = nil
+		case names[0] == route.Version:
+			route.Canary = router.Name + "-" + route.Version
+		default:
+			if len(unrouted) == 0 || unrouted[len(unrouted)-1] != route.Version {
+				unrouted = append(unrouted, route.Version)
+			}
+			continue
+		}
+		assigned = append(assigned, route)
+	}
+	return assigned, unrouted
+}
+
+// canaryAnnotations renders the pins and weight of the routes of a canary
+// Ingress as nginx-ingress canary annotations. The routes of a single version
+// match its header value and cookie, the routes of several versions match
+// their header values through a pattern.
+func canaryAnnotations(routes []versionRoute) map[string]string {
+	annotations := map[string]string{nginxCanaryAnnotation: "true"}
+
+	var values []string
+	for _, route := range routes {
+		if len(values) == 0 || values[len(values)-1] != route.Pin.Value {
+			values = append(values, route.Pin.Value)
+		}
+	}
+	pin := routes[0].Pin
+	if len(values) > 1 {
+		sort.Strings(values)
+		for i, value := range values {
+			values[i] = regexp.QuoteMeta(value)
+		}
+		annotations[nginxCanaryByHeaderAnnotation] = pin.Header
+		annotations[nginxCanaryByHeaderPatternAnnotation] = "^(" + strings.Join(values, "|") + ")$"
+		return annotations
+	}
+
+	if route := routes[0]; route.Weight != nil {
+		annotations[nginxCanaryWeightAnnotation] = strconv.Itoa(int(*route.Weight))
+	}
+	if pin.Header != "" {
+		annotations[nginxCanaryByHeaderAnnotation] = pin.Header
+		annotations[nginxCanaryByHeaderValueAnnotation] = pin.Value
+	}
+	if pin.Cookie != "" {
+		annotations[nginxCanaryByCookieAnnotation] = pin.Cookie + "-" + pin.Value
+	}
+	return annotations
+}
+
+// rewritePathRoutes turns Path mode routes into nginx regex paths whose second
+// capture group is the path forwarded by the rewrite-target annotation. Routes
+// with a StripPrefix forward the path without it, the others, such as routes
+// of sleeping versions to the activator, forward the whole path.
+func rewritePathRoutes(routes []versionRoute) []versionRoute {
+	rewritten := make([]versionRoute, 0, len(routes))
+	for _, route := range routes {
+		if route.StripPrefix != "" {
+			rest := strings.TrimPrefix(strings.TrimPrefix(route.Path, route.StripPrefix), "/")
+			route.Path = regexp.QuoteMeta(route.StripPrefix) + "(/|$)(" + regexp.QuoteMeta(rest) + ".*)"
+		} else {
+			route.Path = "/()(" + regexp.QuoteMeta(strings.TrimPrefix(route.Path, "/")) + ".*)"
+		}
+		route.PathType = networkingv1.PathTypeImplementationSpecific
+		rewritten = append(rewritten, route)
+	}
+	return rewritten
+}
+
+// renderIngressSpec renders routes into Ingress rules grouped by host, keeping
+// the ingress class and TLS settings of the base Ingress.
+func renderIngressSpec(baseIngress *networkingv1.Ingress, routes []versionRoute) networkingv1.IngressSpec {
+	spec := networkingv1.IngressSpec{IngressClassName: baseIngress.Spec.IngressClassName}
+
+	ruleIndex := map[string]int{}
+	baseHosts := map[string][]string{}
+	for _, route := range routes {
+		i, ok := ruleIndex[route.Host]
+		if !ok {
+			i = len(spec.Rules)
+			ruleIndex[route.Host] = i
+			spec.Rules = append(spec.Rules, networkingv1.IngressRule{
+				Host:             route.Host,
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{}},
+			})
+			baseHosts[route.BaseHost] = append(baseHosts[route.BaseHost], route.Host)
+		}
+
+		if containsIngressPath(spec.Rules[i].HTTP.Paths, route.Path) {
+			// Versions pinned together share the route to the activator.
+			continue
+		}
+		pathType := route.PathType
+		service := route.Service
+		spec.Rules[i].HTTP.Paths = append(spec.Rules[i].HTTP.Paths, networkingv1.HTTPIngressPath{
+			Path:     route.Path,
+			PathType: &pathType,
+			Backend:  networkingv1.IngressBackend{Service: &service},
+		})
+	}
+
+	for _, tls := range baseIngress.Spec.TLS {
+		var hosts []string
+		for _, host := range tls.Hosts {
+			hosts = append(hosts, baseHosts[host]...)
+		}
+		if len(hosts) > 0 {
+			spec.TLS = append(spec.TLS, networkingv1.IngressTLS{Hosts: hosts, SecretName: tls.SecretName})
+		}
+	}
+
+	return spec
+}
+
+func containsIngressPath(paths []networkingv1.HTTPIngressPath, path string) bool {
+	for _, p := range paths {
+		if p.Path == path {
+			return true
+		}
+	}
+	return false
+}
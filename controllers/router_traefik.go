@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+var (
+	traefikIngressRouteGVK = schema.GroupVersionKind{Group: "traefik.containo.us", Version: "v1alpha1", Kind: "IngressRoute"}
+	traefikMiddlewareGVK   = schema.GroupVersionKind{Group: "traefik.containo.us", Version: "v1alpha1", Kind: "Middleware"}
+)
+
+const (
+	// routerLabel marks the objects generated for a Router.
+	routerLabel = "kyaninus.codepraxis.com/router"
+	// traefikEntryPointsAnnotation lists the Traefik entry points of an Ingress.
+	traefikEntryPointsAnnotation = "traefik.ingress.kubernetes.io/router.entrypoints"
+)
+
+// traefikBackend renders version routes into a Traefik IngressRoute named
+// after the Router, plus a StripPrefix Middleware per path routed version.
+// Traefik objects are handled as unstructured so no Traefik Go module is needed.
+type traefikBackend struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=traefik.containo.us,resources=ingressroutes;middlewares,verbs=get;list;watch;create;update;patch;delete
+
+// apply writes the IngressRoute and Middlewares for the routes and removes any
+// that are no longer wanted. When the Traefik CRDs are not installed there is
+// nothing to clean up, so a missing kind only fails when routes are requested.
+func (b *traefikBackend) apply(ctx context.Context, router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, routes []versionRoute) error {
+	err := b.applyRoutes(ctx, router, baseIngress, routes)
+	if len(routes) == 0 && meta.IsNoMatchError(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *traefikBackend) applyRoutes(ctx context.Context, router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, routes []versionRoute) error {
+	log := log.FromContext(ctx)
+
+	middlewares := map[string]string{}
+	for _, route := range routes {
+		if route.StripPrefix != "" {
+			middlewares[traefikMiddlewareName(router, route.Version)] = route.StripPrefix
+		}
+	}
+
+	var existing unstructured.UnstructuredList
+	existing.SetGroupVersionKind(traefikMiddlewareGVK.GroupVersion().WithKind(traefikMiddlewareGVK.Kind + "List"))
+	if err := b.List(ctx, &existing, client.InNamespace(router.Namespace), client.MatchingLabels{routerLabel: router.Name}); err != nil {
+		return err
+	}
+	for i := range existing.Items {
+		middleware := &existing.Items[i]
+		if _, ok := middlewares[middleware.GetName()]; ok || !metav1.IsControlledBy(middleware, router) {
+			continue
+		}
+		log.Info(fmt.Sprintf("%s %s", "Removing middleware for router", middleware.GetName()))
+		if err := b.Delete(ctx, middleware); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	for name, prefix := range middlewares {
+		middleware := &unstructured.Unstructured{}
+		middleware.SetGroupVersionKind(traefikMiddlewareGVK)
+		middleware.SetName(name)
+		middleware.SetNamespace(router.Namespace)
+
+		_, err := controllerutil.CreateOrUpdate(ctx, b.Client, middleware, func() error {
+			middleware.SetLabels(map[string]string{routerLabel: router.Name})
+			middleware.Object["spec"] = map[string]interface{}{
+				"stripPrefix": map[string]interface{}{
+					"prefixes": []interface{}{prefix},
+				},
+			}
+			return ctrl.SetControllerReference(router, middleware, b.Scheme)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	ingressRoute := &unstructured.Unstructured{}
+	ingressRoute.SetGroupVersionKind(traefikIngressRouteGVK)
+	ingressRoute.SetName(router.Name)
+	ingressRoute.SetNamespace(router.Namespace)
+
+	if len(routes) == 0 {
+		if err := b.Get(ctx, client.ObjectKeyFromObject(ingressRoute), ingressRoute); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if !metav1.IsControlledBy(ingressRoute, router) {
+			return nil
+		}
+		log.Info(fmt.Sprintf("%s %s", "Removing ingressroute for router", router.Name))
+		return client.IgnoreNotFound(b.Delete(ctx, ingressRoute))
+	}
+
+	_, err := controllerutil.CreateOrUpdate(ctx, b.Client, ingressRoute, func() error {
+		if ingressRoute.GetResourceVersion() != "" && !metav1.IsControlledBy(ingressRoute, router) {
+			return apierrors.NewAlreadyExists(schema.GroupResource{Group: traefikIngressRouteGVK.Group, Resource: "ingressroutes"}, router.Name)
+		}
+		ingressRoute.SetLabels(map[string]string{routerLabel: router.Name})
+		ingressRoute.Object["spec"] = renderIngressRouteSpec(router, baseIngress, routes)
+		return ctrl.SetControllerReference(router, ingressRoute, b.Scheme)
+	})
+	return err
+}
+
+// renderIngressRouteSpec renders routes into the spec of a Traefik IngressRoute.
+func renderIngressRouteSpec(router *kyaninusv1.Router, baseIngress *networkingv1.Ingress, routes []versionRoute) map[string]interface{} {
+	var rules []interface{}
+	for _, route := range routes {
+		match := traefikRouteMatcher(route)
+		if route.Pin != nil {
+			match += " && " + traefikPinMatcher(route.Pin)
+		}
+
+		rule := map[string]interface{}{
+			"kind":     "Rule",
+			"match":    match,
+			"services": []interface{}{traefikService(route.Service, nil)},
+		}
+		if route.StripPrefix != "" {
+			rule["middlewares"] = []interface{}{
+				map[string]interface{}{"name": traefikMiddlewareName(router, route.Version)},
+			}
+		}
+		rules = append(rules, rule)
+	}
+	rules = append(rules, traefikWeightedRules(routes)...)
+
+	spec := map[string]interface{}{"routes": rules}
+
+	if entryPoints := baseIngress.Annotations[traefikEntryPointsAnnotation]; entryPoints != "" {
+		var names []interface{}
+		for _, name := range strings.Split(entryPoints, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+		spec["entryPoints"] = names
+	}
+	if len(baseIngress.Spec.TLS) > 0 {
+		spec["tls"] = map[string]interface{}{"secretName": baseIngress.Spec.TLS[0].SecretName}
+	}
+
+	return spec
+}
+
+// traefikRouteMatcher matches the host and path of a route.
+func traefikRouteMatcher(route versionRoute) string {
+	var matchers []string
+	if route.Host != "" {
+		matchers = append(matchers, fmt.Sprintf("Host(`%s`)", route.Host))
+	}
+	path := route.Path
+	if path == "" {
+		path = "/"
+	}
+	if route.PathType == networkingv1.PathTypeExact {
+		matchers = append(matchers, fmt.Sprintf("Path(`%s`)", path))
+	} else {
+		matchers = append(matchers, fmt.Sprintf("PathPrefix(`%s`)", path))
+	}
+	return strings.Join(matchers, " && ")
+}
+
+// traefikWeightedRules splits the unpinned requests of each host and path
+// between the base Service and the weighted versions routed on it. The rules
+// get a priority just above the one Traefik gives the base Ingress route for
+// the same match, and below the longer pinned rules.
+func traefikWeightedRules(routes []versionRoute) []interface{} {
+	var matches []string
+	weighted := map[string][]versionRoute{}
+	for _, route := range routes {
+		if route.Weight == nil {
+			continue
+		}
+		match := traefikRouteMatcher(route)
+		if _, ok := weighted[match]; !ok {
+			matches = append(matches, match)
+		}
+		weighted[match] = append(weighted[match], route)
+	}
+
+	var rules []interface{}
+	for _, match := range matches {
+		baseWeight := int32(100)
+		var services []interface{}
+		for _, route := range weighted[match] {
+			weight := *route.Weight
+			baseWeight -= weight
+			services = append(services, traefikService(route.Service, &weight))
+		}
+		if baseWeight < 0 {
+			baseWeight = 0
+		}
+		services = append([]interface{}{traefikService(weighted[match][0].BaseService, &baseWeight)}, services...)
+
+		rules = append(rules, map[string]interface{}{
+			"kind":     "Rule",
+			"match":    match,
+			"priority": int64(len(match) + 1),
+			"services": services,
+		})
+	}
+	return rules
+}
+
+// traefikService renders a Service backend of an IngressRoute rule.
+func traefikService(backend networkingv1.IngressServiceBackend, weight *int32) map[string]interface{} {
+	service := map[string]interface{}{"name": backend.Name}
+	if backend.Port.Number != 0 {
+		service["port"] = int64(backend.Port.Number)
+	} else {
+		service["port"] = backend.Port.Name
+	}
+	if weight != nil {
+		service["weight"] = int64(*weight)
+	}
+	return service
+}
+
+// traefikPinMatcher matches requests carrying the pinned header or cookie value.
+func traefikPinMatcher(pin *routePin) string {
+	var matchers []string
+	if pin.Header != "" {
+		matchers = append(matchers, fmt.Sprintf("Headers(`%s`, `%s`)", pin.Header, pin.Value))
+	}
+	if pin.Cookie != "" {
+		matchers = append(matchers, fmt.Sprintf("HeadersRegexp(`Cookie`, `(^|;\\s*)%s=%s(;|$)`)",
+			regexp.QuoteMeta(pin.Cookie), regexp.QuoteMeta(pin.Value)))
+	}
+	if len(matchers) == 1 {
+		return matchers[0]
+	}
+	return "(" + strings.Join(matchers, " || ") + ")"
+}
+
+// traefikMiddlewareName is the name of the StripPrefix Middleware generated
+// for a path routed version.
+func traefikMiddlewareName(router *kyaninusv1.Router, version string) string {
+	return router.Name + "-" + version + "-strip"
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+var _ = Describe("Router Traefik backend", func() {
+
+	const (
+		RouterNamespace = "default"
+
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+	)
+
+	getTraefikObject := func(ctx context.Context, kind, name string) (*unstructured.Unstructured, error) {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(traefikIngressRouteGVK.GroupVersion().WithKind(kind))
+		err := k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: RouterNamespace}, obj)
+		return obj, err
+	}
+
+	Context("When applying routes for a Traefik Router", func() {
+		It("Should write an IngressRoute and StripPrefix middlewares for each version", func() {
+			ctx := context.Background()
+
+			By("By creating a Router")
+			// The base Ingress is never created, so the Router controller
+			// leaves the Traefik objects to the backend under test.
+			router := &kyaninusv1.Router{
+				ObjectMeta: metav1.ObjectMeta{Name: "traefik-router", Namespace: RouterNamespace},
+				Spec: kyaninusv1.RouterSpec{
+					IngressRef: corev1.LocalObjectReference{Name: "traefik-missing-ingress"},
+					Mode:       kyaninusv1.RoutingModePath,
+					Provider:   kyaninusv1.RouterProviderTraefik,
+				},
+			}
+			Expect(k8sClient.Create(ctx, router)).Should(Succeed())
+
+			backend := &traefikBackend{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			ingress := baseIngress()
+			versions := []kyaninusv1.DeploymentVersion{routedVersion("version-1", true), routedVersion("version-2", true)}
+
+			By("By applying path routes for two versions")
+			Expect(backend.apply(ctx, router, ingress, buildRoutes(router, ingress, versions))).Should(Succeed())
+
+			ingressRoute, err := getTraefikObject(ctx, "IngressRoute", "traefik-router")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metav1.IsControlledBy(ingressRoute, router)).Should(BeTrue())
+
+			rules, _, _ := unstructured.NestedSlice(ingressRoute.Object, "spec", "routes")
+			Expect(rules).Should(HaveLen(2))
+			Expect(rules[0].(map[string]interface{})["match"]).Should(Equal("Host(`mydomain.com`) && PathPrefix(`/version-1`)"))
+
+			middleware, err := getTraefikObject(ctx, "Middleware", "traefik-router-version-2-strip")
+			Expect(err).NotTo(HaveOccurred())
+			prefixes, _, _ := unstructured.NestedStringSlice(middleware.Object, "spec", "stripPrefix", "prefixes")
+			Expect(prefixes).Should(Equal([]string{"/version-2"}))
+
+			By("By removing a version")
+			Expect(backend.apply(ctx, router, ingress, buildRoutes(router, ingress, versions[:1]))).Should(Succeed())
+			Eventually(func() bool {
+				_, err := getTraefikObject(ctx, "Middleware", "traefik-router-version-2-strip")
+				return err != nil
+			}, timeout, interval).Should(BeTrue())
+
+			By("By removing every version")
+			Expect(backend.apply(ctx, router, ingress, nil)).Should(Succeed())
+			Eventually(func() bool {
+				_, err := getTraefikObject(ctx, "IngressRoute", "traefik-router")
+				return err != nil
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When applying routes for a Traefik Router in Host mode", func() {
+		It("Should match the host of each version and keep the TLS of the base Ingress", func() {
+			ctx := context.Background()
+
+			By("By creating a Router")
+			router := &kyaninusv1.Router{
+				ObjectMeta: metav1.ObjectMeta{Name: "traefik-host-router", Namespace: RouterNamespace},
+				Spec: kyaninusv1.RouterSpec{
+					IngressRef: corev1.LocalObjectReference{Name: "traefik-missing-ingress"},
+					Mode:       kyaninusv1.RoutingModeHost,
+					Provider:   kyaninusv1.RouterProviderTraefik,
+				},
+			}
+			Expect(k8sClient.Create(ctx, router)).Should(Succeed())
+
+			backend := &traefikBackend{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			ingress := baseIngress()
+			versions := []kyaninusv1.DeploymentVersion{routedVersion("version-1", true), routedVersion("version-2", true)}
+
+			By("By applying host routes for two versions")
+			Expect(backend.apply(ctx, router, ingress, buildRoutes(router, ingress, versions))).Should(Succeed())
+
+			ingressRoute, err := getTraefikObject(ctx, "IngressRoute", "traefik-host-router")
+			Expect(err).NotTo(HaveOccurred())
+
+			rules, _, _ := unstructured.NestedSlice(ingressRoute.Object, "spec", "routes")
+			Expect(rules).Should(HaveLen(2))
+			Expect(rules[0].(map[string]interface{})["match"]).Should(Equal("Host(`version-1.mydomain.com`) && PathPrefix(`/`)"))
+			Expect(rules[1].(map[string]interface{})["match"]).Should(Equal("Host(`version-2.mydomain.com`) && PathPrefix(`/`)"))
+			Expect(rules[0].(map[string]interface{})).ShouldNot(HaveKey("middlewares"))
+
+			secretName, _, _ := unstructured.NestedString(ingressRoute.Object, "spec", "tls", "secretName")
+			Expect(secretName).Should(Equal("wildcard"))
+
+			_, err = getTraefikObject(ctx, "Middleware", "traefik-host-router-version-1-strip")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -18,11 +18,16 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
@@ -58,8 +63,16 @@ var _ = BeforeSuite(func() {
 
 	ctx, cancel = context.WithCancel(context.TODO())
 
+	// Install the CRDs as the config/crd kustomization renders them, so that
+	// versions are validated against the schemas users install.
+	crds, err := kustomizedCRDs(filepath.Join("..", "config", "crd"))
+	Expect(err).NotTo(HaveOccurred())
+
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDs: crds,
+		CRDDirectoryPaths: []string{
+			filepath.Join("testdata", "traefik"),
+		},
 		ErrorIfCRDPathMissing: true,
 	}
 
@@ -82,6 +95,19 @@ var _ = BeforeSuite(func() {
 	Expect(err).ToNot(HaveOccurred())
 
 	err = (&DeploymentVersionReconciler{
+		Client:   k8sManager.GetClient(),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("deploymentversion-controller"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&RouterReconciler{
+		Client: k8sManager.GetClient(),
+		Scheme: k8sManager.GetScheme(),
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&VersionGeneratorReconciler{
 		Client: k8sManager.GetClient(),
 		Scheme: k8sManager.GetScheme(),
 	}).SetupWithManager(k8sManager)
@@ -95,6 +121,68 @@ var _ = BeforeSuite(func() {
 
 }, 60)
 
+// kustomizedCRDs reads the CRD resources of the kustomization in dir with its
+// JSON 6902 patches applied.
+func kustomizedCRDs(dir string) ([]apiextensionsv1.CustomResourceDefinition, error) {
+	var kustomization struct {
+		Resources       []string `json:"resources"`
+		PatchesJson6902 []struct {
+			Target struct {
+				Name string `json:"name"`
+			} `json:"target"`
+			Path string `json:"path"`
+		} `json:"patchesJson6902"`
+	}
+	if err := readYAML(filepath.Join(dir, "kustomization.yaml"), &kustomization); err != nil {
+		return nil, err
+	}
+
+	var crds []apiextensionsv1.CustomResourceDefinition
+	for _, resource := range kustomization.Resources {
+		var doc json.RawMessage
+		if err := readYAML(filepath.Join(dir, resource), &doc); err != nil {
+			return nil, err
+		}
+		var crd apiextensionsv1.CustomResourceDefinition
+		if err := json.Unmarshal(doc, &crd); err != nil {
+			return nil, err
+		}
+		for _, patch := range kustomization.PatchesJson6902 {
+			if patch.Target.Name != crd.Name {
+				continue
+			}
+			var ops jsonpatch.Patch
+			if err := readYAML(filepath.Join(dir, patch.Path), &ops); err != nil {
+				return nil, err
+			}
+			patched, err := ops.Apply(doc)
+			if err != nil {
+				return nil, err
+			}
+			doc = patched
+		}
+		crd = apiextensionsv1.CustomResourceDefinition{}
+		if err := json.Unmarshal(doc, &crd); err != nil {
+			return nil, err
+		}
+		crds = append(crds, crd)
+	}
+	return crds, nil
+}
+
+// readYAML decodes the YAML file at path into out.
+func readYAML(path string, out interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err = yaml.ToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
 var _ = AfterSuite(func() {
 	cancel()
 	By("tearing down the test environment")
@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// generatorSpecAnnotation records the hash of the spec a VersionGenerator last
+// wrote onto a DeploymentVersion, so fields defaulted by the webhook are not
+// fought over on every poll.
+const generatorSpecAnnotation = "kyaninus.codepraxis.com/generator-spec"
+
+// VersionGeneratorReconciler reconciles a VersionGenerator object
+type VersionGeneratorReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to call the Git provider APIs. It defaults to a
+	// client timing out after gitProviderTimeout.
+	HTTPClient *http.Client
+}
+
+// imageData is given to the image template of a VersionGenerator.
+type imageData struct {
+	// Branch is the branch name with the characters not allowed in image
+	// tags replaced by dashes.
+	Branch    string
+	RawBranch string
+	SHA       string
+	ShortSHA  string
+	Number    int
+}
+
+var (
+	invalidTagChars   = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=versiongenerators,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=versiongenerators/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kyaninus.codepraxis.com,resources=versiongenerators/finalizers,verbs=update
+
+// Reconcile polls the Git provider of a VersionGenerator and keeps one
+// DeploymentVersion per matching branch or open pull request. Versions whose
+// branch is gone or whose pull request was closed are deleted.
+func (r *VersionGeneratorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var generator kyaninusv1.VersionGenerator
+	if err := r.Get(ctx, req.NamespacedName, &generator); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "Unable to fetch VersionGenerator")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	reconcileErr := r.reconcileVersions(ctx, &generator)
+	if reconcileErr != nil {
+		log.Error(reconcileErr, "Error generating versions")
+		setGeneratorCondition(&generator, metav1.ConditionFalse, "GenerateFailed", reconcileErr.Error())
+	} else {
+		setGeneratorCondition(&generator, metav1.ConditionTrue, "Generated", fmt.Sprintf("%d versions", len(generator.Status.Versions)))
+	}
+
+	generator.Status.ObservedGeneration = generator.Generation
+	if err := r.Status().Update(ctx, &generator); err != nil {
+		log.Error(err, "Unable to update VersionGenerator status")
+		if reconcileErr == nil {
+			reconcileErr = err
+		}
+	}
+
+	interval := generator.Spec.Interval.Duration
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return ctrl.Result{RequeueAfter: interval}, reconcileErr
+}
+
+// reconcileVersions lists the branches or pull requests of the repository,
+// creates or updates a version for each match and deletes the versions of
+// those no longer listed. Nothing is deleted when the provider cannot be
+// polled.
+func (r *VersionGeneratorReconciler) reconcileVersions(ctx context.Context, generator *kyaninusv1.VersionGenerator) error {
+	log := log.FromContext(ctx)
+	spec := generator.Spec
+
+	render, err := newVersionRenderer(generator)
+	if err != nil {
+		return err
+	}
+	if spec.Provider.Type == kyaninusv1.GitProviderGitea && spec.Provider.URL == "" {
+		return fmt.Errorf("the URL of the Gitea server must be set")
+	}
+
+	token, err := r.providerToken(ctx, generator)
+	if err != nil {
+		return err
+	}
+	provider := &gitProviderClient{provider: spec.Provider, token: token, httpClient: r.HTTPClient}
+	refs, err := provider.refs(ctx, spec.Source)
+	if err != nil {
+		return fmt.Errorf("unable to poll %s/%s: %w", spec.Provider.Owner, spec.Provider.Repository, err)
+	}
+	now := metav1.Now()
+	generator.Status.LastPollTime = &now
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Number != refs[j].Number {
+			return refs[i].Number < refs[j].Number
+		}
+		return refs[i].Branch < refs[j].Branch
+	})
+
+	var generated []kyaninusv1.GeneratedVersion
+	wanted := map[string]bool{}
+	for _, ref := range refs {
+		if !render.matches(ref) {
+			continue
+		}
+		if _, ok := generatedVersionName(generator, ref); !ok {
+			log.Info(fmt.Sprintf("%s %s", "Skipping ref without a valid version name", ref.Branch))
+			continue
+		}
+
+		version, status, err := render.version(ref)
+		if err != nil {
+			return err
+		}
+		if err := r.applyVersion(ctx, generator, version); err != nil {
+			generator.Status.Versions = generated
+			return err
+		}
+		wanted[version.Name] = true
+		generated = append(generated, status)
+	}
+	generator.Status.Versions = generated
+
+	var versions kyaninusv1.DeploymentVersionList
+	if err := r.List(ctx, &versions, client.InNamespace(generator.Namespace),
+		client.MatchingLabels{kyaninusv1.GeneratorLabel: generator.Name}); err != nil {
+		return err
+	}
+	for i := range versions.Items {
+		version := &versions.Items[i]
+		if wanted[version.Name] {
+			continue
+		}
+		if err := r.deleteVersion(ctx, generator, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteVersion deletes a version the generator created.
+func (r *VersionGeneratorReconciler) deleteVersion(ctx context.Context, generator *kyaninusv1.VersionGenerator, version *kyaninusv1.DeploymentVersion) error {
+	if !metav1.IsControlledBy(version, generator) || !version.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	log.FromContext(ctx).Info(fmt.Sprintf("%s %s", "Deleting generated version", version.Name))
+	return client.IgnoreNotFound(r.Delete(ctx, version))
+}
+
+// versionRenderer renders the versions of a generator for single branches.
+type versionRenderer struct {
+	generator *kyaninusv1.VersionGenerator
+	pattern   *regexp.Regexp
+	image     *template.Template
+}
+
+func newVersionRenderer(generator *kyaninusv1.VersionGenerator) (*versionRenderer, error) {
+	pattern, err := regexp.Compile(generator.Spec.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	image, err := template.New("image").Option("missingkey=error").Parse(generator.Spec.Image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image template: %w", err)
+	}
+	return &versionRenderer{generator: generator, pattern: pattern, image: image}, nil
+}
+
+// matches reports whether the generator creates a version for a ref.
+func (v *versionRenderer) matches(ref gitRef) bool {
+	return v.pattern.MatchString(ref.Branch)
+}
+
+// version renders the DeploymentVersion of a ref, and its status entry.
+func (v *versionRenderer) version(ref gitRef) (*kyaninusv1.DeploymentVersion, kyaninusv1.GeneratedVersion, error) {
+	var rendered bytes.Buffer
+	if err := v.image.Execute(&rendered, newImageData(ref)); err != nil {
+		return nil, kyaninusv1.GeneratedVersion{}, fmt.Errorf("unable to render the image of %s: %w", ref.Branch, err)
+	}
+	name, ok := generatedVersionName(v.generator, ref)
+	if !ok {
+		return nil, kyaninusv1.GeneratedVersion{}, fmt.Errorf("no valid version name for %s", ref.Branch)
+	}
+	version, err := newGeneratedVersion(v.generator, name, v.generator.Spec.Container, rendered.String())
+	if err != nil {
+		return nil, kyaninusv1.GeneratedVersion{}, err
+	}
+	return version, kyaninusv1.GeneratedVersion{
+		Name:   name,
+		Branch: ref.Branch,
+		SHA:    ref.SHA,
+		Number: ref.Number,
+		Image:  rendered.String(),
+	}, nil
+}
+
+// providerToken reads the API token of the provider from its Secret.
+func (r *VersionGeneratorReconciler) providerToken(ctx context.Context, generator *kyaninusv1.VersionGenerator) (string, error) {
+	ref := generator.Spec.Provider.TokenSecretRef
+	if ref == nil {
+		return "", nil
+	}
+	var secret corev1.Secret
+	if err := r.Get(ctx, types.NamespacedName{Namespace: generator.Namespace, Name: ref.Name}, &secret); err != nil {
+		if apierrors.IsNotFound(err) && ref.Optional != nil && *ref.Optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to fetch token Secret %s: %w", ref.Name, err)
+	}
+	token, ok := secret.Data[ref.Key]
+	if !ok && (ref.Optional == nil || !*ref.Optional) {
+		return "", fmt.Errorf("token Secret %s has no key %s", ref.Name, ref.Key)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// applyVersion creates the version, or updates it when the spec generated for
+// it changed since it was last written.
+func (r *VersionGeneratorReconciler) applyVersion(ctx context.Context, generator *kyaninusv1.VersionGenerator, version *kyaninusv1.DeploymentVersion) error {
+	log := log.FromContext(ctx)
+
+	existing := &kyaninusv1.DeploymentVersion{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(version), existing)
+	if apierrors.IsNotFound(err) {
+		if err := ctrl.SetControllerReference(generator, version, r.Scheme); err != nil {
+			return err
+		}
+		log.Info(fmt.Sprintf("%s %s", "Creating generated version", version.Name))
+		return r.Create(ctx, version)
+	}
+	if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(existing, generator) {
+		return fmt.Errorf("DeploymentVersion %s already exists and is not owned by VersionGenerator %s",
+			version.Name, generator.Name)
+	}
+	if existing.Annotations[generatorSpecAnnotation] == version.Annotations[generatorSpecAnnotation] {
+		return nil
+	}
+
+	// The selector of the generated workload is immutable, keep the one the
+	// version was created with.
+	selector := existing.Spec.DeploymentSpec.Selector
+	existing.Spec = version.Spec
+	if selector != nil {
+		existing.Spec.DeploymentSpec.Selector = selector
+	}
+	existing.Labels = mergeStringMaps(existing.Labels, version.Labels)
+	existing.Annotations = mergeStringMaps(existing.Annotations, version.Annotations)
+	log.Info(fmt.Sprintf("%s %s", "Updating generated version", version.Name))
+	return r.Update(ctx, existing)
+}
+
+// newGeneratedVersion renders the template of a generator into a
+// DeploymentVersion running image in container.
+func newGeneratedVersion(generator *kyaninusv1.VersionGenerator, name, container, image string) (*kyaninusv1.DeploymentVersion, error) {
+	versionTemplate := generator.Spec.Template.DeepCopy()
+	version := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   generator.Namespace,
+			Labels:      mergeStringMaps(versionTemplate.Labels, map[string]string{kyaninusv1.GeneratorLabel: generator.Name}),
+			Annotations: versionTemplate.Annotations,
+		},
+		Spec: versionTemplate.Spec,
+	}
+	if version.Spec.Namespace == "" {
+		version.Spec.Namespace = generator.Namespace
+	}
+	if version.Spec.Images == nil {
+		version.Spec.Images = map[string]string{}
+	}
+	version.Spec.Images[container] = image
+
+	raw, err := json.Marshal(version.Spec)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(raw)
+	version.Annotations = mergeStringMaps(version.Annotations, map[string]string{
+		generatorSpecAnnotation: hex.EncodeToString(hash[:])[:16],
+	})
+	return version, nil
+}
+
+// generatedVersionName names the version of a pull request after its number,
+// and the version of a branch after the branch. Names are valid DNS labels, so
+// they can be used as hosts by Routers. A branch whose name had to be altered
+// or truncated to fit gets a short hash of its name appended, so that e.g.
+// feature/a and feature-a get versions of their own. It reports false when no
+// valid name can be made, e.g. for a generator with a long name.
+func generatedVersionName(generator *kyaninusv1.VersionGenerator, ref gitRef) (string, bool) {
+	if ref.Number > 0 {
+		name := fmt.Sprintf("%s-pr-%d", generator.Name, ref.Number)
+		return name, len(validation.IsDNS1123Label(name)) == 0
+	}
+	slug := strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(ref.Branch), "-"), "-")
+	name := generator.Name + "-" + slug
+	if slug != ref.Branch || len(name) > validation.DNS1123LabelMaxLength {
+		hash := sha256.Sum256([]byte(ref.Branch))
+		suffix := "-" + hex.EncodeToString(hash[:])[:8]
+		name = strings.TrimRight(name, "-")
+		if max := validation.DNS1123LabelMaxLength - len(suffix); len(name) > max {
+			name = strings.TrimRight(name[:max], "-")
+		}
+		name += suffix
+	}
+	return name, len(validation.IsDNS1123Label(name)) == 0
+}
+
+func newImageData(ref gitRef) imageData {
+	data := imageData{
+		Branch:    strings.TrimLeft(invalidTagChars.ReplaceAllString(ref.Branch, "-"), ".-"),
+		RawBranch: ref.Branch,
+		SHA:       ref.SHA,
+		ShortSHA:  ref.SHA,
+		Number:    ref.Number,
+	}
+	if len(data.ShortSHA) > 7 {
+		data.ShortSHA = data.ShortSHA[:7]
+	}
+	return data
+}
+
+func mergeStringMaps(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for key, value := range a {
+		merged[key] = value
+	}
+	for key, value := range b {
+		merged[key] = value
+	}
+	return merged
+}
+
+func setGeneratorCondition(generator *kyaninusv1.VersionGenerator, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&generator.Status.Conditions, metav1.Condition{
+		Type:               kyaninusv1.ConditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: generator.Generation,
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager. Generators are
+// polled on their interval, so only changes to their spec trigger an early
+// reconcile; the status written by every poll does not.
+func (r *VersionGeneratorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&kyaninusv1.VersionGenerator{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
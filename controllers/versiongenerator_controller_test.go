@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kyaninusv1 "codepraxis.com/kyaninus/api/v1"
+)
+
+// fakeGitAPI serves the branch and pull request listings of a single
+// repository in the shape of the GitHub, or with gitea set the Gitea, API.
+type fakeGitAPI struct {
+	mu       sync.Mutex
+	gitea    bool
+	branches []gitRef
+	pulls    []gitRef
+	fail     bool
+	// tokens records the Authorization headers received.
+	tokens []string
+}
+
+func (f *fakeGitAPI) set(update func(f *fakeGitAPI)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update(f)
+}
+
+func (f *fakeGitAPI) serve(t *testing.T) *httptest.Server {
+	t.Helper()
+	prefix := "/repos/acme/myapp/"
+	if f.gitea {
+		prefix = "/api/v1" + prefix
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.tokens = append(f.tokens, req.Header.Get("Authorization"))
+		if f.fail {
+			http.Error(w, "rate limited", http.StatusForbidden)
+			return
+		}
+
+		sizeParam := "per_page"
+		if f.gitea {
+			sizeParam = "limit"
+		}
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		size, _ := strconv.Atoi(req.URL.Query().Get(sizeParam))
+		if page < 1 || size < 1 {
+			http.Error(w, "bad paging", http.StatusBadRequest)
+			return
+		}
+
+		var items []interface{}
+		switch req.URL.Path {
+		case prefix + "branches":
+			for _, branch := range f.branches {
+				commit := map[string]string{"sha": branch.SHA}
+				if f.gitea {
+					commit = map[string]string{"id": branch.SHA}
+				}
+				items = append(items, map[string]interface{}{"name": branch.Branch, "commit": commit})
+			}
+		case prefix + "pulls":
+			if req.URL.Query().Get("state") != "open" {
+				http.Error(w, "expected open pulls", http.StatusBadRequest)
+				return
+			}
+			for _, pull := range f.pulls {
+				items = append(items, map[string]interface{}{
+					"number": pull.Number,
+					"state":  "open",
+					"head":   map[string]string{"ref": pull.Branch, "sha": pull.SHA},
+				})
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+
+		start, end := (page-1)*size, page*size
+		if start > len(items) {
+			start = len(items)
+		}
+		if end > len(items) {
+			end = len(items)
+		}
+		_ = json.NewEncoder(w).Encode(append([]interface{}{}, items[start:end]...))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testGenerator(url string) *kyaninusv1.VersionGenerator {
+	return &kyaninusv1.VersionGenerator{
+		ObjectMeta: metav1.ObjectMeta{Name: "previews", Namespace: "default", UID: "gen", Generation: 1},
+		Spec: kyaninusv1.VersionGeneratorSpec{
+			Provider: kyaninusv1.GitProvider{
+				Type:       kyaninusv1.GitProviderGitHub,
+				URL:        url,
+				Owner:      "acme",
+				Repository: "myapp",
+			},
+			Source:    kyaninusv1.GitSourcePullRequests,
+			Pattern:   "^feature/",
+			Container: "app",
+			Image:     "myapp:{{.Branch}}-{{.ShortSHA}}",
+			Template: kyaninusv1.VersionTemplate{
+				Labels: map[string]string{"app": "myapp"},
+				Spec: kyaninusv1.DeploymentVersionSpec{
+					Name:       "myapp",
+					ServiceRef: &corev1.LocalObjectReference{Name: "myapp"},
+				},
+			},
+		},
+	}
+}
+
+func newGeneratorReconciler(t *testing.T, objs ...client.Object) *VersionGeneratorReconciler {
+	scheme := newTestScheme(t)
+	return &VersionGeneratorReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme: scheme,
+	}
+}
+
+func reconcileGenerator(t *testing.T, r *VersionGeneratorReconciler, generator *kyaninusv1.VersionGenerator) (*kyaninusv1.VersionGenerator, error) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(generator)})
+	var updated kyaninusv1.VersionGenerator
+	if getErr := r.Get(ctx, client.ObjectKeyFromObject(generator), &updated); getErr != nil {
+		t.Fatal(getErr)
+	}
+	return &updated, err
+}
+
+func TestVersionGeneratorPullRequests(t *testing.T) {
+	api := &fakeGitAPI{pulls: []gitRef{
+		{Branch: "feature/login", SHA: "abcdef1234567890", Number: 12},
+		{Branch: "fix/typo", SHA: "1234567890abcdef", Number: 13},
+	}}
+	server := api.serve(t)
+	generator := testGenerator(server.URL)
+	generator.Spec.Provider.TokenSecretRef = &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "github"}, Key: "token",
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "github", Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("s3cret\n")},
+	}
+	r := newGeneratorReconciler(t, generator, secret)
+	ctx := context.Background()
+
+	updated, err := reconcileGenerator(t, r, generator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "previews-pr-12"}, &version); err != nil {
+		t.Fatal(err)
+	}
+	if got := version.Spec.Images["app"]; got != "myapp:feature-login-abcdef1" {
+		t.Errorf("image = %s, want myapp:feature-login-abcdef1", got)
+	}
+	if version.Spec.Name != "myapp" || version.Labels["app"] != "myapp" || version.Labels[kyaninusv1.GeneratorLabel] != "previews" {
+		t.Errorf("version %+v does not follow the template", version.ObjectMeta)
+	}
+	if !metav1.IsControlledBy(&version, generator) {
+		t.Error("expected the version to be owned by the generator")
+	}
+	err = r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "previews-pr-13"}, &version)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected no version for a branch not matching the pattern, got %v", err)
+	}
+
+	if len(updated.Status.Versions) != 1 || updated.Status.Versions[0].Number != 12 {
+		t.Errorf("status versions %+v, want the version of #12", updated.Status.Versions)
+	}
+	if updated.Status.LastPollTime == nil || !meta.IsStatusConditionTrue(updated.Status.Conditions, kyaninusv1.ConditionReady) {
+		t.Errorf("expected a successful poll, got %+v", updated.Status)
+	}
+	if api.tokens[0] != "token s3cret" {
+		t.Errorf("Authorization = %q, want the token of the Secret", api.tokens[0])
+	}
+
+	// A new commit is pushed to the pull request.
+	api.set(func(f *fakeGitAPI) { f.pulls[0].SHA = "0fedcba987654321" })
+	if _, err := reconcileGenerator(t, r, generator); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "previews-pr-12"}, &version); err != nil {
+		t.Fatal(err)
+	}
+	if got := version.Spec.Images["app"]; got != "myapp:feature-login-0fedcba" {
+		t.Errorf("image = %s, want the new commit", got)
+	}
+
+	// The pull request is closed.
+	api.set(func(f *fakeGitAPI) { f.pulls = f.pulls[1:] })
+	updated, err = reconcileGenerator(t, r, generator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "previews-pr-12"}, &version)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the version of a closed pull request to be deleted, got %v", err)
+	}
+	if len(updated.Status.Versions) != 0 {
+		t.Errorf("status versions %+v, want none", updated.Status.Versions)
+	}
+}
+
+func TestVersionGeneratorKeepsDefaultedSelector(t *testing.T) {
+	api := &fakeGitAPI{pulls: []gitRef{{Branch: "feature/login", SHA: "abcdef1234567890", Number: 12}}}
+	server := api.serve(t)
+	generator := testGenerator(server.URL)
+	r := newGeneratorReconciler(t, generator)
+	ctx := context.Background()
+
+	if _, err := reconcileGenerator(t, r, generator); err != nil {
+		t.Fatal(err)
+	}
+
+	// The defaulting webhook extends the selector of new versions.
+	var version kyaninusv1.DeploymentVersion
+	key := types.NamespacedName{Namespace: "default", Name: "previews-pr-12"}
+	if err := r.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	version.Spec.DeploymentSpec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{kyaninusv1.VersionLabel: version.Name}}
+	if err := r.Update(ctx, &version); err != nil {
+		t.Fatal(err)
+	}
+	resourceVersion := version.ResourceVersion
+
+	if _, err := reconcileGenerator(t, r, generator); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.ResourceVersion != resourceVersion {
+		t.Error("expected an unchanged version not to be updated")
+	}
+
+	api.set(func(f *fakeGitAPI) { f.pulls[0].SHA = "0fedcba987654321" })
+	if _, err := reconcileGenerator(t, r, generator); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Spec.DeploymentSpec.Selector == nil || version.Spec.Images["app"] != "myapp:feature-login-0fedcba" {
+		t.Errorf("expected the image to be updated and the selector kept, got %+v", version.Spec)
+	}
+}
+
+func TestVersionGeneratorGiteaBranches(t *testing.T) {
+	api := &fakeGitAPI{gitea: true}
+	for i := 0; i < gitPageSize; i++ {
+		api.branches = append(api.branches, gitRef{Branch: fmt.Sprintf("main-%d", i), SHA: "0000000"})
+	}
+	api.branches = append(api.branches, gitRef{Branch: "feature/Checkout_V2", SHA: "cafebabe12345678"})
+	server := api.serve(t)
+
+	generator := testGenerator(server.URL)
+	generator.Spec.Provider.Type = kyaninusv1.GitProviderGitea
+	generator.Spec.Source = kyaninusv1.GitSourceBranches
+	generator.Spec.Image = "registry.local/myapp:{{.Branch}}-{{.SHA}}"
+	r := newGeneratorReconciler(t, generator)
+
+	updated, err := reconcileGenerator(t, r, generator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version kyaninusv1.DeploymentVersion
+	key := types.NamespacedName{Namespace: "default", Name: "previews-feature-checkout-v2-b92b740a"}
+	if err := r.Get(context.Background(), key, &version); err != nil {
+		t.Fatalf("expected a version for the branch on the second page: %v", err)
+	}
+	if got := version.Spec.Images["app"]; got != "registry.local/myapp:feature-Checkout_V2-cafebabe12345678" {
+		t.Errorf("image = %s", got)
+	}
+	if len(updated.Status.Versions) != 1 || updated.Status.Versions[0].Branch != "feature/Checkout_V2" {
+		t.Errorf("status versions %+v", updated.Status.Versions)
+	}
+}
+
+func TestVersionGeneratorPollFailureKeepsVersions(t *testing.T) {
+	api := &fakeGitAPI{pulls: []gitRef{{Branch: "feature/login", SHA: "abcdef1234567890", Number: 12}}}
+	server := api.serve(t)
+	generator := testGenerator(server.URL)
+	r := newGeneratorReconciler(t, generator)
+
+	if _, err := reconcileGenerator(t, r, generator); err != nil {
+		t.Fatal(err)
+	}
+
+	api.set(func(f *fakeGitAPI) { f.fail = true })
+	updated, err := reconcileGenerator(t, r, generator)
+	if err == nil {
+		t.Fatal("expected an error when the provider cannot be polled")
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, kyaninusv1.ConditionReady)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "GenerateFailed" {
+		t.Errorf("Ready condition %+v, want GenerateFailed", condition)
+	}
+
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "previews-pr-12"}, &version); err != nil {
+		t.Errorf("expected the version to be kept while the provider is unavailable, got %v", err)
+	}
+}
+
+func TestGitProviderTimesOut(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	defer func(timeout time.Duration) { gitProviderTimeout = timeout }(gitProviderTimeout)
+	gitProviderTimeout = 50 * time.Millisecond
+
+	provider := &gitProviderClient{provider: kyaninusv1.GitProvider{URL: server.URL, Owner: "acme", Repository: "shop"}}
+	if _, err := provider.refs(context.Background(), kyaninusv1.GitSourcePullRequests); err == nil {
+		t.Fatal("expected a hung provider to time out")
+	}
+}
+
+func TestVersionGeneratorSkipsUnownedVersion(t *testing.T) {
+	api := &fakeGitAPI{pulls: []gitRef{{Branch: "feature/login", SHA: "abcdef1234567890", Number: 12}}}
+	server := api.serve(t)
+	generator := testGenerator(server.URL)
+	unowned := &kyaninusv1.DeploymentVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "previews-pr-12", Namespace: "default"},
+		Spec:       kyaninusv1.DeploymentVersionSpec{Name: "myapp"},
+	}
+	r := newGeneratorReconciler(t, generator, unowned)
+
+	if _, err := reconcileGenerator(t, r, generator); err == nil {
+		t.Fatal("expected an error for a version name taken by an unowned DeploymentVersion")
+	}
+	var version kyaninusv1.DeploymentVersion
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(unowned), &version); err != nil {
+		t.Fatal(err)
+	}
+	if len(version.Spec.Images) != 0 {
+		t.Error("expected the unowned version to be left alone")
+	}
+}
+
+func TestGeneratedVersionName(t *testing.T) {
+	generator := &kyaninusv1.VersionGenerator{ObjectMeta: metav1.ObjectMeta{Name: "previews"}}
+	tests := []struct {
+		ref  gitRef
+		want string
+	}{
+		{ref: gitRef{Branch: "feature/login", Number: 7}, want: "previews-pr-7"},
+		{ref: gitRef{Branch: "hotfix"}, want: "previews-hotfix"},
+		{ref: gitRef{Branch: "Feature/Login_Page"}, want: "previews-feature-login-page-12ff048e"},
+		{ref: gitRef{Branch: "-hotfix-"}, want: "previews-hotfix-534d1644"},
+		{ref: gitRef{Branch: "日本語"}, want: "previews-77710aed"},
+		{
+			ref:  gitRef{Branch: "feature/a-very-long-branch-name-that-does-not-fit-into-a-label"},
+			want: "previews-feature-a-very-long-branch-name-that-does-not-512448df",
+		},
+	}
+	for _, tt := range tests {
+		got, ok := generatedVersionName(generator, tt.ref)
+		if !ok || got != tt.want {
+			t.Errorf("generatedVersionName(%q) = %s, %t, want %s", tt.ref.Branch, got, ok, tt.want)
+		}
+	}
+
+	for _, branches := range [][2]string{
+		{"feature/a", "feature-a"},
+		{
+			"feature-a-very-long-branch-name-that-does-not-fit-into-a-label-1",
+			"feature-a-very-long-branch-name-that-does-not-fit-into-a-label-2",
+		},
+	} {
+		first, _ := generatedVersionName(generator, gitRef{Branch: branches[0]})
+		second, _ := generatedVersionName(generator, gitRef{Branch: branches[1]})
+		if first == second {
+			t.Errorf("branches %q and %q share the version name %s", branches[0], branches[1], first)
+		}
+	}
+
+	long := &kyaninusv1.VersionGenerator{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("g", 60)}}
+	if name, ok := generatedVersionName(long, gitRef{Branch: "main", Number: 1234}); ok {
+		t.Errorf("expected no valid name for a long generator name, got %s", name)
+	}
+}
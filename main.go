@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"flag"
 	"os"
 
@@ -52,8 +53,30 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var prometheusURL string
+	var activityQuery string
+	var enableWebhooks bool
+	var allowCrossNamespace bool
+	var watchRollouts bool
+	var receiverAddr string
+	var receiverSecretFile string
+	var receiverAllowList string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&prometheusURL, "prometheus-url", "", "The Prometheus server queried by DeploymentVersion canary analyses.")
+	flag.StringVar(&activityQuery, "activity-query", controllers.DefaultActivityQuery,
+		"The PromQL template counting recent requests to a DeploymentVersion, used by expireAfterIdle.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Serve the DeploymentVersion admission webhooks.")
+	flag.BoolVar(&allowCrossNamespace, "allow-cross-namespace-base", true,
+		"Allow a DeploymentVersion to clone a base Deployment from another namespace.")
+	flag.BoolVar(&watchRollouts, "watch-rollouts", false,
+		"Watch Argo Rollouts so versions of them are kept up to date. Requires the Rollout CRD.")
+	flag.StringVar(&receiverAddr, "receiver-bind-address", "0",
+		"The address the webhook receiver for CI systems binds to. Set to 0 to disable the receiver.")
+	flag.StringVar(&receiverSecretFile, "receiver-secret-file", "",
+		"The file holding the key the payloads of the webhook receiver are signed with.")
+	flag.StringVar(&receiverAllowList, "receiver-allow-list", "",
+		"The file listing, per namespace, the repositories and base workloads the webhook receiver may change.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -79,12 +102,61 @@ func main() {
 	}
 
 	if err = (&controllers.DeploymentVersionReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		PrometheusURL: prometheusURL,
+		ActivityQuery: activityQuery,
+		WatchRollouts: watchRollouts,
+		Recorder:      mgr.GetEventRecorderFor("deploymentversion-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DeploymentVersion")
+		os.Exit(1)
+	}
+	if err = (&controllers.RouterReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "DeploymentVersion")
+		setupLog.Error(err, "unable to create controller", "controller", "Router")
+		os.Exit(1)
+	}
+	if err = (&controllers.VersionGeneratorReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VersionGenerator")
 		os.Exit(1)
 	}
+	if receiverAddr != "0" {
+		receiver := &controllers.Receiver{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+			Addr:   receiverAddr,
+		}
+		secret, err := os.ReadFile(receiverSecretFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read the webhook receiver secret")
+			os.Exit(1)
+		}
+		receiver.Secret = bytes.TrimSpace(secret)
+		if len(receiver.Secret) == 0 {
+			setupLog.Error(nil, "the webhook receiver secret is empty")
+			os.Exit(1)
+		}
+		if receiver.AllowList, err = controllers.ReadReceiverAllowList(receiverAllowList); err != nil {
+			setupLog.Error(err, "unable to read the webhook receiver allow-list")
+			os.Exit(1)
+		}
+		if err := mgr.Add(receiver); err != nil {
+			setupLog.Error(err, "unable to add the webhook receiver")
+			os.Exit(1)
+		}
+	}
+	if enableWebhooks {
+		if err = (&kyaninusv1.DeploymentVersion{}).SetupWebhookWithManager(mgr, allowCrossNamespace); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DeploymentVersion")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {